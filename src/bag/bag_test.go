@@ -0,0 +1,711 @@
+package bag_test
+
+import (
+	"eventdispatcher"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"bag"
+	"bag/bagtest"
+)
+
+const (
+	tidPotion  = 1001 //>> 可堆叠, 有负重
+	tidOre     = 1002 //>> 可堆叠
+	tidElixir  = 1003 //>> 有等级要求和冷却
+	tidGift    = 1004 //>> 礼包
+	tidStone   = 1005 //>> 很重, 整堆的负重超过int32
+	tidSword   = 2001 //>> 不可堆叠的武器
+	tidHelmet  = 2002
+	tidGold    = 3001 //>> 货币
+	tidDiamond = 3002 //>> 货币, 有持有上限
+)
+
+var testTemplates = bag.ItemTemplateTable{
+	tidPotion:  {TID: tidPotion, Weight: 1, MaxOverlap: 20},
+	tidOre:     {TID: tidOre, MaxOverlap: 99},
+	tidElixir:  {TID: tidElixir, MaxOverlap: 20, UseLevel: 10, CDGroup: 1, CDTime: 60000},
+	tidGift:    {TID: tidGift, MaxOverlap: 20},
+	tidStone:   {TID: tidStone, Weight: 1 << 20, MaxOverlap: 1 << 20},
+	tidSword:   {TID: tidSword, Weight: 5, EquipSlot: int32(bag.KEquipSlotWeapon)},
+	tidHelmet:  {TID: tidHelmet, Weight: 3, EquipSlot: int32(bag.KEquipSlotHelmet)},
+	tidGold:    {TID: tidGold, Type: bag.KItemTypeCurrency},
+	tidDiamond: {TID: tidDiamond, Type: bag.KItemTypeCurrency, MaxHold: 1000},
+}
+
+func init() {
+	bag.SetItemTemplateProvider(testTemplates)
+}
+
+func TestItemBase(t *testing.T) {
+	bagtest.RunItemTests(t, func() bag.ItemInterface { return bag.NewItem(tidPotion, 1) })
+}
+
+func TestBag(t *testing.T) {
+	bagtest.RunContainerTests(t, bagtest.ContainerConfig{
+		New:  func() bag.ContainerInterface { return bag.NewBag(10, 300) },
+		TIDs: []int32{tidPotion, tidOre, tidSword},
+	})
+}
+
+func TestWarehouse(t *testing.T) {
+	bagtest.RunContainerTests(t, bagtest.ContainerConfig{
+		New:  func() bag.ContainerInterface { return bag.NewWarehouse(0, 0) },
+		TIDs: []int32{tidPotion, tidOre, tidSword},
+	})
+}
+
+func TestEquipment(t *testing.T) {
+	bagtest.RunContainerTests(t, bagtest.ContainerConfig{
+		New:  func() bag.ContainerInterface { return bag.NewEquipment(bag.DefaultEquipSlots) },
+		TIDs: []int32{tidSword, tidHelmet},
+	})
+}
+
+func TestWallet(t *testing.T) {
+	bagtest.RunContainerTests(t, bagtest.ContainerConfig{
+		New:        func() bag.ContainerInterface { return bag.NewWallet() },
+		TIDs:       []int32{tidGold, tidDiamond},
+		MaxOverlap: func(int32) int64 { return math.MaxInt64 },
+	})
+}
+
+func TestWalletLimits(t *testing.T) {
+	wallet := bag.NewWallet()
+	if _, err := wallet.AddItem(tidGold, math.MaxInt64, 1); err != nil {
+		t.Fatalf("AddItem max gold: %v", err)
+	}
+	if _, err := wallet.AddItem(tidGold, 1, 1); err == nil || err.Code != bag.ErrExceedLimit {
+		t.Fatalf("gold overflow: got %v, want ErrExceedLimit", err)
+	}
+	if _, err := wallet.AddItem(tidDiamond, 1001, 1); err == nil || err.Code != bag.ErrExceedLimit {
+		t.Fatalf("diamond over cap: got %v, want ErrExceedLimit", err)
+	}
+	if err := wallet.ReduceItemByTID(tidGold, math.MaxInt64, 1); err != nil {
+		t.Fatalf("ReduceItemByTID: %v", err)
+	}
+	if err := wallet.ReduceItemByTID(tidGold, 1, 1); err == nil {
+		t.Fatal("balance went negative")
+	}
+}
+
+func TestComponentMixedAdd(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	items := []bag.ItemTidDesc{{TID: tidGold, Count: 100}, {TID: tidPotion, Count: 30}}
+	if _, err := component.AddItems(bag.KContainerTypeBag, items, 1); err != nil {
+		t.Fatalf("AddItems: %v", err)
+	}
+	if got := component.GetContainerByType(bag.KContainerTypeWallet).GetItemCount(tidGold); got != 100 {
+		t.Fatalf("wallet gold = %d, want 100", got)
+	}
+	if got := component.GetContainerByType(bag.KContainerTypeBag).GetItemCount(tidPotion); got != 30 {
+		t.Fatalf("bag potion = %d, want 30", got)
+	}
+
+	//>> 钻石超上限, 整批都不能加
+	items = []bag.ItemTidDesc{{TID: tidPotion, Count: 1}, {TID: tidDiamond, Count: 2000}}
+	if _, err := component.AddItems(bag.KContainerTypeBag, items, 1); err == nil {
+		t.Fatal("AddItems over diamond cap should fail")
+	}
+	if got := component.GetContainerByType(bag.KContainerTypeBag).GetItemCount(tidPotion); got != 30 {
+		t.Fatalf("failed AddItems changed potion to %d", got)
+	}
+}
+
+func TestComponentReduceAndAddByUID(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+
+	//>> 卖掉剑换金币, 金币进钱包
+	del := []bag.ItemUidDesc{{UID: swords[0].GetUID(), Count: 1}}
+	give := []bag.ItemTidDesc{{TID: tidGold, Count: 50}, {TID: tidPotion, Count: 2}}
+	if err := component.ReduceAndAddItemByUID(bag.KContainerTypeBag, del, give, 1); err != nil {
+		t.Fatalf("ReduceAndAddItemByUID: %v", err)
+	}
+	if got := component.GetContainerByType(bag.KContainerTypeWallet).GetItemCount(tidGold); got != 50 {
+		t.Fatalf("wallet gold = %d, want 50", got)
+	}
+	if component.GetItemCount(tidSword) != 0 || component.GetItemCount(tidPotion) != 2 {
+		t.Fatalf("after exchange: sword %d potion %d", component.GetItemCount(tidSword), component.GetItemCount(tidPotion))
+	}
+
+	//>> 钻石超上限, 扣掉的药水也要还回来
+	potion := component.GetItemsByTID(tidPotion)[0]
+	del = []bag.ItemUidDesc{{UID: potion.GetUID(), Count: 2}}
+	if err := component.ReduceAndAddItemByUID(bag.KContainerTypeBag, del, []bag.ItemTidDesc{{TID: tidDiamond, Count: 2000}}, 1); err == nil {
+		t.Fatal("exchange over the diamond cap should fail")
+	}
+	if component.GetItemCount(tidPotion) != 2 {
+		t.Fatalf("failed exchange changed potion to %d", component.GetItemCount(tidPotion))
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	component := bag.NewItemComponent(7)
+	component.AddItem(bag.KContainerTypeBag, tidPotion, 45, 1)
+	component.AddItem(bag.KContainerTypeBag, tidGold, 500, 1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	component.ModifyItemAttrs(swords[0].GetUID(), func(attrs *bag.ItemAttrs) {
+		attrs.SetInt(bag.AttrEnhanceLevel, 3)
+	})
+	component.StartCooldown(1, 60000)
+
+	for name, codec := range map[string]struct {
+		marshal   func(*bag.ItemComponent) ([]byte, error)
+		unmarshal func(*bag.ItemComponent, []byte) error
+	}{
+		"binary": {
+			func(c *bag.ItemComponent) ([]byte, error) { return c.Marshal(), nil },
+			(*bag.ItemComponent).Unmarshal,
+		},
+		"json": {
+			(*bag.ItemComponent).MarshalJSON,
+			(*bag.ItemComponent).UnmarshalJSON,
+		},
+	} {
+		data, err := codec.marshal(component)
+		if err != nil {
+			t.Fatalf("%s marshal: %v", name, err)
+		}
+		loaded := bag.NewItemComponent(7)
+		if err := codec.unmarshal(loaded, data); err != nil {
+			t.Fatalf("%s unmarshal: %v", name, err)
+		}
+
+		if got := loaded.GetItemCount(tidPotion); got != 45 {
+			t.Errorf("%s: potion = %d, want 45", name, got)
+		}
+		if got := loaded.GetItemCount(tidGold); got != 500 {
+			t.Errorf("%s: gold = %d, want 500", name, got)
+		}
+		sword := loaded.GetItemByUID(swords[0].GetUID())
+		if sword == nil || sword.GetAttrs().GetInt(bag.AttrEnhanceLevel) != 3 {
+			t.Errorf("%s: sword attrs lost", name)
+		}
+		if left := loaded.GetCooldownLeft(1); left <= 0 || left > 60000 {
+			t.Errorf("%s: cooldown left = %d", name, left)
+		}
+	}
+}
+
+func TestComponentRollback(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	sword := component.GetItemsByTID(tidSword)[0]
+
+	err := component.Atomic(func() bag.ItemError {
+		if err := component.Transfer(sword.GetUID(), bag.KContainerTypeBag, bag.KContainerTypeEquip, 0); err != nil {
+			return err
+		}
+		_, err := component.AddItem(bag.KContainerTypeBag, tidPotion, -1, 1)
+		return err
+	})
+	if err == nil {
+		t.Fatal("Atomic should fail")
+	}
+	if component.GetContainerByType(bag.KContainerTypeBag).GetItemByUID(sword.GetUID()) == nil {
+		t.Fatal("rollback did not move the sword back to the bag")
+	}
+	if component.GetContainerByType(bag.KContainerTypeEquip).GetSize() != 0 {
+		t.Fatal("rollback left the sword in the equipment")
+	}
+}
+
+func TestAsyncReduce(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+
+	var pending *bag.ReduceReservation
+	component.SetAsyncReduceHandler(func(res *bag.ReduceReservation) { pending = res }, 0)
+
+	var result bag.ItemError
+	done := false
+	component.AsyncReduceItem(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 8}}, 1, func(err bag.ItemError) {
+		result, done = err, true
+	})
+	if pending == nil || done {
+		t.Fatal("reservation should wait for confirmation")
+	}
+	if err := component.TryReduceItemByTID(bag.KContainerTypeBag, tidOre, 3); err == nil {
+		t.Fatal("frozen ore should not be reducible")
+	}
+
+	component.ConfirmReduce(pending.ID, nil)
+	component.Update()
+	if !done || result != nil {
+		t.Fatalf("confirm: done %v err %v", done, result)
+	}
+	if got := component.GetItemCount(tidOre); got != 2 {
+		t.Fatalf("ore = %d, want 2", got)
+	}
+}
+
+func TestDeltaCoalesce(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	var deltas []*bag.ItemDelta
+	component.SetSyncHandler(func(delta *bag.ItemDelta) { deltas = append(deltas, delta) })
+
+	added, _ := component.AddItem(bag.KContainerTypeBag, tidOre, 5, 1)
+	component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 2, 1)
+	component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	component.ReduceItemByTID(bag.KContainerTypeBag, tidSword, 1, 1)
+	component.Update()
+
+	if len(deltas) != 1 || len(deltas[0].Containers) != 1 {
+		t.Fatalf("got %d deltas, want one bag delta", len(deltas))
+	}
+	delta := deltas[0].Containers[0]
+	if len(delta.Added) != 1 || delta.Added[0].UID != added[0].GetUID() || delta.Added[0].Count != 3 {
+		t.Fatalf("added = %+v, want the ore stack with count 3", delta.Added)
+	}
+	if len(delta.Updated) != 0 || len(delta.Deleted) != 0 {
+		t.Fatalf("sword add+del should cancel out: %+v", delta)
+	}
+
+	decoded, err := bag.UnmarshalItemDelta(deltas[0].Marshal())
+	if err != nil || decoded.Containers[0].Added[0].Count != 3 {
+		t.Fatalf("UnmarshalItemDelta: %v", err)
+	}
+}
+
+func TestOverflowMail(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.SetOverflowPolicy(bag.KOverflowMail, 0)
+	bagSize := component.GetContainerByType(bag.KContainerTypeBag).GetMaxSize()
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, int64(bagSize-1), 1)
+
+	result, err := component.AddItemsWithResult(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 150}}, 1)
+	if err != nil {
+		t.Fatalf("AddItemsWithResult: %v", err)
+	}
+	if got := component.GetItemCount(tidOre); got != 99 {
+		t.Fatalf("ore in bag = %d, want 99", got)
+	}
+	if result.Overflow == nil || len(result.Overflow.Items) != 1 || result.Overflow.Items[0].Count != 51 {
+		t.Fatalf("overflow = %+v, want 51 ore", result.Overflow)
+	}
+
+	//>> 存档后邮件还在
+	loaded := bag.NewItemComponent(1)
+	if err := loaded.Unmarshal(component.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if mails := loaded.GetOverflow(); len(mails) != 1 || mails[0].ID != result.Overflow.ID {
+		t.Fatalf("overflow lost after snapshot: %+v", mails)
+	}
+
+	if err := component.ClaimOverflow(result.Overflow.ID); err == nil {
+		t.Fatal("claim should fail while the bag is full")
+	}
+	for _, sword := range swords[:5] {
+		component.ReduceItemByUID(sword.GetUID(), 1, 1)
+	}
+	if err := component.ClaimOverflow(result.Overflow.ID); err != nil {
+		t.Fatalf("ClaimOverflow: %v", err)
+	}
+	if got := component.GetItemCount(tidOre); got != 150 || len(component.GetOverflow()) != 0 {
+		t.Fatalf("after claim: ore %d, mails %d", got, len(component.GetOverflow()))
+	}
+}
+
+func TestItemActor(t *testing.T) {
+	actor := bag.NewItemActor(bag.NewItemComponent(1), 16, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := actor.AddItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 1}}, 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := actor.GetItemCount(tidOre); got != 500 {
+		t.Fatalf("ore = %d, want 500", got)
+	}
+
+	//>> 异步操作按投递顺序执行
+	var order []int
+	for i := 0; i < 5; i++ {
+		i := i
+		actor.ReduceItemsAsync(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 100}}, 1, func(err bag.ItemError) {
+			if err != nil {
+				t.Error(err)
+			}
+			order = append(order, i)
+		})
+	}
+	actor.Stop()
+	if !reflect.DeepEqual(order, []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("async order = %v", order)
+	}
+	if err := actor.ReduceItems(bag.KContainerTypeBag, nil, 1); err == nil || err.Code != bag.ErrActorStopped {
+		t.Fatalf("call after Stop: %v", err)
+	}
+}
+
+func TestItemEvents(t *testing.T) {
+	dispatcher := eventdispatcher.NewEventDispatcher()
+	component := bag.NewItemComponent(1)
+	component.SetEventDispatcher(dispatcher)
+	component.SetEventDelivery(eventdispatcher.EventEnumItemEquipped, bag.KItemEventImmediate)
+
+	var events []string
+	record := func(name string) eventdispatcher.EventCallback {
+		return func(arg interface{}) {
+			evt := arg.(*bag.ItemEvent)
+			events = append(events, fmt.Sprintf("%s %d %d", name, evt.TID, evt.Delta))
+		}
+	}
+	dispatcher.AddListener(eventdispatcher.EventEnumItemAdded, 1, record("added"))
+	dispatcher.AddListener(eventdispatcher.EventEnumItemCountChanged, 1, record("changed"))
+	dispatcher.AddListener(eventdispatcher.EventEnumItemRemoved, 1, record("removed"))
+	dispatcher.AddListener(eventdispatcher.EventEnumItemEquipped, 1, record("equipped"))
+
+	component.AddItem(bag.KContainerTypeBag, tidOre, 5, 1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 3, 1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	component.Transfer(swords[0].GetUID(), bag.KContainerTypeBag, bag.KContainerTypeEquip, 0)
+	if !reflect.DeepEqual(events, []string{"equipped 2001 1"}) {
+		t.Fatalf("immediate events = %v", events)
+	}
+
+	events = nil
+	dispatcher.Update()
+	want := []string{"added 1002 5", "changed 1002 3", "added 2001 1", "removed 2001 -1", "added 2001 1"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("next frame events = %v, want %v", events, want)
+	}
+
+	//>> 回滚的修改不抛事件
+	events = nil
+	component.Atomic(func() bag.ItemError {
+		component.AddItem(bag.KContainerTypeBag, tidOre, 1, 1)
+		return bag.NewItemError(bag.ErrInvalidCount)
+	})
+	dispatcher.Update()
+	if len(events) != 0 {
+		t.Fatalf("rolled back events = %v", events)
+	}
+}
+
+func TestTradeSession(t *testing.T) {
+	a, b := bag.NewItemComponent(1), bag.NewItemComponent(2)
+	swords, _ := a.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	a.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+	b.AddItem(bag.KContainerTypeBag, tidGold, 500, 1)
+	sword := swords[0].GetUID()
+
+	trade := bag.NewTradeSession(a, b)
+	if err := trade.Offer(a, bag.TradeOffer{
+		UIDs: []bag.ItemUidDesc{{UID: sword, Count: 1}},
+		TIDs: []bag.ItemTidDesc{{TID: tidOre, Count: 6}},
+	}); err != nil {
+		t.Fatalf("Offer a: %v", err)
+	}
+	if err := trade.Commit(); err == nil || err.Code != bag.ErrTradeClosed {
+		t.Fatalf("commit before both offered: %v", err)
+	}
+
+	//>> 锁定的道具不能再扣或移走
+	if err := a.ReduceItemByUID(sword, 1, 1); err == nil {
+		t.Fatal("locked sword reduced")
+	}
+	if _, err := a.GetContainerByType(bag.KContainerTypeBag).SwapOut(sword); err == nil || err.Code != bag.ErrItemLocked {
+		t.Fatalf("SwapOut locked sword: %v", err)
+	}
+	if err := a.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 5, 1); err == nil {
+		t.Fatal("locked ore reduced")
+	}
+	if err := trade.Offer(b, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidGold, Count: 501}}}); err == nil {
+		t.Fatal("offer more gold than owned")
+	}
+	if err := trade.Offer(b, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidGold, Count: 300}}}); err != nil {
+		t.Fatalf("Offer b: %v", err)
+	}
+
+	if err := trade.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if a.GetItemCount(tidGold) != 300 || a.GetItemCount(tidOre) != 4 || a.GetItemByUID(sword) != nil {
+		t.Fatalf("a after trade: gold %d ore %d", a.GetItemCount(tidGold), a.GetItemCount(tidOre))
+	}
+	if b.GetItemCount(tidGold) != 200 || b.GetItemCount(tidOre) != 6 || b.GetItemByUID(sword) == nil {
+		t.Fatalf("b after trade: gold %d ore %d", b.GetItemCount(tidGold), b.GetItemCount(tidOre))
+	}
+	if err := trade.Commit(); err == nil || err.Code != bag.ErrTradeClosed {
+		t.Fatalf("second commit: %v", err)
+	}
+
+	//>> 一方放不下时两边都不变, 取消后解除锁定
+	a.AddItem(bag.KContainerTypeBag, tidDiamond, 300, 1)
+	b.AddItem(bag.KContainerTypeBag, tidDiamond, 800, 1)
+	trade = bag.NewTradeSession(a, b)
+	trade.Offer(a, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidDiamond, Count: 300}}})
+	trade.Offer(b, bag.TradeOffer{UIDs: []bag.ItemUidDesc{{UID: sword, Count: 1}}})
+	if err := trade.Commit(); err == nil || err.Code != bag.ErrExceedLimit {
+		t.Fatalf("commit over the diamond limit: %v", err)
+	}
+	if a.GetItemCount(tidDiamond) != 300 || b.GetItemCount(tidDiamond) != 800 || b.GetItemByUID(sword) == nil {
+		t.Fatalf("after failed trade: a diamond %d, b diamond %d", a.GetItemCount(tidDiamond), b.GetItemCount(tidDiamond))
+	}
+	if err := b.ReduceItemByUID(sword, 1, 1); err == nil {
+		t.Fatal("sword unlocked by failed commit")
+	}
+	trade.Abort()
+	if err := b.ReduceItemByUID(sword, 1, 1); err != nil {
+		t.Fatalf("sword still locked after abort: %v", err)
+	}
+}
+
+func TestUseItem(t *testing.T) {
+	var buffs []int
+	bag.RegisterUseHandler(tidElixir, func(ctx *bag.UseContext) bag.ItemError {
+		ctx.OnCommit(func() { buffs = append(buffs, int(ctx.Count)) })
+		ctx.AddEffect("heal")
+		return nil
+	})
+	bag.RegisterUseHandler(tidGift, bag.GiftPackHandler([]bag.ItemTidDesc{{TID: tidOre, Count: 2}, {TID: tidGold, Count: 10}}))
+	defer bag.RegisterUseHandler(tidElixir, nil)
+	defer bag.RegisterUseHandler(tidGift, nil)
+
+	component := bag.NewItemComponent(1)
+	gifts, _ := component.AddItem(bag.KContainerTypeBag, tidGift, 3, 1)
+	elixirs, _ := component.AddItem(bag.KContainerTypeBag, tidElixir, 5, 1)
+	ores, _ := component.AddItem(bag.KContainerTypeBag, tidOre, 1, 1)
+
+	result, err := component.UseItem(gifts[0].GetUID(), 2, nil)
+	if err != nil {
+		t.Fatalf("use gift: %v", err)
+	}
+	if result.Consumed != 2 || component.GetItemCount(tidGift) != 1 || component.GetItemCount(tidOre) != 5 || component.GetItemCount(tidGold) != 20 {
+		t.Fatalf("after gift: gift %d ore %d gold %d", component.GetItemCount(tidGift), component.GetItemCount(tidOre), component.GetItemCount(tidGold))
+	}
+	if _, err := component.UseItem(ores[0].GetUID(), 1, nil); err == nil || err.Code != bag.ErrItemCannotUse {
+		t.Fatalf("use ore: %v", err)
+	}
+
+	level := int32(5)
+	component.SetLevelProvider(func() int32 { return level })
+	if _, err := component.UseItem(elixirs[0].GetUID(), 1, nil); err == nil || err.Code != bag.ErrLevelNotEnough {
+		t.Fatalf("use elixir at level 5: %v", err)
+	}
+	level = 10
+	result, err = component.UseItem(elixirs[0].GetUID(), 2, "pet")
+	if err != nil {
+		t.Fatalf("use elixir: %v", err)
+	}
+	if !reflect.DeepEqual(buffs, []int{2}) || !reflect.DeepEqual(result.Effects, []interface{}{"heal"}) {
+		t.Fatalf("buffs %v effects %v", buffs, result.Effects)
+	}
+	if _, err := component.UseItem(elixirs[0].GetUID(), 1, nil); err == nil || err.Code != bag.ErrItemInCooldown {
+		t.Fatalf("use elixir in cooldown: %v", err)
+	}
+
+	//>> handler失败时道具不扣, 效果不生效
+	bag.RegisterUseHandler(tidGift, func(ctx *bag.UseContext) bag.ItemError {
+		ctx.AddItems([]bag.ItemTidDesc{{TID: tidOre, Count: 1}})
+		ctx.OnCommit(func() { t.Error("OnCommit called after failure") })
+		return bag.NewItemError(bag.ErrInvalidCount)
+	})
+	if _, err := component.UseItem(gifts[0].GetUID(), 1, nil); err == nil {
+		t.Fatal("failing handler should fail the use")
+	}
+	if component.GetItemCount(tidGift) != 1 || component.GetItemCount(tidOre) != 5 {
+		t.Fatalf("after failed use: gift %d ore %d", component.GetItemCount(tidGift), component.GetItemCount(tidOre))
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidElixir, 5, 1)
+
+	if err := component.ConsumeItem(bag.KContainerTypeBag, tidElixir, 1, 1); err != nil {
+		t.Fatalf("ConsumeItem: %v", err)
+	}
+	if left := component.GetItemCooldownLeft(tidElixir); left <= 0 || left > 60000 {
+		t.Fatalf("cooldown left = %d", left)
+	}
+	if err := component.ConsumeItem(bag.KContainerTypeBag, tidElixir, 1, 1); err == nil || err.Code != bag.ErrItemInCooldown {
+		t.Fatalf("consume in cooldown: %v", err)
+	}
+	//>> 扣除失败不进入冷却
+	component.ClearCooldown(1)
+	if err := component.ConsumeItem(bag.KContainerTypeBag, tidElixir, 10, 1); err == nil {
+		t.Fatal("consume more than owned")
+	}
+	if left := component.GetCooldownLeft(1); left != 0 {
+		t.Fatalf("cooldown started by failed consume: %d", left)
+	}
+
+	//>> 使用原因的扣除检查并开始冷却, 其他原因冷却中也能扣
+	elixir := component.GetItemsByTID(tidElixir)[0]
+	if err := component.ReduceItemByUID(elixir.GetUID(), 1, bag.KItemChangeReasonUse); err != nil {
+		t.Fatalf("reduce for use: %v", err)
+	}
+	if component.GetCooldownLeft(1) <= 0 {
+		t.Fatal("reduce for use did not start the cooldown")
+	}
+	if err := component.ReduceItemByTID(bag.KContainerTypeBag, tidElixir, 1, bag.KItemChangeReasonUse); err == nil || err.Code != bag.ErrItemInCooldown {
+		t.Fatalf("reduce by tid for use in cooldown: %v", err)
+	}
+	if err := component.ReduceItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidElixir, Count: 1}}, bag.KItemChangeReasonUse); err == nil || err.Code != bag.ErrItemInCooldown {
+		t.Fatalf("reduce items for use in cooldown: %v", err)
+	}
+	if err := component.ReduceItemByTID(bag.KContainerTypeBag, tidElixir, 1, 1); err != nil {
+		t.Fatalf("reduce for another reason in cooldown: %v", err)
+	}
+	if got := component.GetItemCount(tidElixir); got != 2 {
+		t.Fatalf("elixir = %d, want 2", got)
+	}
+	component.ClearCooldown(1)
+	if err := component.ReduceItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidElixir, Count: 1}}, bag.KItemChangeReasonUse); err != nil || component.GetCooldownLeft(1) <= 0 {
+		t.Fatalf("reduce items for use: %v, cooldown %d", err, component.GetCooldownLeft(1))
+	}
+	component.ClearCooldown(1)
+
+	//>> 到期后由定时器删除
+	component.StartCooldown(2, 20)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(component.GetCooldowns()) != 0 || component.GetCooldownLeft(2) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("cooldown not expired: %v", component.GetCooldowns())
+		}
+		time.Sleep(5 * time.Millisecond)
+		component.Update()
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	container := bag.NewBag(4, 0)
+	ores, _ := container.AddItem(tidOre, 99*4, 1)
+	if err := container.TryAddItem(tidSword, 1); err == nil || err.Code != bag.ErrContainerFull {
+		t.Fatalf("add to full bag: %v", err)
+	}
+	if err := container.ExpandSize(2); err != nil || container.GetMaxSize() != 6 {
+		t.Fatalf("ExpandSize: %v, max %d", err, container.GetMaxSize())
+	}
+
+	//>> 锁定的格子不能放新道具
+	container.LockSlot(4)
+	if container.GetUsableSize() != 5 || container.TryAddItem(tidSword, 1) != nil || container.TryAddItem(tidSword, 2) == nil {
+		t.Fatalf("usable size = %d with slot 4 locked", container.GetUsableSize())
+	}
+	swords, _ := container.AddItem(tidSword, 1, 1)
+	if pos := swords[0].GetPos(); pos != 5 {
+		t.Fatalf("sword at %d, want 5", pos)
+	}
+
+	//>> 减益后超出容量的道具保留, 可以移出但不能移进
+	container.SetCapacityDebuff(3, 0)
+	if container.GetUsableSize() != 3 || container.GetItemByPos(3) == nil {
+		t.Fatalf("usable size = %d after debuff", container.GetUsableSize())
+	}
+	if err := container.TryAddItem(tidOre, 1); err == nil {
+		t.Fatal("add while over the debuffed capacity")
+	}
+	container.ReduceItemByUID(ores[0].GetUID(), 99, 1)
+	if err := container.MoveItem(swords[0].GetUID(), 0); err != nil {
+		t.Fatalf("move sword out of the debuffed slot: %v", err)
+	}
+	if err := container.MoveItem(swords[0].GetUID(), 5); err == nil || err.Code != bag.ErrSlotMismatch {
+		t.Fatalf("move sword into the debuffed slot: %v", err)
+	}
+	container.Sort(nil)
+	for pos := int16(0); pos < 3; pos++ {
+		if container.GetItemByPos(pos) == nil {
+			t.Fatalf("sort left usable slot %d empty", pos)
+		}
+	}
+
+	//>> 扩充在事务中可以回滚
+	tx := container.Begin()
+	container.ExpandSize(10)
+	tx.Rollback()
+	if container.GetMaxSize() != 6 {
+		t.Fatalf("max size = %d after rollback", container.GetMaxSize())
+	}
+}
+
+func TestCapacitySync(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	container := component.GetContainerByType(bag.KContainerTypeBag)
+	container.ExpandSize(10)
+	container.LockSlot(3)
+	container.SetCapacityDebuff(5, 0)
+
+	delta := component.BuildDelta()
+	if delta == nil || len(delta.Containers) != 1 {
+		t.Fatalf("capacity change not synced: %+v", delta)
+	}
+	decoded, err := bag.UnmarshalItemDelta(delta.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := decoded.Containers[0]
+	if c.MaxSize != 110 || c.UsableSize != 104 || !reflect.DeepEqual(c.LockedSlots, []int16{3}) {
+		t.Fatalf("delta = %+v", c)
+	}
+	if component.BuildDelta() != nil {
+		t.Fatal("capacity change synced twice")
+	}
+
+	loaded := bag.NewItemComponent(1)
+	if err := loaded.Unmarshal(component.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	c2 := loaded.GetContainerByType(bag.KContainerTypeBag)
+	if c2.GetMaxSize() != 110 || !reflect.DeepEqual(c2.GetLockedSlots(), []int16{3}) || c2.GetUsableSize() != 109 {
+		t.Fatalf("after load: max %d, locked %v, usable %d", c2.GetMaxSize(), c2.GetLockedSlots(), c2.GetUsableSize())
+	}
+}
+
+func TestQueryItems(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	swords, _ := component.AddItem(bag.KContainerTypeWarehouse, tidSword, 6, 1)
+	for i, sword := range swords {
+		level := int64(i)
+		component.ModifyItemAttrs(sword.GetUID(), func(attrs *bag.ItemAttrs) {
+			attrs.SetInt(bag.AttrEnhanceLevel, level)
+		})
+	}
+	swords[1].SetFlag(bag.IsBind)
+	component.AddItem(bag.KContainerTypeWarehouse, tidOre, 300, 1)
+	component.SetItemExpireTime(swords[5].GetUID(), time.Now().Unix()+3600)
+
+	byLevel := func(a, b bag.ItemInterface) bool {
+		return a.GetAttrs().GetInt(bag.AttrEnhanceLevel) > b.GetAttrs().GetInt(bag.AttrEnhanceLevel)
+	}
+	query := bag.NewItemQuery().TIDs(tidSword).Flag(bag.IsBind, 0).IntAttr(bag.AttrEnhanceLevel, 1, 4).OrderBy(byLevel).Page(1, 2)
+	result := component.QueryItems(bag.KContainerTypeWarehouse, query)
+	if result.Total != 3 || len(result.Items) != 2 || result.Items[0] != swords[3] || result.Items[1] != swords[2] {
+		t.Fatalf("query result: total %d, %d items", result.Total, len(result.Items))
+	}
+
+	if got := component.QueryItems(bag.KContainerTypeWarehouse, bag.NewItemQuery().ExpireBetween(1, math.MaxInt64)); got.Total != 1 || got.Items[0] != swords[5] {
+		t.Fatalf("expiring items: %d", got.Total)
+	}
+	if got := component.QueryItems(bag.KContainerTypeWarehouse, bag.NewItemQuery().PosRange(0, 2)).Total; got != 3 {
+		t.Fatalf("items in pos [0,2] = %d", got)
+	}
+	if got := component.QueryItems(bag.KContainerTypeWarehouse, nil).Total; got != 10 {
+		t.Fatalf("all items = %d, want 10", got)
+	}
+
+	//>> 回滚的删除不影响索引
+	component.Atomic(func() bag.ItemError {
+		component.ReduceItemByUID(swords[5].GetUID(), 1, 1)
+		return bag.NewItemError(bag.ErrInvalidCount)
+	})
+	if got := component.QueryItems(bag.KContainerTypeWarehouse, bag.NewItemQuery().ExpireBetween(1, math.MaxInt64)).Total; got != 1 {
+		t.Fatalf("expiring items after rollback = %d", got)
+	}
+}
@@ -0,0 +1,588 @@
+package bagtest
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"bag"
+)
+
+/**
+* @Description: 道具和容器的一致性测试
+	自己实现的ItemInterface/ContainerInterface可以在测试里调用RunItemTests/RunContainerTests,
+	检查加减道具、堆叠、事务回滚这些容器必须满足的约束. 随机测试会打印种子, 失败时用同一个种子可以复现
+**/
+
+//>> 容器测试配置
+type ContainerConfig struct {
+	//>> 创建一个空容器, 每个用例调用一次
+	New func() bag.ContainerInterface
+	//>> 用到的模板id, 需要已经在模板表里, 且不能配置过期时间
+	TIDs []int32
+	//>> 单堆上限, nil表示按模板的MaxOverlap, 钱包这类没有堆叠上限的容器需要自己提供
+	MaxOverlap func(tid int32) int64
+	//>> 随机操作序列的种子, 0表示用当前时间
+	Seed int64
+	//>> 随机操作步数, 0表示1000步
+	Steps int
+}
+
+//>> 检查道具的get/set是否一致, newItem每次返回一个新道具
+func RunItemTests(t *testing.T, newItem func() bag.ItemInterface) {
+	item := newItem()
+	if item == nil {
+		t.Fatal("newItem returned nil")
+	}
+
+	item.SetTID(1001)
+	item.SetUID(123456789)
+	item.SetCount(99)
+	item.SetCreateTime(1600000000)
+	item.SetPos(7)
+	item.SetContainerType(bag.KContainerTypeWarehouse)
+	item.SetFlag(bag.IsBind)
+	item.SetExpireTime(1700000000)
+
+	check := func(name string, got, want interface{}) {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	check("GetTID", item.GetTID(), int32(1001))
+	check("GetUID", item.GetUID(), uint64(123456789))
+	check("GetCount", item.GetCount(), int64(99))
+	check("GetCreateTime", item.GetCreateTime(), int64(1600000000))
+	check("GetPos", item.GetPos(), int16(7))
+	check("GetContainerType", item.GetContainerType(), bag.KContainerTypeWarehouse)
+	check("GetFlag", item.GetFlag(), bag.IsBind)
+	check("GetExpireTime", item.GetExpireTime(), int64(1700000000))
+
+	attrs := bag.NewItemAttrs()
+	attrs.SetInt(bag.AttrEnhanceLevel, 5)
+	item.SetAttrs(attrs)
+	check("GetAttrs().GetInt", item.GetAttrs().GetInt(bag.AttrEnhanceLevel), int64(5))
+	item.SetAttrs(nil)
+	check("GetAttrs().IsEmpty", item.GetAttrs().IsEmpty(), true)
+
+	//>> 两个道具互不影响
+	other := newItem()
+	other.SetCount(1)
+	item.SetCount(2)
+	check("independent GetCount", other.GetCount(), int64(1))
+}
+
+//>> 对容器跑一整套一致性测试
+func RunContainerTests(t *testing.T, cfg ContainerConfig) {
+	if cfg.New == nil || len(cfg.TIDs) == 0 {
+		t.Fatal("bagtest: ContainerConfig needs New and TIDs")
+	}
+
+	t.Run("AddReduce", func(t *testing.T) { testAddReduce(t, cfg) })
+	t.Run("Stacking", func(t *testing.T) { testStacking(t, cfg) })
+	t.Run("InvalidCount", func(t *testing.T) { testInvalidCount(t, cfg) })
+	t.Run("Transaction", func(t *testing.T) { testTransaction(t, cfg) })
+	t.Run("Random", func(t *testing.T) { testRandom(t, cfg) })
+}
+
+//>> 检查容器内部是否自洽, 只看TIDs里的道具
+func CheckInvariants(container bag.ContainerInterface, cfg ContainerConfig) error {
+	uids := make(map[uint64]bool)
+	positions := make(map[int16]uint64)
+	types := make(map[int32]int)
+	size, load := int32(0), int64(0)
+
+	for _, tid := range cfg.TIDs {
+		total := int64(0)
+		for _, item := range container.GetItemsByTID(tid) {
+			uid := item.GetUID()
+			if uids[uid] {
+				return fmt.Errorf("uid %d appears twice", uid)
+			}
+			uids[uid] = true
+
+			if item.GetTID() != tid {
+				return fmt.Errorf("item %d tid %d listed under tid %d", uid, item.GetTID(), tid)
+			}
+			if item.GetCount() <= 0 || item.GetCount() > maxOverlap(cfg, tid) {
+				return fmt.Errorf("item %d count %d out of [1,%d]", uid, item.GetCount(), maxOverlap(cfg, tid))
+			}
+			if item.GetContainerType() != container.GetType() {
+				return fmt.Errorf("item %d container type %d, want %d", uid, item.GetContainerType(), container.GetType())
+			}
+			if container.GetItemByUID(uid) != item {
+				return fmt.Errorf("GetItemByUID(%d) does not return the item", uid)
+			}
+
+			pos := item.GetPos()
+			if prev, ok := positions[pos]; ok {
+				return fmt.Errorf("items %d and %d share pos %d", prev, uid, pos)
+			}
+			positions[pos] = uid
+			if pos < 0 || (container.GetMaxSize() > 0 && int32(pos) >= container.GetMaxSize()) {
+				return fmt.Errorf("item %d pos %d out of range", uid, pos)
+			}
+			if container.GetItemByPos(pos) != item {
+				return fmt.Errorf("GetItemByPos(%d) does not return item %d", pos, uid)
+			}
+
+			total += item.GetCount()
+			types[item.GetType()]++
+			size++
+			load += int64(item.GetWeight()) * item.GetCount()
+		}
+
+		if got := container.GetItemCount(tid); got != total {
+			return fmt.Errorf("GetItemCount(%d) = %d, items sum to %d", tid, got, total)
+		}
+	}
+
+	//>> 查询走的索引要和道具一致
+	if got := container.QueryItems(bag.NewItemQuery().TIDs(cfg.TIDs...)).Total; got != int(size) {
+		return fmt.Errorf("QueryItems by tid found %d items, want %d", got, size)
+	}
+	inTIDs := func(item bag.ItemInterface) bool {
+		for _, tid := range cfg.TIDs {
+			if item.GetTID() == tid {
+				return true
+			}
+		}
+		return false
+	}
+	for typ, n := range types {
+		if got := container.QueryItems(bag.NewItemQuery().Types(typ).Where(inTIDs)).Total; got != n {
+			return fmt.Errorf("QueryItems by type %d found %d items, want %d", typ, got, n)
+		}
+	}
+
+	if container.GetSize() != size {
+		return fmt.Errorf("GetSize() = %d, want %d", container.GetSize(), size)
+	}
+	if int64(container.GetLoad()) != load {
+		return fmt.Errorf("GetLoad() = %d, want %d", container.GetLoad(), load)
+	}
+	if container.GetMaxSize() > 0 && container.GetSize() > container.GetMaxSize() {
+		return fmt.Errorf("size %d exceeds max %d", container.GetSize(), container.GetMaxSize())
+	}
+	if container.GetMaxLoad() > 0 && container.GetLoad() > container.GetMaxLoad() {
+		return fmt.Errorf("load %d exceeds max %d", container.GetLoad(), container.GetMaxLoad())
+	}
+	return nil
+}
+
+func testAddReduce(t *testing.T, cfg ContainerConfig) {
+	container := cfg.New()
+	tid := cfg.TIDs[0]
+
+	//>> 只加一个, 装备栏这种每个部位一个格子的容器也能跑
+	if _, err := container.AddItem(tid, 1, 1); err != nil {
+		t.Fatalf("AddItem(%d, 1): %v", tid, err)
+	}
+	mustCheck(t, container, cfg)
+	if got := container.GetItemCount(tid); got != 1 {
+		t.Fatalf("GetItemCount = %d, want 1", got)
+	}
+
+	if err := container.TryReduceItemByTID(tid, 2); err == nil {
+		t.Fatal("TryReduceItemByTID more than owned should fail")
+	}
+	if err := container.ReduceItemByTID(tid, 2, 1); err == nil {
+		t.Fatal("ReduceItemByTID more than owned should fail")
+	}
+	if got := container.GetItemCount(tid); got != 1 {
+		t.Fatalf("failed reduce changed count to %d", got)
+	}
+
+	if err := container.ReduceItemByTID(tid, 1, 1); err != nil {
+		t.Fatalf("ReduceItemByTID(%d, 1): %v", tid, err)
+	}
+	mustCheck(t, container, cfg)
+	if container.GetItemCount(tid) != 0 || container.GetSize() != 0 {
+		t.Fatalf("container not empty after reducing everything: count %d size %d", container.GetItemCount(tid), container.GetSize())
+	}
+}
+
+func testStacking(t *testing.T, cfg ContainerConfig) {
+	tid := int32(0)
+	for _, candidate := range cfg.TIDs {
+		if n := maxOverlap(cfg, candidate); n > 1 && n < 1<<20 {
+			tid = candidate
+			break
+		}
+	}
+	if tid == 0 {
+		t.Skip("no stackable tid in config")
+	}
+
+	container := cfg.New()
+	n := maxOverlap(cfg, tid)
+	if _, err := container.AddItem(tid, n-1, 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if _, err := container.AddItem(tid, 2, 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	mustCheck(t, container, cfg)
+
+	items := container.GetItemsByTID(tid)
+	if len(items) != 2 {
+		t.Fatalf("got %d stacks, want 2", len(items))
+	}
+	full := 0
+	for _, item := range items {
+		if item.GetCount() == n {
+			full++
+		}
+	}
+	if full != 1 {
+		t.Fatalf("existing stack was not topped up first: %v", dump(container, cfg))
+	}
+}
+
+func testInvalidCount(t *testing.T, cfg ContainerConfig) {
+	container := cfg.New()
+	tid := cfg.TIDs[0]
+	if _, err := container.AddItem(tid, 1, 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	before := dump(container, cfg)
+
+	for _, n := range []int64{0, -1} {
+		if _, err := container.AddItem(tid, n, 1); err == nil {
+			t.Errorf("AddItem count %d should fail", n)
+		}
+		if err := container.ReduceItemByTID(tid, n, 1); err == nil {
+			t.Errorf("ReduceItemByTID count %d should fail", n)
+		}
+		uid := container.GetItemsByTID(tid)[0].GetUID()
+		if err := container.ReduceItemByUID(uid, n, 1); err == nil {
+			t.Errorf("ReduceItemByUID count %d should fail", n)
+		}
+	}
+
+	if after := dump(container, cfg); !reflect.DeepEqual(before, after) {
+		t.Fatalf("invalid counts changed the container:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+func testTransaction(t *testing.T, cfg ContainerConfig) {
+	container := cfg.New()
+	tx, ok := begin(container)
+	if !ok {
+		t.Skip("container does not support transactions")
+	}
+	tx.Commit()
+
+	tid := cfg.TIDs[0]
+	if _, err := container.AddItem(tid, 1, 1); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	before := dump(container, cfg)
+
+	tx, _ = begin(container)
+	if tx == nil {
+		t.Fatal("Begin returned nil")
+	}
+	if again, _ := begin(container); again != nil {
+		t.Fatal("Begin should fail while a transaction is open")
+	}
+	for _, other := range cfg.TIDs {
+		container.AddItem(other, 1, 1)
+	}
+	container.ReduceItemByTID(tid, 1, 1)
+	tx.Rollback()
+	mustCheck(t, container, cfg)
+
+	if after := dump(container, cfg); !reflect.DeepEqual(before, after) {
+		t.Fatalf("rollback did not restore the container:\nbefore %v\nafter  %v", before, after)
+	}
+
+	//>> ReduceAndAddItems失败时什么都不改
+	err := container.ReduceAndAddItems(
+		[]bag.ItemTidDesc{{TID: tid, Count: 1}},
+		[]bag.ItemTidDesc{{TID: tid, Count: -1}}, 1)
+	if err == nil {
+		t.Fatal("ReduceAndAddItems with invalid give count should fail")
+	}
+	if after := dump(container, cfg); !reflect.DeepEqual(before, after) {
+		t.Fatalf("failed ReduceAndAddItems changed the container:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+//>> 随机操作序列: 每一步之后检查约束, 失败的操作不能改变容器, 成功的操作数量变化要和模型一致
+func testRandom(t *testing.T, cfg ContainerConfig) {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	steps := cfg.Steps
+	if steps <= 0 {
+		steps = 1000
+	}
+	t.Logf("seed %d", seed)
+
+	r := &runner{
+		t:         t,
+		cfg:       cfg,
+		rng:       rand.New(rand.NewSource(seed)),
+		container: cfg.New(),
+		model:     make(map[int32]int64),
+	}
+	for r.step = 0; r.step < steps; r.step++ {
+		r.randomOp(true)
+		if t.Failed() {
+			t.Fatalf("seed %d failed at step %d", seed, r.step)
+		}
+	}
+}
+
+type runner struct {
+	t         *testing.T
+	cfg       ContainerConfig
+	rng       *rand.Rand
+	container bag.ContainerInterface
+	model     map[int32]int64 //>> 期望的每个模板的数量
+	step      int
+}
+
+func (this *runner) fail(op string, format string, args ...interface{}) {
+	this.t.Errorf("step %d %s: %s", this.step, op, fmt.Sprintf(format, args...))
+}
+
+func (this *runner) randomTID() int32 {
+	return this.cfg.TIDs[this.rng.Intn(len(this.cfg.TIDs))]
+}
+
+func (this *runner) randomCount(tid int32) int64 {
+	n := maxOverlap(this.cfg, tid)
+	if n > 100 {
+		n = 100
+	}
+	return this.rng.Int63n(n*3) + 1
+}
+
+func (this *runner) randomItem() bag.ItemInterface {
+	items := allItems(this.container, this.cfg)
+	if len(items) == 0 {
+		return nil
+	}
+	return items[this.rng.Intn(len(items))]
+}
+
+func (this *runner) randomPos() int16 {
+	max := this.container.GetMaxSize()
+	if max <= 0 {
+		max = this.container.GetSize() + 5
+	}
+	return int16(this.rng.Int31n(max))
+}
+
+func (this *runner) randomDescs() []bag.ItemTidDesc {
+	descs := make([]bag.ItemTidDesc, this.rng.Intn(3)+1)
+	for i := range descs {
+		descs[i].TID = this.randomTID()
+		descs[i].Count = this.randomCount(descs[i].TID)
+	}
+	return descs
+}
+
+//>> 执行一个随机操作, allowTx为false时不会嵌套开事务
+func (this *runner) randomOp(allowTx bool) {
+	before := dump(this.container, this.cfg)
+	container := this.container
+	var op string
+	var err bag.ItemError
+	var try bag.ItemError
+	delta := make(map[int32]int64)
+
+	switch this.rng.Intn(10) {
+	case 0, 1:
+		op = "AddItem"
+		tid := this.randomTID()
+		n := this.randomCount(tid)
+		try = container.TryAddItem(tid, n)
+		_, err = container.AddItem(tid, n, 1)
+		delta[tid] += n
+	case 2:
+		op = "AddItems"
+		descs := this.randomDescs()
+		try = container.TryAddItems(descs)
+		_, err = container.AddItems(descs, 1)
+		for _, desc := range descs {
+			delta[desc.TID] += desc.Count
+		}
+	case 3:
+		op = "ReduceItemByTID"
+		tid := this.randomTID()
+		n := this.rng.Int63n(this.model[tid]+2) + 1
+		try = container.TryReduceItemByTID(tid, n)
+		err = container.ReduceItemByTID(tid, n, 1)
+		delta[tid] -= n
+	case 4:
+		op = "ReduceItemByUID"
+		item := this.randomItem()
+		if item == nil {
+			return
+		}
+		tid, n := item.GetTID(), this.rng.Int63n(item.GetCount()+1)+1
+		try = container.TryReduceItemByUID(item.GetUID(), n)
+		err = container.ReduceItemByUID(item.GetUID(), n, 1)
+		delta[tid] -= n
+	case 5:
+		op = "ReduceAndAddItems"
+		del, give := this.randomDescs(), this.randomDescs()
+		err = container.ReduceAndAddItems(del, give, 1)
+		try = err
+		for _, desc := range del {
+			delta[desc.TID] -= desc.Count
+		}
+		for _, desc := range give {
+			delta[desc.TID] += desc.Count
+		}
+	case 6:
+		op = "MoveItem"
+		item := this.randomItem()
+		if item == nil {
+			return
+		}
+		err = container.MoveItem(item.GetUID(), this.randomPos())
+		try = err
+	case 7:
+		op = "SplitItem"
+		item := this.randomItem()
+		if item == nil {
+			return
+		}
+		_, err = container.SplitItem(item.GetUID(), this.rng.Int63n(item.GetCount()+1), -1)
+		try = err
+	case 8:
+		op = "Sort"
+		err = container.Sort(nil)
+		try = err
+	case 9:
+		if !allowTx {
+			return
+		}
+		op = "Transaction"
+		this.randomTx(before)
+		return
+	}
+
+	if (try == nil) != (err == nil) {
+		this.fail(op, "Try returned %v but the operation returned %v", try, err)
+	}
+	if e := CheckInvariants(container, this.cfg); e != nil {
+		this.fail(op, "invariant broken: %v", e)
+		return
+	}
+
+	if err != nil {
+		if after := dump(container, this.cfg); !reflect.DeepEqual(before, after) {
+			this.fail(op, "failed with %v but changed the container", err)
+		}
+		return
+	}
+
+	for tid, n := range delta {
+		this.model[tid] += n
+	}
+	for _, tid := range this.cfg.TIDs {
+		if got := container.GetItemCount(tid); got != this.model[tid] {
+			this.fail(op, "tid %d count %d, want %d", tid, got, this.model[tid])
+		}
+	}
+}
+
+//>> 在事务里做几步随机操作, 回滚后要和开始时一样
+func (this *runner) randomTx(before []itemState) {
+	tx, ok := begin(this.container)
+	if !ok || tx == nil {
+		return
+	}
+
+	model := make(map[int32]int64, len(this.model))
+	for tid, n := range this.model {
+		model[tid] = n
+	}
+
+	for i := this.rng.Intn(5) + 1; i > 0; i-- {
+		this.randomOp(false)
+	}
+
+	if this.rng.Intn(2) == 0 {
+		tx.Commit()
+		return
+	}
+
+	tx.Rollback()
+	this.model = model
+	if e := CheckInvariants(this.container, this.cfg); e != nil {
+		this.fail("Rollback", "invariant broken: %v", e)
+	}
+	if after := dump(this.container, this.cfg); !reflect.DeepEqual(before, after) {
+		this.fail("Rollback", "did not restore the container:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+//>> 用于比较的道具状态
+type itemState struct {
+	UID        uint64
+	TID        int32
+	Count      int64
+	Pos        int16
+	Flag       int
+	ExpireTime int64
+}
+
+//>> 容器里所有道具的状态, 按uid排序
+func dump(container bag.ContainerInterface, cfg ContainerConfig) []itemState {
+	var states []itemState
+	for _, item := range allItems(container, cfg) {
+		states = append(states, itemState{
+			UID:        item.GetUID(),
+			TID:        item.GetTID(),
+			Count:      item.GetCount(),
+			Pos:        item.GetPos(),
+			Flag:       item.GetFlag(),
+			ExpireTime: item.GetExpireTime(),
+		})
+	}
+	return states
+}
+
+func allItems(container bag.ContainerInterface, cfg ContainerConfig) []bag.ItemInterface {
+	var items []bag.ItemInterface
+	for _, tid := range cfg.TIDs {
+		items = append(items, container.GetItemsByTID(tid)...)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].GetUID() < items[j].GetUID() })
+	return items
+}
+
+func maxOverlap(cfg ContainerConfig, tid int32) int64 {
+	if cfg.MaxOverlap != nil {
+		return cfg.MaxOverlap(tid)
+	}
+	if tmpl := bag.GetItemTemplate(tid); tmpl != nil && tmpl.MaxOverlap > 1 {
+		return tmpl.MaxOverlap
+	}
+	return 1
+}
+
+func begin(container bag.ContainerInterface) (*bag.Transaction, bool) {
+	c, ok := container.(interface{ Begin() *bag.Transaction })
+	if !ok {
+		return nil, false
+	}
+	return c.Begin(), true
+}
+
+func mustCheck(t *testing.T, container bag.ContainerInterface, cfg ContainerConfig) {
+	t.Helper()
+	if err := CheckInvariants(container, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,118 @@
+package bag
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/**
+* @Description: 紧凑的二进制编码, 整数都用varint
+**/
+
+var errShortBuffer = errors.New("bag: unexpected end of data")
+
+type byteWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (this *byteWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(this.tmp[:], v)
+	this.buf = append(this.buf, this.tmp[:n]...)
+}
+
+func (this *byteWriter) varint(v int64) {
+	n := binary.PutVarint(this.tmp[:], v)
+	this.buf = append(this.buf, this.tmp[:n]...)
+}
+
+func (this *byteWriter) bool(v bool) {
+	if v {
+		this.buf = append(this.buf, 1)
+	} else {
+		this.buf = append(this.buf, 0)
+	}
+}
+
+func (this *byteWriter) bytes(v []byte) {
+	this.uvarint(uint64(len(v)))
+	this.buf = append(this.buf, v...)
+}
+
+func (this *byteWriter) string(v string) {
+	this.uvarint(uint64(len(v)))
+	this.buf = append(this.buf, v...)
+}
+
+//>> 读到错误之后的读取都返回0, 最后统一检查err
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (this *byteReader) uvarint() uint64 {
+	if this.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(this.buf)
+	if n <= 0 {
+		this.err = errShortBuffer
+		return 0
+	}
+	this.buf = this.buf[n:]
+	return v
+}
+
+func (this *byteReader) varint() int64 {
+	if this.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(this.buf)
+	if n <= 0 {
+		this.err = errShortBuffer
+		return 0
+	}
+	this.buf = this.buf[n:]
+	return v
+}
+
+func (this *byteReader) bool() bool {
+	if this.err != nil {
+		return false
+	}
+	if len(this.buf) == 0 {
+		this.err = errShortBuffer
+		return false
+	}
+	v := this.buf[0] != 0
+	this.buf = this.buf[1:]
+	return v
+}
+
+func (this *byteReader) bytes() []byte {
+	n := this.uvarint()
+	if this.err != nil {
+		return nil
+	}
+	if uint64(len(this.buf)) < n {
+		this.err = errShortBuffer
+		return nil
+	}
+	v := append([]byte(nil), this.buf[:n]...)
+	this.buf = this.buf[n:]
+	return v
+}
+
+func (this *byteReader) string() string {
+	return string(this.bytes())
+}
+
+//>> 长度字段最多还能读出多少个元素, 防止坏数据导致超大分配
+func (this *byteReader) length() int {
+	n := this.uvarint()
+	if this.err == nil && n > uint64(len(this.buf)) {
+		this.err = errShortBuffer
+		return 0
+	}
+	return int(n)
+}
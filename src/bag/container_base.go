@@ -1,7 +1,10 @@
 package bag
 
 import (
+	"eventdispatcher"
 	"fmt"
+	"math"
+	"sort"
 	"time"
 )
 
@@ -9,13 +12,24 @@ import (
 type ContainerType int16
 
 const (
-	KContainerTypeInvalid ContainerType = iota
-	KContainerTypeBag                   // 背包
+	KContainerTypeInvalid   ContainerType = iota
+	KContainerTypeBag                     // 背包
+	KContainerTypeEquip                   // 装备栏
+	KContainerTypeWarehouse               // 仓库
+	KContainerTypeWallet                  // 钱包, 放货币
 )
 
-//>> 道具更改原因
+//>> 道具更改原因, 业务自定义的原因用正数, 负数保留给容器内部使用
 type ItemChangeReason int
 
+const (
+	KItemChangeReasonMove     ItemChangeReason = -1 - iota // 移动、合并、整理
+	KItemChangeReasonTransfer                              // 跨容器转移，比如穿脱装备
+	KItemChangeReasonExpire                                // 过期删除
+	KItemChangeReasonTrade                                 // 玩家交易
+	KItemChangeReasonUse                                   // 使用道具, 包括使用后获得的道具
+)
+
 //>> 道具描述信息
 type ItemTidDesc struct {
 	TID   int32
@@ -32,6 +46,26 @@ const (
 	ErrItemNotExist
 	ErrItemNotEnough
 	ErrContainerNotExist
+	ErrInvalidCount        //>> 数量非法
+	ErrContainerFull       //>> 格子不足, Param为[tid,差多少格]
+	ErrOverLoad            //>> 超出负重, Param为[tid,超出多少负重]
+	ErrTransactionConflict //>> 容器已经在别的事务中
+	ErrInvalidPos          //>> 格子位置非法
+	ErrSlotMismatch        //>> 格子类型不匹配, 比如武器不能放到头盔位
+	ErrItemExist           //>> 道具已经在容器中
+	ErrReduceTimeout       //>> 异步扣除超时, Param为[预扣id的低32位]
+	ErrReservationNotExist //>> 预扣不存在或已经结束
+	ErrExceedLimit         //>> 超过持有上限或数量溢出, Param为[tid,超出多少]
+	ErrActorStopped        //>> 背包actor已经停止
+	ErrItemLocked          //>> 道具被交易锁定, 不能移出
+	ErrTradeClosed         //>> 交易已经结束或双方还没都放好道具
+	ErrItemCannotUse       //>> 道具没有注册使用效果, Param为[tid]
+	ErrLevelNotEnough      //>> 等级不够, Param为[tid,需要的等级]
+	ErrItemInCooldown      //>> 冷却中, Param为[冷却组,剩余毫秒]
+	ErrItemBound           //>> 绑定的道具不能交易, Param为[tid]
+	ErrNotExclusive        //>> 背包由actor管理, 要在Exclusive里操作
+	ErrMixedContainers     //>> 一次异步扣除的道具不在同一个容器里, 比如货币和道具混在一起
+	ErrTemplateNotExist    //>> 道具没有模板配置, Param为[tid]
 )
 
 type itemError struct {
@@ -47,7 +81,7 @@ func (this *itemError) Error() string {
 }
 
 func NewItemError(code int) *itemError {
-	err := itemError{Code: code, Param: make([]int, 1)}
+	err := itemError{Code: code, Param: make([]int, 0, 2)}
 	return &err
 }
 
@@ -63,6 +97,22 @@ type ContainerInterface interface {
 	GetMaxSize() int32
 	//>> 负重上限
 	GetMaxLoad() int32
+	//>> 可用的格子数, 去掉锁定的格子和减益
+	GetUsableSize() int32
+	//>> 可用的负重上限, 去掉减益
+	GetUsableLoad() int32
+	//>> 锁定的格子
+	GetLockedSlots() []int16
+	//>> 扩充格子
+	ExpandSize(n int32) ItemError
+	//>> 提高负重上限
+	ExpandLoad(n int32) ItemError
+	//>> 锁定格子, 格子里已有的道具保留
+	LockSlot(pos int16) ItemError
+	//>> 解锁格子
+	UnlockSlot(pos int16) ItemError
+	//>> 临时降低容量, 传0取消
+	SetCapacityDebuff(size, load int32)
 	//>> 根据uid返回道具
 	GetItemByUID(uid uint64) ItemInterface
 	//>> 根据模板id返回道具列表
@@ -95,15 +145,30 @@ type ContainerInterface interface {
 	ReduceAndAddItems(delItems, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError
 	//>> 扣并给道具，保证事务性
 	ReduceAndAddItemByUID(delUIDs []ItemUidDesc, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError
-	//>> todo: 异步扣道具，结果调用回调, 有些一级货币可能无法同步扣除
-	//AsyncReduceItem(items []ItemTidDesc, reason ItemChangeReason, cb func(err ItemError))
-	//>> todo: 移动位置
-	//MoveItem(uid uint64, targetPos int64) ItemError
-	//>> todo：交换位置
-	//SwapPosition(dstPos, scrPos int16) ItemError
-	//>> todo: 如果有穿脱装备，会跨容器交换位置
-	//SwapOut()
-	//SwapIn()
+	//>> 异步扣道具，结果调用回调, 有些一级货币可能无法同步扣除
+	AsyncReduceItem(items []ItemTidDesc, reason ItemChangeReason, cb func(err ItemError))
+	//>> 外部确认异步扣除的结果, err为nil表示扣除成功
+	ConfirmReduce(id uint64, err ItemError) ItemError
+	//>> 根据格子返回道具
+	GetItemByPos(pos int16) ItemInterface
+	//>> 移动位置, 目标格子是同模板未满的堆会自动合并, 有其他道具则交换
+	MoveItem(uid uint64, targetPos int16) ItemError
+	//>> 交换位置
+	SwapPosition(dstPos, srcPos int16) ItemError
+	//>> 拆分堆叠, 分出来的道具有新的uid
+	SplitItem(uid uint64, count int64, pos int16) (ItemInterface, ItemError)
+	//>> 整理, 合并未满的堆并按规则紧凑排列
+	Sort(rule SortRule) ItemError
+	//>> 把道具整个移出容器(穿脱装备等跨容器交换用), 道具本身不销毁
+	SwapOut(uid uint64) (ItemInterface, ItemError)
+	//>> 把别的容器移出的道具放到指定格子, pos<0表示放到第一个能放的空格子
+	SwapIn(item ItemInterface, pos int16) ItemError
+	//>> 修改单个道具的过期时间, 0表示永不过期
+	SetItemExpireTime(uid uint64, expireTime int64) ItemError
+	//>> 替换道具的实例属性, 数量大于1的堆不能设置属性
+	SetItemAttrs(uid uint64, attrs *ItemAttrs) ItemError
+	//>> 按条件查询道具, 支持排序和分页
+	QueryItems(query *ItemQuery) *ItemQueryResult
 }
 
 // 道具更新类型
@@ -123,15 +188,60 @@ type ItemOpRecord struct {
 
 type ContainerBase struct {
 	typ      ContainerType
-	curSize  int32
-	maxSize  int32
-	curLoad  int32
-	maxLoad  int32
+	curSize  int32 //>> 已占用格子数
+	maxSize  int32 //>> 格子上限, <=0表示不限
+	curLoad  int64 //>> 当前负重, 不限负重的容器可能超过int32
+	maxLoad  int32 //>> 负重上限, <=0表示不限
 	items    map[uint64]ItemInterface
 	tid2UIDs map[int32][]uint64
+	pos2UID  map[int16]uint64 //>> 格子占用
+
+	//>> 格子能否放某个模板的道具, nil表示任意格子都能放, 装备栏用来校验部位
+	acceptPos func(tid int32, pos int16) bool
+	//>> 单堆上限, nil表示按模板的MaxOverlap, 钱包用来去掉堆叠上限
+	stackLimit func(tid int32) int64
 
 	// 更新队列
 	updateQueue []ItemOpRecord
+
+	// 存盘脏标记, 和updateQueue分开, 存盘和同步客户端的频率不一样
+	dirty map[uint64]bool
+
+	// 当前所在事务
+	tx *Transaction
+
+	// 同模板多个堆的扣除顺序
+	reducePolicy ReducePolicy
+
+	// 所属的背包组件，负责过期定时器等
+	owner *ItemComponent
+
+	// 异步扣除、交易冻结的数量, 冻结的部分不能再被扣除或移出
+	frozen       map[int32]int64
+	locked       map[uint64]int64 //>> 按uid锁定的数量
+	lockedTotal  map[int32]int64  //>> 每个模板按uid锁定的总数
+	reservations map[uint64]*ReduceReservation
+	asyncReduce  AsyncReduceHandler
+	asyncTimeout int64 //>> 毫秒
+
+	// 锁定的格子和临时减益, 见container_capacity.go
+	lockedSlots     map[int16]bool
+	sizeDebuff      int32
+	loadDebuff      int32
+	capacityDirty   bool
+	capacityUnsaved bool //>> 永久容量改过还没写进存储, 见item_dirty.go
+
+	// 查询用的二级索引, 见container_query.go
+	expiring map[uint64]bool //>> 有过期时间的道具
+}
+
+func (this *ContainerBase) init(typ ContainerType, maxSize, maxLoad int32) {
+	this.typ = typ
+	this.maxSize = maxSize
+	this.maxLoad = maxLoad
+	this.items = make(map[uint64]ItemInterface)
+	this.tid2UIDs = make(map[int32][]uint64)
+	this.pos2UID = make(map[int16]uint64)
 }
 
 //>> 容器类型
@@ -144,9 +254,12 @@ func (this *ContainerBase) GetSize() int32 {
 	return this.curSize
 }
 
-//>> 负重
+//>> 负重, 超过int32时返回math.MaxInt32
 func (this *ContainerBase) GetLoad() int32 {
-	return this.curLoad
+	if this.curLoad > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(this.curLoad)
 }
 
 //>> 最大格子数量
@@ -168,8 +281,8 @@ func (this *ContainerBase) GetItemByUID(uid uint64) ItemInterface {
 func (this *ContainerBase) GetItemsByTID(tid int32) []ItemInterface {
 	var ret []ItemInterface
 	if tids, ok := this.tid2UIDs[tid]; ok {
-		for uid := range tids {
-			item, ok := this.items[uint64(uid)]
+		for _, uid := range tids {
+			item, ok := this.items[uid]
 			if ok {
 				ret = append(ret, item)
 			}
@@ -180,9 +293,8 @@ func (this *ContainerBase) GetItemsByTID(tid int32) []ItemInterface {
 
 //>> 根据模板id返回一个“最佳删除”道具，可能优先绑定或快过期的
 func (this *ContainerBase) GetItemForReduce(tid int32) ItemInterface {
-	items := this.GetItemsByTID(tid)
+	items := this.getItemsForReduce(tid)
 	if len(items) > 0 {
-		// todo: 根据规则找出先扣除的
 		return items[0]
 	}
 	return nil
@@ -200,10 +312,7 @@ func (this *ContainerBase) GetItemCount(tid int32) int64 {
 
 //>> 检查是否能加道具
 func (this *ContainerBase) TryAddItem(tid int32, count int64) ItemError {
-	//>> 计算负重
-	//>> 计算格子
-	//>> 计算堆叠
-	return NewItemError(0)
+	return this.tryAddItems(map[int32]int64{tid: count})
 }
 
 //>> 检查是否能加道具
@@ -212,35 +321,111 @@ func (this *ContainerBase) TryAddItems(items []ItemTidDesc) ItemError {
 	return this.tryAddItems(itemMap)
 }
 
+//>> 把整批道具当作一次操作来模拟: 堆叠后新占的格子和总负重都不能超上限
 func (this *ContainerBase) tryAddItems(itemMap map[int32]int64) ItemError {
-	for k, v := range itemMap {
-		if err := this.TryAddItem(k, v); err != nil {
+	//>> 固定顺序，保证同一批道具报出的溢出道具是确定的
+	tids := sortedTIDs(itemMap)
+
+	//>> 没有模板的道具存档后读不回来, 加的时候就拒绝; 先于容量检查, 免得被当成放不下进了邮箱
+	for _, tid := range tids {
+		if GetItemTemplate(tid) == nil {
+			err := NewItemError(ErrTemplateNotExist)
+			err.Param = append(err.Param, int(tid))
+			return err
+		}
+	}
+
+	//>> 不可用格子里的道具不占可用容量
+	size := int64(this.usedUsableSlots())
+	capacity := int64(this.GetUsableSize())
+	load := this.curLoad
+	taken := make(map[int16]bool)
+	for _, tid := range tids {
+		count := itemMap[tid]
+		if count <= 0 {
+			err := NewItemError(ErrInvalidCount)
+			err.Param = append(err.Param, int(tid), int(count))
+			return err
+		}
+
+		//>> 持有上限, 同时防止数量溢出
+		has := this.GetItemCount(tid)
+		if count > math.MaxInt64-has {
+			err := NewItemError(ErrExceedLimit)
+			err.Param = append(err.Param, int(tid), int(count-(math.MaxInt64-has)))
+			return err
+		}
+		if maxHold := getItemMaxHold(tid); maxHold > 0 && has+count > maxHold {
+			err := NewItemError(ErrExceedLimit)
+			err.Param = append(err.Param, int(tid), int(has+count-maxHold))
+			return err
+		}
+
+		//>> 计算堆叠
+		grids := this.calcNewGrids(tid, count)
+		size += grids
+		if this.maxSize > 0 && size > capacity {
+			err := NewItemError(ErrContainerFull)
+			err.Param = append(err.Param, int(tid), int(size-capacity))
+			return err
+		}
+
+		//>> 格子有类型限制时，还得有足够能放这个道具的空格子
+		if this.acceptPos != nil {
+			for ; grids > 0; grids-- {
+				pos := this.findFreePosExcept(tid, taken)
+				if pos < 0 {
+					err := NewItemError(ErrContainerFull)
+					err.Param = append(err.Param, int(tid), int(grids))
+					return err
+				}
+				taken[pos] = true
+			}
+		}
+
+		//>> 计算负重
+		load += int64(getItemWeight(tid)) * count
+		if over := this.overLoad(load); over > 0 && getItemWeight(tid) > 0 {
+			err := NewItemError(ErrOverLoad)
+			err.Param = append(err.Param, int(tid), int(over))
 			return err
 		}
 	}
 	return nil
 }
 
+//>> 计算加count个道具需要新占用的格子数, 先算已有的未满堆能放下多少
+func (this *ContainerBase) calcNewGrids(tid int32, count int64) int64 {
+	maxOverlap := this.getMaxOverlap(tid)
+	expire := calcExpireTime(tid, time.Now().Unix())
+	for _, uid := range this.tid2UIDs[tid] {
+		if item := this.items[uid]; item != nil && canStackOn(item, expire) && item.GetCount() < maxOverlap {
+			count -= maxOverlap - item.GetCount()
+		}
+	}
+	if count <= 0 {
+		return 0
+	}
+	//>> 不写成(count+maxOverlap-1)/maxOverlap, 钱包的maxOverlap是MaxInt64会溢出
+	return (count-1)/maxOverlap + 1
+}
+
 //>> 增加道具，成功返回增加后的道具
 func (this *ContainerBase) AddItem(tid int32, count int64, reason ItemChangeReason) ([]ItemInterface, ItemError) {
 	if err := this.TryAddItem(tid, count); err != nil {
 		return nil, err
 	}
 
-	var items []ItemInterface
-	// todo: 计算堆叠
-	for n := 1; n > 0; n-- {
-
-		item := NewItem(tid, count)
-		if item == nil {
-			return nil, NewItemError(-1)
-		}
-
-		this.addItem(item, reason)
-		items = append(items, item)
+	var ret []ItemInterface
+	err := atomically(this.tx, this.Begin, func() (err ItemError) {
+		ret, err = this.stackItem(tid, count, reason)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return items, nil
+	return ret, nil
 }
 
 //>> 批量加道具, 成功返回增加后的道具切片
@@ -251,25 +436,57 @@ func (this *ContainerBase) AddItems(items []ItemTidDesc, reason ItemChangeReason
 	}
 
 	var ret []ItemInterface
-	for tid, count := range itemMap {
-		// todo: 计算堆叠
-		total := int64(0)
-		cur := int64(1)
-		for {
-			//maxOverlap := getItemMaxOverlap(itemDesc.TID)
-			//curOverlap
-			total += cur
-			item := NewItem(tid, cur)
-			if item == nil {
-				return nil, NewItemError(-1)
+	err := atomically(this.tx, this.Begin, func() ItemError {
+		for _, tid := range sortedTIDs(itemMap) {
+			added, err := this.stackItem(tid, itemMap[tid], reason)
+			if err != nil {
+				return err
 			}
-			ret = append(ret, item)
-			this.addItem(item, reason)
+			ret = append(ret, added...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			if total >= count {
-				break
-			}
+	return ret, nil
+}
+
+//>> 按堆叠规则加道具: 先补满已有的未满堆, 剩下的按最大堆叠拆成新堆
+func (this *ContainerBase) stackItem(tid int32, count int64, reason ItemChangeReason) ([]ItemInterface, ItemError) {
+	var ret []ItemInterface
+	maxOverlap := this.getMaxOverlap(tid)
+	expire := calcExpireTime(tid, time.Now().Unix())
+
+	for _, uid := range this.tid2UIDs[tid] {
+		if count <= 0 {
+			break
+		}
+		item := this.items[uid]
+		if item == nil || !canStackOn(item, expire) || item.GetCount() >= maxOverlap {
+			continue
 		}
+
+		add := maxOverlap - item.GetCount()
+		if add > count {
+			add = count
+		}
+		this.setItemCount(item, item.GetCount()+add, reason)
+		ret = append(ret, item)
+		count -= add
+	}
+
+	for count > 0 {
+		cur := count
+		if cur > maxOverlap {
+			cur = maxOverlap
+		}
+
+		item := NewItem(tid, cur)
+		this.addItem(item, reason)
+		ret = append(ret, item)
+		count -= cur
 	}
 
 	return ret, nil
@@ -282,32 +499,46 @@ func (this *ContainerBase) TryReduceItemByUID(uid uint64, count int64) ItemError
 		return NewItemError(ErrItemNotExist)
 	}
 
-	if item.GetCount() < count {
+	if count <= 0 {
+		err := NewItemError(ErrInvalidCount)
+		err.Param = append(err.Param, int(item.GetTID()), int(count))
+		return err
+	}
+
+	if free := item.GetCount() - this.locked[uid]; free < count {
 		err := NewItemError(ErrItemNotEnough)
-		err.Param = append(err.Param, int(count-item.GetCount()))
+		err.Param = append(err.Param, int(item.GetTID()), int(count-free))
 		return err
 	}
 
-	return nil
+	return this.checkFrozen(item.GetTID(), count)
 }
 
 //>> 检查是否能扣道具，成功返回nil
 func (this *ContainerBase) TryReduceItemByTID(tid int32, count int64) ItemError {
+	if count <= 0 {
+		err := NewItemError(ErrInvalidCount)
+		err.Param = append(err.Param, int(tid), int(count))
+		return err
+	}
+
 	items := this.GetItemsByTID(tid)
 	if len(items) == 0 {
 		return NewItemError(ErrItemNotExist)
 	}
 
+	//>> 异步扣除冻结的部分和交易锁定的部分视为不可用
+	need := count + this.frozen[tid] + this.lockedTotal[tid]
 	has := int64(0)
 	for _, item := range items {
 		has += item.GetCount()
-		if count <= has {
+		if need <= has {
 			return nil
 		}
 	}
 
 	err := NewItemError(ErrItemNotEnough)
-	err.Param = append(err.Param, int(count-has))
+	err.Param = append(err.Param, int(tid), int(need-has))
 	return err
 }
 
@@ -318,8 +549,8 @@ func (this *ContainerBase) TryReduceItems(items []ItemTidDesc) ItemError {
 		return nil
 	}
 
-	for k, v := range itemMap {
-		if err := this.TryReduceItemByTID(k, v); err != nil {
+	for _, tid := range sortedTIDs(itemMap) {
+		if err := this.TryReduceItemByTID(tid, itemMap[tid]); err != nil {
 			return err
 		}
 	}
@@ -343,49 +574,19 @@ func (this *ContainerBase) ReduceItemByTID(tid int32, count int64, reason ItemCh
 		return err
 	}
 
-	for {
-		item := this.GetItemForReduce(tid)
-		if item == nil {
-			panic("(this *ContainerBase) ReduceItemByTID()!")
-		}
-		if item.GetCount() > count {
-			this.delItem(item.GetUID(), count, reason)
-		} else {
-			this.delItem(item.GetUID(), item.GetCount(), reason)
-		}
-		count -= item.GetCount()
-		if count <= 0 {
-			break
-		}
-	}
-
+	this.reduceByTID(tid, count, reason)
 	return nil
 }
 
 //>> 扣道具，成功返回nil
 func (this *ContainerBase) ReduceItems(items []ItemTidDesc, reason ItemChangeReason) ItemError {
 	if err := this.TryReduceItems(items); err != nil {
-		return nil
+		return err
 	}
 
-	for _, v := range items {
-		tid := v.TID
-		count := v.Count
-		for {
-			item := this.GetItemForReduce(tid)
-			if item == nil {
-				panic("(this *ContainerBase) ReduceItemByTID()!")
-			}
-			if item.GetCount() > count {
-				this.delItem(item.GetUID(), count, reason)
-			} else {
-				this.delItem(item.GetUID(), item.GetCount(), reason)
-			}
-			count -= item.GetCount()
-			if count <= 0 {
-				break
-			}
-		}
+	itemMap := ItemTidDesc{}.convertToMap(items)
+	for _, tid := range sortedTIDs(itemMap) {
+		this.reduceByTID(tid, itemMap[tid], reason)
 	}
 
 	return nil
@@ -393,65 +594,125 @@ func (this *ContainerBase) ReduceItems(items []ItemTidDesc, reason ItemChangeRea
 
 //>> 扣并给道具，保证事务性
 func (this *ContainerBase) ReduceAndAddItems(delItems, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError {
-	if err := this.TryAddItems(giveItems); err != nil {
-		return err
-	}
+	return atomically(this.tx, this.Begin, func() ItemError {
+		//>> 先扣再给，扣掉的道具腾出的格子和负重可以用来放新道具
+		if err := this.ReduceItems(delItems, reason); err != nil {
+			return err
+		}
 
-	if err := this.ReduceItems(delItems, reason); err != nil {
+		_, err := this.AddItems(giveItems, reason)
 		return err
-	}
-
-	this.AddItems(giveItems, reason)
-	return nil
+	})
 }
 
 //>> 扣并给道具，保证事务性
 func (this *ContainerBase) ReduceAndAddItemByUID(delItems []ItemUidDesc, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError {
-	if err := this.TryAddItems(giveItems); err != nil {
-		return err
-	}
-
-	delItemMap := ItemUidDesc{}.convertToMap(delItems)
-	if delItemMap != nil {
-		for k, v := range delItemMap {
-			if err := this.TryReduceItemByUID(k, v); err != nil {
+	return atomically(this.tx, this.Begin, func() ItemError {
+		delItemMap := ItemUidDesc{}.convertToMap(delItems)
+		uids := make([]uint64, 0, len(delItemMap))
+		for uid := range delItemMap {
+			uids = append(uids, uid)
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		for _, uid := range uids {
+			if err := this.ReduceItemByUID(uid, delItemMap[uid], reason); err != nil {
 				return err
 			}
 		}
 
-		for k, v := range delItemMap {
-			if err := this.ReduceItemByUID(k, v, reason); err != nil {
-				panic("this.ReduceItemByUID")
-			}
-		}
+		_, err := this.AddItems(giveItems, reason)
+		return err
+	})
+}
+
+//>> 开启事务，之后的修改可以通过Rollback撤销
+func (this *ContainerBase) Begin() *Transaction {
+	tx := NewTransaction()
+	if !tx.Join(this) {
+		return nil
 	}
+	return tx
+}
 
-	this.AddItems(giveItems, reason)
-	return nil
+func (this *ContainerBase) getTransaction() *Transaction {
+	return this.tx
+}
+
+func (this *ContainerBase) setTransaction(tx *Transaction) {
+	this.tx = tx
+}
+
+//>> 事务中记录修改前的容器状态(格子/负重/更新队列/tid索引), undo负责撤销items和道具本身的修改
+func (this *ContainerBase) journal(tid int32, undo func()) {
+	if this.tx == nil {
+		return
+	}
+
+	curSize, curLoad, queueLen := this.curSize, this.curLoad, len(this.updateQueue)
+	uids, ok := this.tid2UIDs[tid]
+	//>> delItem会原地修改切片，必须拷贝一份
+	uids = append([]uint64(nil), uids...)
+
+	this.tx.record(func() {
+		undo()
+		this.curSize, this.curLoad = curSize, curLoad
+		this.updateQueue = this.updateQueue[:queueLen]
+		if ok {
+			this.tid2UIDs[tid] = uids
+		} else {
+			delete(this.tid2UIDs, tid)
+		}
+	})
 }
 
 func (this *ContainerBase) addItem(item ItemInterface, reason ItemChangeReason) {
 
 	item.SetCreateTime(time.Now().Unix())
-	item.SetContainerType(this.GetType())
-
-	//todo
-	newGrid := int16(0)
-	item.SetPos(newGrid)
+	if item.GetExpireTime() == 0 {
+		item.SetExpireTime(calcExpireTime(item.GetTID(), item.GetCreateTime()))
+	}
 
 	//todo: 绑定信息等
 	//item.SetFlag()
 
-	this.items[item.GetUID()] = item
+	this.insertItem(item, this.findFreePos(item.GetTID()), reason)
+}
 
-	ii, ok := this.tid2UIDs[item.GetTID()]
-	if !ok {
-		ii = make([]uint64, 1)
+//>> 把道具放到容器的指定格子
+func (this *ContainerBase) insertItem(item ItemInterface, newGrid int16, reason ItemChangeReason) {
+	oldContainer, oldGrid := item.GetContainerType(), item.GetPos()
+	item.SetContainerType(this.GetType())
+	item.SetPos(newGrid)
+
+	uid := item.GetUID()
+	this.journal(item.GetTID(), func() {
+		delete(this.items, uid)
+		delete(this.pos2UID, newGrid)
+		this.unindexItem(item)
+		item.SetContainerType(oldContainer)
+		item.SetPos(oldGrid)
+		if this.owner != nil {
+			this.owner.unwatchExpire(uid)
+		}
+	})
+	this.pos2UID[newGrid] = uid
+	if this.owner != nil {
+		this.owner.watchExpire(item)
 	}
-	ii = append(ii, item.GetUID())
-	this.tid2UIDs[item.GetTID()] = ii
 
-	this.updateQueue = append(this.updateQueue, ItemOpRecord{UID: item.GetUID(), Operation: KItemUpdateTypeAdd})
+	this.items[item.GetUID()] = item
+	this.indexItem(item)
+	this.curSize++
+	this.curLoad += int64(item.GetWeight()) * item.GetCount()
+
+	this.tid2UIDs[item.GetTID()] = append(this.tid2UIDs[item.GetTID()], item.GetUID())
+
+	this.pushUpdate(item.GetUID(), KItemUpdateTypeAdd)
+	this.logChange(item, 0, item.GetCount(), reason)
+	this.publishChange(item, 0, item.GetCount(), reason)
+	if this.typ == KContainerTypeEquip {
+		this.publish(eventdispatcher.EventEnumItemEquipped, item, 0, item.GetCount(), reason)
+	}
 }
 
 func (this *ContainerBase) delItem(uid uint64, count int64, reason ItemChangeReason) {
@@ -462,8 +723,22 @@ func (this *ContainerBase) delItem(uid uint64, count int64, reason ItemChangeRea
 
 	left := item.GetCount() - count
 	if left > 0 {
-		item.SetCount(left)
+		this.setItemCount(item, left, reason)
+		return
 	} else if left == 0 {
+		pos := item.GetPos()
+		this.journal(item.GetTID(), func() {
+			this.items[uid] = item
+			this.pos2UID[pos] = uid
+			this.indexItem(item)
+			if this.owner != nil {
+				this.owner.watchExpire(item)
+			}
+		})
+		if this.owner != nil {
+			this.owner.unwatchExpire(uid)
+		}
+
 		uids := this.tid2UIDs[item.GetTID()]
 		if len(uids) == 0 {
 			panic("(this *ContainerBase) delItem len(uids) == 0")
@@ -481,18 +756,128 @@ func (this *ContainerBase) delItem(uid uint64, count int64, reason ItemChangeRea
 			this.tid2UIDs[item.GetTID()] = uids
 		}
 		delete(this.items, uid)
+		this.unindexItem(item)
+		if this.pos2UID[pos] == uid {
+			delete(this.pos2UID, pos)
+		}
+		this.curSize--
+		this.curLoad -= int64(item.GetWeight()) * count
 	} else {
 		panic("(this *ContainerBase) delItem left < 0")
 	}
 
-	op := ItemOpRecord{UID: uid}
-	if left == 0 {
-		op.Operation = KItemUpdateTypeDel
-	} else {
-		op.Operation = KItemUpdateTypeUpdate
+	this.pushUpdate(uid, KItemUpdateTypeDel)
+	this.logChange(item, count, 0, reason)
+	this.publishChange(item, count, 0, reason)
+}
+
+//>> 修改道具数量(堆叠或部分扣除)
+func (this *ContainerBase) setItemCount(item ItemInterface, count int64, reason ItemChangeReason) {
+	old := item.GetCount()
+	this.journal(item.GetTID(), func() {
+		item.SetCount(old)
+	})
+
+	this.curLoad += int64(item.GetWeight()) * (count - item.GetCount())
+	item.SetCount(count)
+	this.pushUpdate(item.GetUID(), KItemUpdateTypeUpdate)
+	this.logChange(item, old, count, reason)
+	this.publishChange(item, old, count, reason)
+}
+
+//>> 修改单个道具的过期时间, 0表示永不过期
+func (this *ContainerBase) SetItemExpireTime(uid uint64, expireTime int64) ItemError {
+	item := this.GetItemByUID(uid)
+	if item == nil {
+		return NewItemError(ErrItemNotExist)
 	}
 
-	this.updateQueue = append(this.updateQueue, op)
+	old := item.GetExpireTime()
+	this.journal(item.GetTID(), func() {
+		item.SetExpireTime(old)
+		this.indexExpire(item)
+		if this.owner != nil {
+			this.owner.watchExpire(item)
+		}
+	})
+
+	item.SetExpireTime(expireTime)
+	this.indexExpire(item)
+	if this.owner != nil {
+		this.owner.watchExpire(item)
+	}
+	this.pushUpdate(uid, KItemUpdateTypeUpdate)
+	return nil
+}
+
+//>> 替换道具的实例属性, 数量大于1的堆不能设置属性
+func (this *ContainerBase) SetItemAttrs(uid uint64, attrs *ItemAttrs) ItemError {
+	item := this.GetItemByUID(uid)
+	if item == nil {
+		return NewItemError(ErrItemNotExist)
+	}
+
+	attrs = attrs.Clone()
+	if attrs != nil && item.GetCount() > 1 {
+		err := NewItemError(ErrInvalidCount)
+		err.Param = append(err.Param, int(item.GetTID()), int(item.GetCount()))
+		return err
+	}
+
+	old := item.GetAttrs()
+	this.journal(item.GetTID(), func() {
+		item.SetAttrs(old)
+	})
+
+	item.SetAttrs(attrs)
+	this.pushUpdate(uid, KItemUpdateTypeUpdate)
+	return nil
+}
+
+//>> 记录道具变化, 同时用于同步客户端和增量存盘
+func (this *ContainerBase) pushUpdate(uid uint64, op ItemUpdateType) {
+	this.updateQueue = append(this.updateQueue, ItemOpRecord{UID: uid, Operation: op})
+	if this.dirty == nil {
+		this.dirty = make(map[uint64]bool)
+	}
+	this.dirty[uid] = true
+}
+
+//>> 取出并清空更新队列
+func (this *ContainerBase) drainUpdateQueue() []ItemOpRecord {
+	//>> 事务还没结束的修改可能被回滚，等事务结束再同步
+	if this.tx != nil {
+		return nil
+	}
+	ops := this.updateQueue
+	this.updateQueue = nil
+	return ops
+}
+
+//>> 容器里的所有道具
+func (this *ContainerBase) getAllItems() []ItemInterface {
+	items := make([]ItemInterface, 0, len(this.items))
+	for _, item := range this.items {
+		items = append(items, item)
+	}
+	return items
+}
+
+func (this *ContainerBase) setOwner(owner *ItemComponent) {
+	this.owner = owner
+}
+
+//>> 容器里单堆的上限
+func (this *ContainerBase) getMaxOverlap(tid int32) int64 {
+	if this.stackLimit != nil {
+		return this.stackLimit(tid)
+	}
+	return getItemMaxOverlap(tid)
+}
+
+//>> 新加的道具只能补到未绑定、没有实例属性且过期时间一样的堆上
+func canStackOn(item ItemInterface, expire int64) bool {
+	return item.GetFlag() == 0 && item.GetExpireTime() == expire && item.GetAttrs().IsEmpty()
 }
 
 func (ItemUidDesc) convertToMap(items []ItemUidDesc) map[uint64]int64 {
@@ -517,18 +902,60 @@ func (ItemTidDesc) convertToMap(items []ItemTidDesc) map[int32]int64 {
 	return itemMap
 }
 
+//>> map的遍历顺序是随机的, 批量操作按tid从小到大处理, 同一批道具生成的uid、格子和日志顺序都是确定的
+func sortedTIDs(itemMap map[int32]int64) []int32 {
+	tids := make([]int32, 0, len(itemMap))
+	for tid := range itemMap {
+		tids = append(tids, tid)
+	}
+	sort.Slice(tids, func(i, j int) bool { return tids[i] < tids[j] })
+	return tids
+}
+
 //>> 根据道具ID从配置表里找到道具类型
 func getItemType(tid int32) int32 {
+	if tmpl := GetItemTemplate(tid); tmpl != nil {
+		return tmpl.Type
+	}
 	return 0
 }
 
 //>> 返回道具负重
 func getItemWeight(tid int32) int32 {
+	if tmpl := GetItemTemplate(tid); tmpl != nil {
+		return tmpl.Weight
+	}
+	return 0
+}
+
+//>> 返回道具最大堆叠, 没配或配置小于1的都视为不可堆叠
+func getItemMaxOverlap(tid int32) int64 {
+	if tmpl := GetItemTemplate(tid); tmpl != nil && tmpl.MaxOverlap > 1 {
+		return tmpl.MaxOverlap
+	}
+	return 1
+}
+
+//>> 返回道具持有上限, 0表示不限
+func getItemMaxHold(tid int32) int64 {
+	if tmpl := GetItemTemplate(tid); tmpl != nil && tmpl.MaxHold > 0 {
+		return tmpl.MaxHold
+	}
 	return 0
 }
 
-//>> 返回道具最大堆叠
-func getItemMaxOverlap(tid int32) int {
+//>> 按模板计算now获得的道具什么时候过期, 0表示不过期
+func calcExpireTime(tid int32, now int64) int64 {
+	tmpl := GetItemTemplate(tid)
+	if tmpl == nil {
+		return 0
+	}
+	if tmpl.ExpireAt > 0 {
+		return tmpl.ExpireAt
+	}
+	if tmpl.Duration > 0 {
+		return now + tmpl.Duration
+	}
 	return 0
 }
 
@@ -536,7 +963,9 @@ func getItemMaxOverlap(tid int32) int {
 func getItemContainerType(tid int32) ContainerType {
 	retTyp := KContainerTypeInvalid
 	switch getItemType(tid) {
-	case 0:
+	case KItemTypeCurrency:
+		retTyp = KContainerTypeWallet
+	case KItemTypeNormal:
 		retTyp = KContainerTypeBag
 	default:
 		retTyp = KContainerTypeBag
@@ -546,10 +975,8 @@ func getItemContainerType(tid int32) ContainerType {
 
 func NewItem(tid int32, count int64) ItemInterface {
 	switch getItemType(tid) {
-	case 0:
-		// todo: uid
-		return &ItemBase{uid: 0, tid: tid, count: count}
+	//>> 需要特殊实现的道具类型在这里扩展
 	default:
+		return &ItemBase{uid: nextUID(), tid: tid, count: count}
 	}
-	return nil
 }
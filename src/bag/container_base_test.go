@@ -0,0 +1,136 @@
+package bag_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bag"
+)
+
+func TestLoadBeyondInt32(t *testing.T) {
+	warehouse := bag.NewWarehouse(10, 0)
+	items, err := warehouse.AddItem(tidStone, 1<<20, 1)
+	if err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if got := warehouse.GetLoad(); got != math.MaxInt32 {
+		t.Fatalf("load = %d, want MaxInt32", got)
+	}
+
+	if err := warehouse.ReduceItemByUID(items[0].GetUID(), 1<<20-1, 1); err != nil {
+		t.Fatalf("ReduceItemByUID: %v", err)
+	}
+	if got := warehouse.GetLoad(); got != 1<<20 {
+		t.Fatalf("load = %d, want %d", got, 1<<20)
+	}
+}
+
+func TestStacking(t *testing.T) {
+	container := bag.NewBag(10, 0)
+	items, err := container.AddItem(tidPotion, 45, 1)
+	if err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if len(items) != 3 || items[0].GetCount() != 20 || items[2].GetCount() != 5 {
+		t.Fatalf("45 potions stacked into %d items", len(items))
+	}
+
+	//>> 先补满未满的堆
+	more, _ := container.AddItem(tidPotion, 10, 1)
+	if len(more) != 1 || more[0] != items[2] || items[2].GetCount() != 15 {
+		t.Fatalf("10 more potions: %d items, last stack %d", len(more), items[2].GetCount())
+	}
+	if got := container.GetSize(); got != 3 {
+		t.Fatalf("size = %d, want 3", got)
+	}
+
+	//>> 不可堆叠的每个占一格
+	swords, _ := container.AddItem(tidSword, 3, 1)
+	if len(swords) != 3 || container.GetSize() != 6 {
+		t.Fatalf("3 swords: %d items, size %d", len(swords), container.GetSize())
+	}
+
+	//>> 批量加和逐个加的堆叠结果一样
+	batch := bag.NewBag(10, 0)
+	batch.AddItems([]bag.ItemTidDesc{{TID: tidPotion, Count: 30}, {TID: tidPotion, Count: 25}, {TID: tidSword, Count: 3}}, 1)
+	if batch.GetSize() != container.GetSize() || batch.GetItemCount(tidPotion) != 55 {
+		t.Fatalf("AddItems: size %d potion %d", batch.GetSize(), batch.GetItemCount(tidPotion))
+	}
+}
+
+func TestLoadItemTemplateJSON(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tmpl")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.json")
+	ioutil.WriteFile(path, []byte(`[{"tid": 7, "weight": 2, "max_overlap": 50}]`), 0644)
+
+	table, err := bag.LoadItemTemplateJSON(path)
+	if err != nil {
+		t.Fatalf("LoadItemTemplateJSON: %v", err)
+	}
+	if tmpl := table.GetItemTemplate(7); tmpl == nil || tmpl.Weight != 2 || tmpl.MaxOverlap != 50 {
+		t.Fatalf("template 7 = %+v", tmpl)
+	}
+}
+
+func TestCapacityAndLoad(t *testing.T) {
+	container := bag.NewBag(3, 20)
+	container.AddItem(tidPotion, 10, 1)
+
+	if err := container.TryAddItem(tidSword, 3); err == nil || err.Code != bag.ErrContainerFull || err.Param[1] != 1 {
+		t.Fatalf("3 swords into 2 free slots: %v", err)
+	}
+	if err := container.TryAddItem(tidSword, 2); err != nil {
+		t.Fatalf("2 swords: %v", err)
+	}
+	if err := container.TryAddItem(tidPotion, 11); err == nil || err.Code != bag.ErrOverLoad || err.Param[1] != 1 {
+		t.Fatalf("potions over the load limit: %v", err)
+	}
+	//>> 整批一起算, 单独都放得下的组合也可能超
+	if err := container.TryAddItems([]bag.ItemTidDesc{{TID: tidPotion, Count: 6}, {TID: tidSword, Count: 1}}); err == nil || err.Code != bag.ErrOverLoad {
+		t.Fatalf("batch over the load limit: %v", err)
+	}
+
+	if _, err := container.AddItem(tidSword, 3, 1); err == nil {
+		t.Fatal("AddItem should fail when full")
+	}
+	if container.GetSize() != 1 || container.GetLoad() != 10 {
+		t.Fatalf("failed add changed the bag: size %d load %d", container.GetSize(), container.GetLoad())
+	}
+}
+
+func TestAddUnknownTemplate(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.SetOverflowPolicy(bag.KOverflowMail, 0)
+
+	if _, err := component.AddItem(bag.KContainerTypeBag, 77777, 1, 1); err == nil || err.Code != bag.ErrTemplateNotExist {
+		t.Fatalf("add unknown tid: %v", err)
+	}
+	//>> 整批拒绝, 也不能当成溢出进邮箱
+	_, err := component.AddItemsWithResult(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 10}, {TID: 77777, Count: 1}}, 1)
+	if err == nil || err.Code != bag.ErrTemplateNotExist || err.Param[0] != 77777 {
+		t.Fatalf("batch with unknown tid: %v", err)
+	}
+	if component.GetItemCount(tidOre) != 0 {
+		t.Fatal("rejected batch added ore")
+	}
+}
+
+func TestAddItemsOrder(t *testing.T) {
+	//>> 同一批道具每次都按tid顺序放进格子
+	for i := 0; i < 20; i++ {
+		container := bag.NewBag(10, 0)
+		added, err := container.AddItems([]bag.ItemTidDesc{{TID: tidSword, Count: 1}, {TID: tidOre, Count: 5}, {TID: tidPotion, Count: 1}}, 1)
+		if err != nil {
+			t.Fatalf("AddItems: %v", err)
+		}
+		for j, tid := range []int32{tidPotion, tidOre, tidSword} {
+			if added[j].GetTID() != tid || added[j].GetPos() != int16(j) {
+				t.Fatalf("item %d: tid %d pos %d, want tid %d pos %d", j, added[j].GetTID(), added[j].GetPos(), tid, j)
+			}
+		}
+	}
+}
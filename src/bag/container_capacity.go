@@ -0,0 +1,235 @@
+package bag
+
+import (
+	"math"
+	"sort"
+)
+
+/**
+* @Description: 容器容量
+	maxSize/maxLoad是永久容量, 购买格子、升级负重用ExpandSize/ExpandLoad扩充, 跟着存档保存, 在事务中可以回滚.
+	格子可以单独锁定(比如还没开放的格子), 锁定的格子也存档; 减益用SetCapacityDebuff临时降低容量, 不存档, 由buff系统上线时重新设置.
+	锁定的格子和超出临时容量的格子都是不可用格子:
+		不可用格子里原有的道具保留, 可以移出、使用、扣除, 已有的堆也还能继续叠加;
+		不能再往不可用格子里放道具(加道具、移动、拆分、SwapIn), TryAddItem按可用的空格子和可用负重计算;
+		负重超过临时上限时, 加任何有负重的道具都会失败, 直到负重降下来.
+	容量变化在下一次BuildDelta里同步给客户端
+**/
+
+//>> 扩充n个格子, 不限格子数的容器不能扩充
+func (this *ContainerBase) ExpandSize(n int32) ItemError {
+	if n <= 0 || this.maxSize <= 0 {
+		err := NewItemError(ErrInvalidCount)
+		err.Param = append(err.Param, 0, int(n))
+		return err
+	}
+	//>> 格子位置是int16
+	if over := int64(this.maxSize) + int64(n) - (math.MaxInt16 + 1); over > 0 {
+		err := NewItemError(ErrExceedLimit)
+		err.Param = append(err.Param, 0, int(over))
+		return err
+	}
+
+	old := this.maxSize
+	this.capacityChanged(func() { this.maxSize = old }, true)
+	this.maxSize += n
+	return nil
+}
+
+//>> 提高n点负重上限, 不限负重的容器不能扩充
+func (this *ContainerBase) ExpandLoad(n int32) ItemError {
+	if n <= 0 || this.maxLoad <= 0 {
+		err := NewItemError(ErrInvalidCount)
+		err.Param = append(err.Param, 0, int(n))
+		return err
+	}
+	if over := int64(this.maxLoad) + int64(n) - math.MaxInt32; over > 0 {
+		err := NewItemError(ErrExceedLimit)
+		err.Param = append(err.Param, 0, int(over))
+		return err
+	}
+
+	old := this.maxLoad
+	this.capacityChanged(func() { this.maxLoad = old }, true)
+	this.maxLoad += n
+	return nil
+}
+
+//>> 锁定格子, 格子里已有的道具保留
+func (this *ContainerBase) LockSlot(pos int16) ItemError {
+	if !this.isValidPos(pos) {
+		return NewItemError(ErrInvalidPos)
+	}
+	if this.lockedSlots[pos] {
+		return nil
+	}
+
+	if this.lockedSlots == nil {
+		this.lockedSlots = make(map[int16]bool)
+	}
+	this.capacityChanged(func() { delete(this.lockedSlots, pos) }, true)
+	this.lockedSlots[pos] = true
+	return nil
+}
+
+//>> 解锁格子
+func (this *ContainerBase) UnlockSlot(pos int16) ItemError {
+	if !this.isValidPos(pos) {
+		return NewItemError(ErrInvalidPos)
+	}
+	if !this.lockedSlots[pos] {
+		return nil
+	}
+
+	this.capacityChanged(func() { this.lockedSlots[pos] = true }, true)
+	delete(this.lockedSlots, pos)
+	return nil
+}
+
+//>> 锁定的格子, 从小到大
+func (this *ContainerBase) GetLockedSlots() []int16 {
+	if len(this.lockedSlots) == 0 {
+		return nil
+	}
+	slots := make([]int16, 0, len(this.lockedSlots))
+	for pos := range this.lockedSlots {
+		slots = append(slots, pos)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	return slots
+}
+
+//>> 临时降低size个格子、load点负重, 传0取消; 多个减益的叠加由调用方算好
+func (this *ContainerBase) SetCapacityDebuff(size, load int32) {
+	if size < 0 {
+		size = 0
+	}
+	if load < 0 {
+		load = 0
+	}
+	if size == this.sizeDebuff && load == this.loadDebuff {
+		return
+	}
+
+	oldSize, oldLoad := this.sizeDebuff, this.loadDebuff
+	//>> 减益是临时的, 只同步给客户端不存盘
+	this.capacityChanged(func() { this.sizeDebuff, this.loadDebuff = oldSize, oldLoad }, false)
+	this.sizeDebuff, this.loadDebuff = size, load
+}
+
+//>> 可用的格子数(去掉锁定的和减益的), maxSize<=0时同样表示不限
+func (this *ContainerBase) GetUsableSize() int32 {
+	if this.maxSize <= 0 {
+		return this.maxSize
+	}
+
+	end := this.usableEnd()
+	size := end
+	for pos := range this.lockedSlots {
+		if int32(pos) < end {
+			size--
+		}
+	}
+	return size
+}
+
+//>> 可用的负重上限, maxLoad<=0时同样表示不限
+func (this *ContainerBase) GetUsableLoad() int32 {
+	if this.maxLoad <= 0 {
+		return this.maxLoad
+	}
+	if load := this.maxLoad - this.loadDebuff; load > 0 {
+		return load
+	}
+	return 0
+}
+
+//>> 超出负重上限的部分, 不超返回0
+func (this *ContainerBase) overLoad(load int64) int64 {
+	if this.maxLoad <= 0 {
+		return 0
+	}
+	if over := load - int64(this.GetUsableLoad()); over > 0 {
+		return over
+	}
+	return 0
+}
+
+//>> 减益后可用格子的结束位置(不含)
+func (this *ContainerBase) usableEnd() int32 {
+	if end := this.maxSize - this.sizeDebuff; end > 0 {
+		return end
+	}
+	return 0
+}
+
+//>> 格子能不能放新道具
+func (this *ContainerBase) isSlotUsable(pos int16) bool {
+	if this.lockedSlots[pos] {
+		return false
+	}
+	return this.maxSize <= 0 || int32(pos) < this.usableEnd()
+}
+
+//>> 可用格子里放着的道具数, 不可用格子里的道具不占可用容量
+func (this *ContainerBase) usedUsableSlots() int32 {
+	if this.maxSize <= 0 {
+		return this.curSize
+	}
+
+	used := this.curSize
+	end := this.usableEnd()
+	for pos := range this.lockedSlots {
+		if _, ok := this.pos2UID[pos]; ok && int32(pos) < end {
+			used--
+		}
+	}
+	for pos := end; pos < this.maxSize; pos++ {
+		if _, ok := this.pos2UID[int16(pos)]; ok {
+			used--
+		}
+	}
+	return used
+}
+
+//>> 整理时道具依次放的格子: 先放可用格子, 放不下的放到不可用格子里
+func (this *ContainerBase) sortPositions(n int) []int16 {
+	var usable, unusable []int16
+	for pos := int16(0); len(usable) < n && this.isValidPos(pos); pos++ {
+		if this.isSlotUsable(pos) {
+			usable = append(usable, pos)
+		} else {
+			unusable = append(unusable, pos)
+		}
+		if pos == math.MaxInt16 {
+			break
+		}
+	}
+	return append(usable, unusable...)
+}
+
+//>> 记下容量的撤销操作并标记需要同步, persist为true时还要存盘
+func (this *ContainerBase) capacityChanged(undo func(), persist bool) {
+	if this.tx != nil {
+		dirty, unsaved := this.capacityDirty, this.capacityUnsaved
+		this.tx.record(func() {
+			undo()
+			this.capacityDirty, this.capacityUnsaved = dirty, unsaved
+		})
+	}
+	this.capacityDirty = true
+	if persist {
+		this.capacityUnsaved = true
+	}
+}
+
+//>> 取出并清除容量变化标记
+func (this *ContainerBase) drainCapacityChanged() bool {
+	//>> 和drainUpdateQueue一样, 事务结束再同步
+	if this.tx != nil {
+		return false
+	}
+	changed := this.capacityDirty
+	this.capacityDirty = false
+	return changed
+}
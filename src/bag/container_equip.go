@@ -0,0 +1,68 @@
+package bag
+
+/**
+* @Description: 装备栏, 每个格子对应一个装备部位
+**/
+
+//>> 装备部位
+type EquipSlotType int32
+
+const (
+	KEquipSlotNone     EquipSlotType = iota
+	KEquipSlotWeapon                 // 武器
+	KEquipSlotHelmet                 // 头盔
+	KEquipSlotArmor                  // 衣服
+	KEquipSlotShoes                  // 鞋子
+	KEquipSlotRing                   // 戒指
+	KEquipSlotNecklace               // 项链
+)
+
+//>> 默认装备栏布局, 下标即格子位置
+var DefaultEquipSlots = []EquipSlotType{
+	KEquipSlotWeapon,
+	KEquipSlotHelmet,
+	KEquipSlotArmor,
+	KEquipSlotShoes,
+	KEquipSlotRing,
+	KEquipSlotRing,
+	KEquipSlotNecklace,
+}
+
+type Equipment struct {
+	ContainerBase
+	slots []EquipSlotType
+}
+
+//>> slots[i]为第i个格子的装备部位
+func NewEquipment(slots []EquipSlotType) *Equipment {
+	equip := &Equipment{slots: append([]EquipSlotType(nil), slots...)}
+	equip.init(KContainerTypeEquip, int32(len(slots)), 0)
+	equip.acceptPos = equip.accept
+	return equip
+}
+
+//>> 格子的装备部位
+func (this *Equipment) GetSlotType(pos int16) EquipSlotType {
+	if pos < 0 || int(pos) >= len(this.slots) {
+		return KEquipSlotNone
+	}
+	return this.slots[pos]
+}
+
+//>> 装备栏的格子位置是固定的，不需要整理
+func (this *Equipment) Sort(rule SortRule) ItemError {
+	return nil
+}
+
+func (this *Equipment) accept(tid int32, pos int16) bool {
+	slot := this.GetSlotType(pos)
+	return slot != KEquipSlotNone && slot == getItemEquipSlot(tid)
+}
+
+//>> 返回道具的装备部位
+func getItemEquipSlot(tid int32) EquipSlotType {
+	if tmpl := GetItemTemplate(tid); tmpl != nil {
+		return EquipSlotType(tmpl.EquipSlot)
+	}
+	return KEquipSlotNone
+}
@@ -0,0 +1,50 @@
+package bag_test
+
+import (
+	"testing"
+
+	"bag"
+)
+
+func TestEquipTransfer(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 2, 1)
+	first, second := swords[0], swords[1]
+	bagBox := component.GetContainerByType(bag.KContainerTypeBag)
+	equip := component.GetContainerByType(bag.KContainerTypeEquip)
+
+	//>> 武器不能放到头盔位, 失败时留在背包
+	if err := component.Transfer(first.GetUID(), bag.KContainerTypeBag, bag.KContainerTypeEquip, 1); err == nil || err.Code != bag.ErrSlotMismatch {
+		t.Fatalf("sword into the helmet slot: %v", err)
+	}
+	if bagBox.GetItemByUID(first.GetUID()) != first {
+		t.Fatal("sword left the bag after a failed transfer")
+	}
+
+	if err := component.Transfer(first.GetUID(), bag.KContainerTypeBag, bag.KContainerTypeEquip, 0); err != nil {
+		t.Fatalf("equip sword: %v", err)
+	}
+	if equip.GetItemByPos(0) != first || bagBox.GetItemByUID(first.GetUID()) != nil {
+		t.Fatal("sword not equipped")
+	}
+
+	//>> 换装备时旧的回到新装备原来的格子
+	pos := second.GetPos()
+	if err := component.Transfer(second.GetUID(), bag.KContainerTypeBag, bag.KContainerTypeEquip, 0); err != nil {
+		t.Fatalf("swap swords: %v", err)
+	}
+	if equip.GetItemByPos(0) != second || bagBox.GetItemByPos(pos) != first {
+		t.Fatal("swords not swapped")
+	}
+
+	//>> 存仓库再取出来还是同一个道具
+	if err := component.Transfer(first.GetUID(), bag.KContainerTypeBag, bag.KContainerTypeWarehouse, -1); err != nil {
+		t.Fatalf("store sword: %v", err)
+	}
+	if err := component.Transfer(first.GetUID(), bag.KContainerTypeWarehouse, bag.KContainerTypeBag, -1); err != nil {
+		t.Fatalf("take sword: %v", err)
+	}
+	if bagBox.GetItemByUID(first.GetUID()) != first {
+		t.Fatal("sword lost its identity in the warehouse")
+	}
+}
@@ -0,0 +1,336 @@
+package bag
+
+import (
+	"math"
+	"sort"
+)
+
+/**
+* @Description: 容器格子管理: 占位表、移动、交换、整理
+**/
+
+//>> 整理背包的排序规则, a排在b前面返回true
+type SortRule func(a, b ItemInterface) bool
+
+//>> 默认整理规则: 按道具类型、模板id排, 同模板数量多的在前
+func DefaultSortRule(a, b ItemInterface) bool {
+	if a.GetType() != b.GetType() {
+		return a.GetType() < b.GetType()
+	}
+	if a.GetTID() != b.GetTID() {
+		return a.GetTID() < b.GetTID()
+	}
+	if a.GetCount() != b.GetCount() {
+		return a.GetCount() > b.GetCount()
+	}
+	return a.GetUID() < b.GetUID()
+}
+
+//>> 根据格子返回道具
+func (this *ContainerBase) GetItemByPos(pos int16) ItemInterface {
+	if uid, ok := this.pos2UID[pos]; ok {
+		return this.items[uid]
+	}
+	return nil
+}
+
+//>> 移动道具到指定格子: 空格子直接放, 同模板未满的堆自动合并, 否则两个道具交换位置
+func (this *ContainerBase) MoveItem(uid uint64, targetPos int16) ItemError {
+	item := this.GetItemByUID(uid)
+	if item == nil {
+		return NewItemError(ErrItemNotExist)
+	}
+	if !this.isValidPos(targetPos) {
+		return NewItemError(ErrInvalidPos)
+	}
+	if !this.canPlace(item.GetTID(), targetPos) {
+		return NewItemError(ErrSlotMismatch)
+	}
+
+	target := this.GetItemByPos(targetPos)
+	if target == nil {
+		this.setItemPos(item, targetPos)
+		return nil
+	}
+	if target == item {
+		return nil
+	}
+
+	if canMerge(target, item) && this.mergeItem(target, item) {
+		return nil
+	}
+	return this.SwapPosition(targetPos, item.GetPos())
+}
+
+//>> 交换两个格子, 其中一个为空就相当于移动
+func (this *ContainerBase) SwapPosition(dstPos, srcPos int16) ItemError {
+	if !this.isValidPos(dstPos) || !this.isValidPos(srcPos) {
+		return NewItemError(ErrInvalidPos)
+	}
+
+	dst := this.GetItemByPos(dstPos)
+	src := this.GetItemByPos(srcPos)
+	if dst == nil && src == nil {
+		return NewItemError(ErrItemNotExist)
+	}
+	if dstPos == srcPos {
+		return nil
+	}
+	if (src != nil && !this.canPlace(src.GetTID(), dstPos)) || (dst != nil && !this.canPlace(dst.GetTID(), srcPos)) {
+		return NewItemError(ErrSlotMismatch)
+	}
+
+	if src != nil {
+		this.setItemPos(src, dstPos)
+	}
+	if dst != nil {
+		this.setItemPos(dst, srcPos)
+	}
+	return nil
+}
+
+//>> 拆分堆叠: 从uid对应的堆里分出count个放到pos, pos<0表示放到第一个空格子
+func (this *ContainerBase) SplitItem(uid uint64, count int64, pos int16) (ItemInterface, ItemError) {
+	item := this.GetItemByUID(uid)
+	if item == nil {
+		return nil, NewItemError(ErrItemNotExist)
+	}
+	if count <= 0 || count >= item.GetCount() || count > item.GetCount()-this.locked[uid] {
+		err := NewItemError(ErrInvalidCount)
+		err.Param = append(err.Param, int(item.GetTID()), int(count))
+		return nil, err
+	}
+
+	if pos < 0 {
+		pos = this.findFreePos(item.GetTID())
+	}
+	if pos < 0 {
+		err := NewItemError(ErrContainerFull)
+		err.Param = append(err.Param, int(item.GetTID()), 1)
+		return nil, err
+	}
+	if !this.isValidPos(pos) || this.GetItemByPos(pos) != nil {
+		return nil, NewItemError(ErrInvalidPos)
+	}
+	if !this.canPlace(item.GetTID(), pos) {
+		return nil, NewItemError(ErrSlotMismatch)
+	}
+
+	newItem := NewItem(item.GetTID(), count)
+	newItem.SetCreateTime(item.GetCreateTime())
+	newItem.SetFlag(item.GetFlag())
+	newItem.SetExpireTime(item.GetExpireTime())
+
+	err := atomically(this.tx, this.Begin, func() ItemError {
+		this.setItemCount(item, item.GetCount()-count, KItemChangeReasonMove)
+		this.insertItem(newItem, pos, KItemChangeReasonMove)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newItem, nil
+}
+
+//>> 整理背包: 合并同模板未满的堆，再按rule排序从0号格子开始紧凑排列(跳过不可用格子), rule为nil时用DefaultSortRule
+func (this *ContainerBase) Sort(rule SortRule) ItemError {
+	if rule == nil {
+		rule = DefaultSortRule
+	}
+
+	return atomically(this.tx, this.Begin, func() ItemError {
+		tids := make([]int32, 0, len(this.tid2UIDs))
+		for tid := range this.tid2UIDs {
+			tids = append(tids, tid)
+		}
+		sort.Slice(tids, func(i, j int) bool { return tids[i] < tids[j] })
+		for _, tid := range tids {
+			this.compactStacks(tid)
+		}
+
+		items := make([]ItemInterface, 0, len(this.items))
+		for _, item := range this.items {
+			items = append(items, item)
+		}
+		sort.SliceStable(items, func(i, j int) bool { return rule(items[i], items[j]) })
+
+		positions := this.sortPositions(len(items))
+		for i, item := range items {
+			if i >= len(positions) {
+				return NewItemError(ErrInvalidPos)
+			}
+			if item.GetPos() != positions[i] {
+				this.setItemPos(item, positions[i])
+			}
+		}
+		return nil
+	})
+}
+
+//>> 把同一模板的道具尽量合并到前面的堆里
+func (this *ContainerBase) compactStacks(tid int32) {
+	maxOverlap := this.getMaxOverlap(tid)
+	if maxOverlap <= 1 {
+		return
+	}
+
+	stacks := this.GetItemsByTID(tid)
+	sort.SliceStable(stacks, func(i, j int) bool { return stacks[i].GetCount() > stacks[j].GetCount() })
+
+	for i := 0; i < len(stacks); i++ {
+		for j := len(stacks) - 1; j > i && stacks[i].GetCount() < maxOverlap; j-- {
+			if this.items[stacks[j].GetUID()] == stacks[j] && canMerge(stacks[i], stacks[j]) {
+				this.mergeItem(stacks[i], stacks[j])
+			}
+		}
+	}
+}
+
+//>> 把src合并到dst上，src合并完会被删除, dst已满或src被锁定返回false
+func (this *ContainerBase) mergeItem(dst, src ItemInterface) bool {
+	if this.locked[src.GetUID()] > 0 {
+		return false
+	}
+	room := this.getMaxOverlap(dst.GetTID()) - dst.GetCount()
+	if room <= 0 {
+		return false
+	}
+
+	n := src.GetCount()
+	if n > room {
+		n = room
+	}
+	this.setItemCount(dst, dst.GetCount()+n, KItemChangeReasonMove)
+	this.delItem(src.GetUID(), n, KItemChangeReasonMove)
+	return true
+}
+
+//>> 同模板、标记相同(比如都是绑定的)、过期时间相同才能合并, 带实例属性的不合并
+func canMerge(dst, src ItemInterface) bool {
+	if !dst.GetAttrs().IsEmpty() || !src.GetAttrs().IsEmpty() {
+		return false
+	}
+	return dst.GetTID() == src.GetTID() && dst.GetFlag() == src.GetFlag() && dst.GetExpireTime() == src.GetExpireTime()
+}
+
+func (this *ContainerBase) isValidPos(pos int16) bool {
+	if pos < 0 {
+		return false
+	}
+	return this.maxSize <= 0 || int32(pos) < this.maxSize
+}
+
+//>> 格子能否放这个模板的道具, 锁定的和超出临时容量的格子不能放
+func (this *ContainerBase) canPlace(tid int32, pos int16) bool {
+	if !this.isSlotUsable(pos) {
+		return false
+	}
+	return this.acceptPos == nil || this.acceptPos(tid, pos)
+}
+
+//>> 找第一个能放这个模板道具的空闲格子，没有返回-1
+func (this *ContainerBase) findFreePos(tid int32) int16 {
+	return this.findFreePosExcept(tid, nil)
+}
+
+//>> 同findFreePos, 跳过taken中已经被预占的格子
+func (this *ContainerBase) findFreePosExcept(tid int32, taken map[int16]bool) int16 {
+	for pos := int16(0); this.isValidPos(pos); pos++ {
+		if _, ok := this.pos2UID[pos]; !ok && !taken[pos] && this.canPlace(tid, pos) {
+			return pos
+		}
+		if pos == math.MaxInt16 {
+			break
+		}
+	}
+	return -1
+}
+
+//>> 修改道具位置
+func (this *ContainerBase) setItemPos(item ItemInterface, pos int16) {
+	uid := item.GetUID()
+	old := item.GetPos()
+	prev, occupied := this.pos2UID[pos]
+	owned := this.pos2UID[old] == uid
+	this.journal(item.GetTID(), func() {
+		if occupied {
+			this.pos2UID[pos] = prev
+		} else {
+			delete(this.pos2UID, pos)
+		}
+		if owned {
+			this.pos2UID[old] = uid
+		}
+		item.SetPos(old)
+	})
+
+	if owned {
+		delete(this.pos2UID, old)
+	}
+	item.SetPos(pos)
+	this.pos2UID[pos] = uid
+
+	this.pushUpdate(uid, KItemUpdateTypeUpdate)
+}
+
+//>> 把道具整个移出容器, 道具本身不销毁，可以SwapIn到别的容器
+func (this *ContainerBase) SwapOut(uid uint64) (ItemInterface, ItemError) {
+	return this.swapOut(uid, KItemChangeReasonTransfer)
+}
+
+func (this *ContainerBase) swapOut(uid uint64, reason ItemChangeReason) (ItemInterface, ItemError) {
+	item := this.GetItemByUID(uid)
+	if item == nil {
+		return nil, NewItemError(ErrItemNotExist)
+	}
+	if this.locked[uid] > 0 {
+		return nil, NewItemError(ErrItemLocked)
+	}
+	if err := this.checkFrozen(item.GetTID(), item.GetCount()); err != nil {
+		return nil, err
+	}
+
+	this.delItem(uid, item.GetCount(), reason)
+	return item, nil
+}
+
+//>> 把别的容器移出的道具放到指定格子, pos<0表示放到第一个能放的空格子
+func (this *ContainerBase) SwapIn(item ItemInterface, pos int16) ItemError {
+	return this.swapIn(item, pos, KItemChangeReasonTransfer)
+}
+
+func (this *ContainerBase) swapIn(item ItemInterface, pos int16, reason ItemChangeReason) ItemError {
+	if item == nil {
+		return NewItemError(ErrItemNotExist)
+	}
+	if this.GetItemByUID(item.GetUID()) != nil {
+		return NewItemError(ErrItemExist)
+	}
+
+	if pos < 0 {
+		if pos = this.findFreePos(item.GetTID()); pos < 0 {
+			err := NewItemError(ErrContainerFull)
+			err.Param = append(err.Param, int(item.GetTID()), 1)
+			return err
+		}
+	}
+	if !this.isValidPos(pos) {
+		return NewItemError(ErrInvalidPos)
+	}
+	if !this.canPlace(item.GetTID(), pos) {
+		return NewItemError(ErrSlotMismatch)
+	}
+	if this.GetItemByPos(pos) != nil {
+		return NewItemError(ErrInvalidPos)
+	}
+
+	load := this.curLoad + int64(item.GetWeight())*item.GetCount()
+	if over := this.overLoad(load); over > 0 && item.GetWeight() > 0 {
+		err := NewItemError(ErrOverLoad)
+		err.Param = append(err.Param, int(item.GetTID()), int(over))
+		return err
+	}
+
+	this.insertItem(item, pos, reason)
+	return nil
+}
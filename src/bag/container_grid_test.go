@@ -0,0 +1,65 @@
+package bag_test
+
+import (
+	"testing"
+
+	"bag"
+)
+
+func TestMoveAndSwap(t *testing.T) {
+	container := bag.NewBag(10, 0)
+	swords, _ := container.AddItem(tidSword, 1, 1)
+	ores, _ := container.AddItem(tidOre, 10, 1)
+	sword, ore := swords[0], ores[0]
+
+	if err := container.MoveItem(sword.GetUID(), 5); err != nil || sword.GetPos() != 5 || container.GetItemByPos(0) != nil {
+		t.Fatalf("move to an empty slot: %v, pos %d", err, sword.GetPos())
+	}
+	//>> 目标格子有别的道具时交换
+	orePos := ore.GetPos()
+	if err := container.MoveItem(ore.GetUID(), 5); err != nil || ore.GetPos() != 5 || sword.GetPos() != orePos {
+		t.Fatalf("move onto the sword: %v, ore %d sword %d", err, ore.GetPos(), sword.GetPos())
+	}
+
+	//>> 同模板的堆合并
+	split, err := container.SplitItem(ore.GetUID(), 4, 7)
+	if err != nil || split.GetPos() != 7 || ore.GetCount() != 6 {
+		t.Fatalf("SplitItem: %v", err)
+	}
+	if err := container.MoveItem(split.GetUID(), 5); err != nil || ore.GetCount() != 10 || container.GetItemByUID(split.GetUID()) != nil {
+		t.Fatalf("merge split ore back: %v, ore %d", err, ore.GetCount())
+	}
+
+	if err := container.SwapPosition(8, 9); err == nil || err.Code != bag.ErrItemNotExist {
+		t.Fatalf("swap two empty slots: %v", err)
+	}
+	if err := container.MoveItem(sword.GetUID(), 10); err == nil || err.Code != bag.ErrInvalidPos {
+		t.Fatalf("move out of range: %v", err)
+	}
+}
+
+func TestSort(t *testing.T) {
+	container := bag.NewBag(10, 0)
+	container.AddItem(tidSword, 1, 1)
+	ores, _ := container.AddItem(tidOre, 30, 1)
+	container.SplitItem(ores[0].GetUID(), 10, 6)
+	container.SplitItem(ores[0].GetUID(), 10, 8)
+	container.AddItem(tidPotion, 5, 1)
+
+	if err := container.Sort(nil); err != nil {
+		t.Fatalf("Sort: %v", err)
+	}
+	want := []struct {
+		tid   int32
+		count int64
+	}{{tidPotion, 5}, {tidOre, 30}, {tidSword, 1}}
+	if container.GetSize() != int32(len(want)) {
+		t.Fatalf("size after sort = %d, want %d", container.GetSize(), len(want))
+	}
+	for pos, w := range want {
+		item := container.GetItemByPos(int16(pos))
+		if item == nil || item.GetTID() != w.tid || item.GetCount() != w.count {
+			t.Fatalf("pos %d after sort: %+v", pos, item)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package bag
+
+import (
+	"math"
+	"sort"
+)
+
+/**
+* @Description: 道具查询
+	ItemQuery用链式调用组合条件, 条件之间是"且"的关系, 比如查强化5到10级的未绑定武器, 按强化等级排序取第一页:
+		NewItemQuery().Types(weapon).Flag(IsBind, 0).IntAttr(AttrEnhanceLevel, 5, 10).OrderBy(rule).Page(0, 20)
+	容器维护模板id和有过期时间的道具两个索引, 加删道具和修改过期时间时更新, 事务回滚时一起撤销.
+	道具类型来自模板, 重新加载模板后可能变化, 所以不单独建索引, 按类型查时从模板id索引里挑出类型符合的模板.
+	查询先从用得上的索引(包括格子)里挑候选最少的一个, 再逐个检查其余条件, 大仓库按类型或模板查不用扫全部道具.
+	标记和实例属性可以直接在道具上修改, 不建索引, 只在候选上过滤
+**/
+
+//>> 查询条件, 零值表示不限
+type ItemQuery struct {
+	tids       []int32
+	types      []int32
+	flagMask   int
+	flagValue  int
+	intAttrs   []intAttrCond
+	strAttrs   map[string]string
+	posFrom    int16
+	posTo      int16
+	hasPos     bool
+	expireFrom int64
+	expireTo   int64
+	hasExpire  bool
+	filters    []func(item ItemInterface) bool
+	order      SortRule
+	offset     int
+	limit      int
+}
+
+type intAttrCond struct {
+	key      string
+	min, max int64
+}
+
+//>> 查询结果
+type ItemQueryResult struct {
+	Items []ItemInterface //>> 当前页的道具
+	Total int             //>> 满足条件的总数
+}
+
+func NewItemQuery() *ItemQuery {
+	return &ItemQuery{}
+}
+
+//>> 模板id是其中之一, 多次调用取并集
+func (this *ItemQuery) TIDs(tids ...int32) *ItemQuery {
+	this.tids = appendUnique(this.tids, tids)
+	return this
+}
+
+//>> 道具类型是其中之一, 多次调用取并集
+func (this *ItemQuery) Types(types ...int32) *ItemQuery {
+	this.types = appendUnique(this.types, types)
+	return this
+}
+
+//>> 标记里mask对应的位等于value, 比如Flag(IsBind, IsBind)只要绑定的, Flag(IsBind, 0)只要不绑定的
+func (this *ItemQuery) Flag(mask, value int) *ItemQuery {
+	this.flagMask |= mask
+	this.flagValue = this.flagValue&^mask | value&mask
+	return this
+}
+
+//>> 整数属性在[min, max]之间, 没有这个属性当作0
+func (this *ItemQuery) IntAttr(key string, min, max int64) *ItemQuery {
+	this.intAttrs = append(this.intAttrs, intAttrCond{key: key, min: min, max: max})
+	return this
+}
+
+//>> 字符串属性等于value
+func (this *ItemQuery) StringAttr(key, value string) *ItemQuery {
+	if this.strAttrs == nil {
+		this.strAttrs = make(map[string]string)
+	}
+	this.strAttrs[key] = value
+	return this
+}
+
+//>> 格子在[from, to]之间
+func (this *ItemQuery) PosRange(from, to int16) *ItemQuery {
+	this.posFrom, this.posTo, this.hasPos = from, to, true
+	return this
+}
+
+//>> 过期时间(unix秒)在[from, to]之间, 不会过期的道具不算
+func (this *ItemQuery) ExpireBetween(from, to int64) *ItemQuery {
+	this.expireFrom, this.expireTo, this.hasExpire = from, to, true
+	return this
+}
+
+//>> 自定义条件
+func (this *ItemQuery) Where(filter func(item ItemInterface) bool) *ItemQuery {
+	this.filters = append(this.filters, filter)
+	return this
+}
+
+//>> 结果的排序规则, 默认按格子
+func (this *ItemQuery) OrderBy(rule SortRule) *ItemQuery {
+	this.order = rule
+	return this
+}
+
+//>> 分页, 跳过offset个后最多返回limit个, limit<=0表示不限
+func (this *ItemQuery) Page(offset, limit int) *ItemQuery {
+	this.offset, this.limit = offset, limit
+	return this
+}
+
+func (this *ItemQuery) match(item ItemInterface) bool {
+	if len(this.tids) > 0 && !containsInt32(this.tids, item.GetTID()) {
+		return false
+	}
+	if len(this.types) > 0 && !containsInt32(this.types, item.GetType()) {
+		return false
+	}
+	if item.GetFlag()&this.flagMask != this.flagValue {
+		return false
+	}
+	if this.hasPos && (item.GetPos() < this.posFrom || item.GetPos() > this.posTo) {
+		return false
+	}
+	if this.hasExpire {
+		expire := item.GetExpireTime()
+		if expire <= 0 || expire < this.expireFrom || expire > this.expireTo {
+			return false
+		}
+	}
+
+	attrs := item.GetAttrs()
+	for _, cond := range this.intAttrs {
+		if v := attrs.GetInt(cond.key); v < cond.min || v > cond.max {
+			return false
+		}
+	}
+	for key, value := range this.strAttrs {
+		if attrs.GetString(key) != value {
+			return false
+		}
+	}
+
+	for _, filter := range this.filters {
+		if !filter(item) {
+			return false
+		}
+	}
+	return true
+}
+
+//>> 按条件查询道具, query为nil表示查全部
+func (this *ContainerBase) QueryItems(query *ItemQuery) *ItemQueryResult {
+	if query == nil {
+		query = NewItemQuery()
+	}
+
+	var items []ItemInterface
+	this.queryCandidates(query, func(item ItemInterface) {
+		if query.match(item) {
+			items = append(items, item)
+		}
+	})
+
+	rule := query.order
+	if rule == nil {
+		rule = func(a, b ItemInterface) bool { return a.GetPos() < b.GetPos() }
+	}
+	sort.SliceStable(items, func(i, j int) bool { return rule(items[i], items[j]) })
+
+	result := &ItemQueryResult{Total: len(items)}
+	if query.offset > 0 {
+		if query.offset >= len(items) {
+			return result
+		}
+		items = items[query.offset:]
+	}
+	if query.limit > 0 && query.limit < len(items) {
+		items = items[:query.limit]
+	}
+	result.Items = items
+	return result
+}
+
+//>> 从候选最少的索引里取出候选道具, 每个道具只回调一次
+func (this *ContainerBase) queryCandidates(query *ItemQuery, fn func(item ItemInterface)) {
+	const (
+		byAll = iota
+		byTID
+		byType
+		byExpire
+		byPos
+	)
+
+	by, best := byAll, len(this.items)
+	if len(query.tids) > 0 {
+		n := 0
+		for _, tid := range query.tids {
+			n += len(this.tid2UIDs[tid])
+		}
+		if n < best {
+			by, best = byTID, n
+		}
+	}
+	var typeTIDs []int32
+	if len(query.types) > 0 {
+		n := 0
+		for tid, uids := range this.tid2UIDs {
+			if containsInt32(query.types, getItemType(tid)) {
+				typeTIDs = append(typeTIDs, tid)
+				n += len(uids)
+			}
+		}
+		if n < best {
+			by, best = byType, n
+		}
+	}
+	if query.hasExpire && len(this.expiring) < best {
+		by, best = byExpire, len(this.expiring)
+	}
+	if query.hasPos && query.posFrom <= query.posTo && int(query.posTo)-int(query.posFrom)+1 < best {
+		by = byPos
+	}
+
+	//>> 索引和items不一致时跳过, 不把nil交给条件检查
+	visit := func(uid uint64) {
+		if item := this.items[uid]; item != nil {
+			fn(item)
+		}
+	}
+
+	switch by {
+	case byTID:
+		for _, tid := range query.tids {
+			for _, uid := range this.tid2UIDs[tid] {
+				visit(uid)
+			}
+		}
+	case byType:
+		for _, tid := range typeTIDs {
+			for _, uid := range this.tid2UIDs[tid] {
+				visit(uid)
+			}
+		}
+	case byExpire:
+		for uid := range this.expiring {
+			visit(uid)
+		}
+	case byPos:
+		for pos := query.posFrom; ; pos++ {
+			if uid, ok := this.pos2UID[pos]; ok {
+				visit(uid)
+			}
+			if pos == query.posTo || pos == math.MaxInt16 {
+				break
+			}
+		}
+	default:
+		for _, item := range this.items {
+			fn(item)
+		}
+	}
+}
+
+//>> 把道具加到过期索引
+func (this *ContainerBase) indexItem(item ItemInterface) {
+	this.indexExpire(item)
+}
+
+//>> 从过期索引里删掉道具
+func (this *ContainerBase) unindexItem(item ItemInterface) {
+	delete(this.expiring, item.GetUID())
+}
+
+//>> 按道具当前的过期时间更新过期索引
+func (this *ContainerBase) indexExpire(item ItemInterface) {
+	if item.GetExpireTime() <= 0 {
+		delete(this.expiring, item.GetUID())
+		return
+	}
+	if this.expiring == nil {
+		this.expiring = make(map[uint64]bool)
+	}
+	this.expiring[item.GetUID()] = true
+}
+
+//>> 重建所有索引, 比如从存档恢复之后
+func (this *ContainerBase) rebuildIndexes() {
+	this.expiring = nil
+	for _, item := range this.items {
+		this.indexItem(item)
+	}
+}
+
+func containsInt32(list []int32, v int32) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+//>> 把values里没有的追加到list
+func appendUnique(list, values []int32) []int32 {
+	for _, v := range values {
+		if !containsInt32(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
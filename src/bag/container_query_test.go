@@ -0,0 +1,31 @@
+package bag_test
+
+import (
+	"testing"
+
+	"bag"
+)
+
+func TestQueryTypeAfterTemplateReload(t *testing.T) {
+	const typeArmor = 7
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidSword, 2, 1)
+	component.AddItem(bag.KContainerTypeBag, tidHelmet, 1, 1)
+
+	reloaded := bag.ItemTemplateTable{}
+	for tid, tmpl := range testTemplates {
+		copied := *tmpl
+		reloaded[tid] = &copied
+	}
+	reloaded[tidHelmet].Type = typeArmor
+	bag.SetItemTemplateProvider(reloaded)
+	defer bag.SetItemTemplateProvider(testTemplates)
+
+	result := component.QueryItems(bag.KContainerTypeBag, bag.NewItemQuery().Types(typeArmor))
+	if result.Total != 1 || result.Items[0].GetTID() != tidHelmet {
+		t.Fatalf("armor after reload: total %d", result.Total)
+	}
+	if got := component.QueryItems(bag.KContainerTypeBag, bag.NewItemQuery().Types(0)).Total; got != 2 {
+		t.Fatalf("untyped after reload = %d, want 2", got)
+	}
+}
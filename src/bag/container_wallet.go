@@ -0,0 +1,41 @@
+package bag
+
+import (
+	"math"
+)
+
+/**
+* @Description: 钱包, 放金币钻石之类的货币
+	每种货币只有一个堆, 没有堆叠上限也不占背包格子, 余额上限用模板的MaxHold配置.
+	加货币时会检查int64溢出, 扣除走容器的正常流程, 余额不会扣成负数
+**/
+
+type Wallet struct {
+	ContainerBase
+}
+
+func NewWallet() *Wallet {
+	wallet := &Wallet{}
+	wallet.init(KContainerTypeWallet, 0, 0)
+	wallet.stackLimit = func(int32) int64 { return math.MaxInt64 }
+	return wallet
+}
+
+//>> 货币余额
+func (this *Wallet) GetBalance(tid int32) int64 {
+	return this.GetItemCount(tid)
+}
+
+//>> 货币不分堆
+func (this *Wallet) SplitItem(uid uint64, count int64, pos int16) (ItemInterface, ItemError) {
+	err := NewItemError(ErrInvalidCount)
+	if item := this.GetItemByUID(uid); item != nil {
+		err.Param = append(err.Param, int(item.GetTID()), int(count))
+	}
+	return nil, err
+}
+
+//>> 钱包没有格子的概念，不需要整理
+func (this *Wallet) Sort(rule SortRule) ItemError {
+	return nil
+}
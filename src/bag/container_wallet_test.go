@@ -0,0 +1,59 @@
+package bag_test
+
+import (
+	"testing"
+
+	"bag"
+)
+
+func TestWalletBalance(t *testing.T) {
+	wallet := bag.NewWallet()
+	for i := 0; i < 3; i++ {
+		wallet.AddItem(tidGold, 100, 1)
+	}
+	//>> 每种货币只有一个堆, 不占格子
+	if got := wallet.GetBalance(tidGold); got != 300 {
+		t.Fatalf("gold = %d, want 300", got)
+	}
+	golds := wallet.GetItemsByTID(tidGold)
+	if len(golds) != 1 {
+		t.Fatalf("gold in %d stacks, want 1", len(golds))
+	}
+
+	if _, err := wallet.SplitItem(golds[0].GetUID(), 50, -1); err == nil || err.Code != bag.ErrInvalidCount {
+		t.Fatalf("split gold: %v", err)
+	}
+	if err := wallet.Sort(nil); err != nil {
+		t.Fatalf("Sort: %v", err)
+	}
+
+	//>> 正好到上限可以, 多一个都不行
+	if _, err := wallet.AddItem(tidDiamond, 1000, 1); err != nil {
+		t.Fatalf("diamond up to the cap: %v", err)
+	}
+	if err := wallet.TryAddItem(tidDiamond, 1); err == nil || err.Code != bag.ErrExceedLimit {
+		t.Fatalf("diamond over the cap: %v", err)
+	}
+}
+
+func TestWalletRouting(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	if component.GetContainerByTID(tidGold).GetType() != bag.KContainerTypeWallet {
+		t.Fatal("gold should route to the wallet")
+	}
+	component.AddItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidGold, Count: 100}, {TID: tidPotion, Count: 10}}, 1)
+
+	//>> 扣的时候货币和道具也可以混在一起, 不够时都不扣
+	items := []bag.ItemTidDesc{{TID: tidGold, Count: 101}, {TID: tidPotion, Count: 1}}
+	if err := component.ReduceItems(bag.KContainerTypeBag, items, 1); err == nil {
+		t.Fatal("reduce more gold than the balance should fail")
+	}
+	items[0].Count = 100
+	if err := component.ReduceItems(bag.KContainerTypeBag, items, 1); err != nil {
+		t.Fatalf("ReduceItems: %v", err)
+	}
+	wallet := component.GetContainerByType(bag.KContainerTypeWallet).(*bag.Wallet)
+	if wallet.GetBalance(tidGold) != 0 || component.GetItemCount(tidPotion) != 9 {
+		t.Fatalf("gold %d potion %d", wallet.GetBalance(tidGold), component.GetItemCount(tidPotion))
+	}
+}
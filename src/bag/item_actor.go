@@ -0,0 +1,251 @@
+package bag
+
+import (
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+* @Description: 背包actor
+	ContainerBase没有加锁, 只能在一个goroutine里用. 网络、定时器等其他goroutine要操作背包时,
+	用ItemActor把操作投递到这个玩家自己的队列里, 由actor的goroutine按投递顺序依次执行, Update也在这个goroutine里定时调用.
+	Call阻塞等结果, Post执行完在actor的goroutine里回调. 操作函数里直接用传进来的ItemComponent, 不要再调Call, 会死锁.
+	同时修改几个玩家背包的操作(比如交易)用Exclusive: 让这些actor都停下来, 在调用者的goroutine里执行
+**/
+
+//>> actor里执行的操作
+type ItemOp func(component *ItemComponent) ItemError
+
+type ItemActor struct {
+	component *ItemComponent
+	queue     chan func()
+	tick      time.Duration
+
+	lock    sync.RWMutex //>> 保护stopped和关闭queue
+	stopped bool
+	done    chan struct{}
+
+	held int32 //>> 被Exclusive停住时为1, 用atomic读写
+}
+
+//>> queueSize为队列长度, 满了投递会阻塞; tick为调用Update的间隔
+func NewItemActor(component *ItemComponent, queueSize int, tick time.Duration) *ItemActor {
+	if queueSize <= 0 {
+		queueSize = 64
+	}
+	if tick <= 0 {
+		tick = 100 * time.Millisecond
+	}
+
+	actor := &ItemActor{
+		component: component,
+		queue:     make(chan func(), queueSize),
+		tick:      tick,
+		done:      make(chan struct{}),
+	}
+	component.actor = actor
+	go actor.loop()
+	return actor
+}
+
+//>> 投递操作并等待结果
+func (this *ItemActor) Call(op ItemOp) ItemError {
+	result := make(chan ItemError, 1)
+	if !this.send(func() { result <- this.run(op) }) {
+		return NewItemError(ErrActorStopped)
+	}
+	return <-result
+}
+
+//>> 投递操作, 执行完在actor的goroutine里调用cb, cb可以为nil
+func (this *ItemActor) Post(op ItemOp, cb func(err ItemError)) {
+	ok := this.send(func() {
+		err := this.run(op)
+		if cb != nil {
+			cb(err)
+		}
+	})
+	if !ok && cb != nil {
+		cb(NewItemError(ErrActorStopped))
+	}
+}
+
+//>> 停止actor, 已经投递的操作会执行完再返回
+func (this *ItemActor) Stop() {
+	this.lock.Lock()
+	if !this.stopped {
+		this.stopped = true
+		close(this.queue)
+	}
+	this.lock.Unlock()
+	<-this.done
+}
+
+//>> 加道具, 返回加完后的道具状态(不能把道具本身交给别的goroutine)
+func (this *ItemActor) AddItems(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) ([]ItemState, ItemError) {
+	var ret []ItemState
+	err := this.Call(func(component *ItemComponent) ItemError {
+		added, err := component.AddItems(typ, items, reason)
+		ret = itemStates(added)
+		return err
+	})
+	return ret, err
+}
+
+func (this *ItemActor) AddItemsAsync(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason, cb func(added []ItemState, err ItemError)) {
+	var ret []ItemState
+	this.Post(func(component *ItemComponent) ItemError {
+		added, err := component.AddItems(typ, items, reason)
+		ret = itemStates(added)
+		return err
+	}, func(err ItemError) {
+		if cb != nil {
+			cb(ret, err)
+		}
+	})
+}
+
+func (this *ItemActor) ReduceItems(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) ItemError {
+	return this.Call(func(component *ItemComponent) ItemError {
+		return component.ReduceItems(typ, items, reason)
+	})
+}
+
+func (this *ItemActor) ReduceItemsAsync(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason, cb func(err ItemError)) {
+	this.Post(func(component *ItemComponent) ItemError {
+		return component.ReduceItems(typ, items, reason)
+	}, cb)
+}
+
+func (this *ItemActor) ReduceAndAddItems(typ ContainerType, delItems, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError {
+	return this.Call(func(component *ItemComponent) ItemError {
+		return component.ReduceAndAddItems(typ, delItems, giveItems, reason)
+	})
+}
+
+func (this *ItemActor) ReduceAndAddItemsAsync(typ ContainerType, delItems, giveItems []ItemTidDesc, reason ItemChangeReason, cb func(err ItemError)) {
+	this.Post(func(component *ItemComponent) ItemError {
+		return component.ReduceAndAddItems(typ, delItems, giveItems, reason)
+	}, cb)
+}
+
+//>> 获取道具数量
+func (this *ItemActor) GetItemCount(tid int32) int64 {
+	count := int64(0)
+	this.Call(func(component *ItemComponent) ItemError {
+		count = component.GetItemCount(tid)
+		return nil
+	})
+	return count
+}
+
+func (this *ItemActor) send(task func()) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.stopped {
+		return false
+	}
+	this.queue <- task
+	return true
+}
+
+//>> 让actors都停下来, 在调用者的goroutine里执行fn, fn里可以直接修改这些actor的ItemComponent.
+//>> 按玩家id的顺序停下, 同时执行的Exclusive不会互相等死; 不能在actor的操作函数里调用
+func Exclusive(actors []*ItemActor, fn func() ItemError) ItemError {
+	sorted := append([]*ItemActor(nil), actors...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].component.GetPlayerID() < sorted[j].component.GetPlayerID()
+	})
+
+	var releases []func()
+	defer func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}()
+	for i, actor := range sorted {
+		if i > 0 && actor == sorted[i-1] {
+			continue
+		}
+		release, err := actor.hold()
+		if err != nil {
+			return err
+		}
+		releases = append(releases, release)
+	}
+	return fn()
+}
+
+//>> 投递一个一直等待的任务, 任务开始执行后返回, 调用release之前actor的goroutine不会碰component
+func (this *ItemActor) hold() (release func(), err ItemError) {
+	held, done := make(chan struct{}), make(chan struct{})
+	if !this.send(func() {
+		atomic.StoreInt32(&this.held, 1)
+		close(held)
+		<-done
+		atomic.StoreInt32(&this.held, 0)
+	}) {
+		return nil, NewItemError(ErrActorStopped)
+	}
+	<-held
+	return func() { close(done) }, nil
+}
+
+//>> 执行操作, panic不会弄死actor; op里Begin之后没结束的事务会被回滚
+func (this *ItemActor) run(op ItemOp) (err ItemError) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("player:%d item op panic: %v\n%s", this.component.GetPlayerID(), r, debug.Stack())
+			err = NewItemError(-1)
+		}
+		if tx := this.component.tx; tx != nil {
+			tx.Rollback()
+		}
+	}()
+	return op(this.component)
+}
+
+func (this *ItemActor) loop() {
+	defer close(this.done)
+
+	ticker := time.NewTicker(this.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case task, ok := <-this.queue:
+			if !ok {
+				this.update()
+				return
+			}
+			task()
+		case <-ticker.C:
+			this.update()
+		}
+	}
+}
+
+func (this *ItemActor) update() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("player:%d item update panic: %v\n%s", this.component.GetPlayerID(), r, debug.Stack())
+		}
+	}()
+	this.component.Update()
+}
+
+func itemStates(items []ItemInterface) []ItemState {
+	if len(items) == 0 {
+		return nil
+	}
+	states := make([]ItemState, 0, len(items))
+	for _, item := range items {
+		states = append(states, newItemState(item))
+	}
+	return states
+}
@@ -0,0 +1,202 @@
+package bag
+
+import "sort"
+
+/**
+* @Description: 道具实例属性
+	强化等级、随机词条、耐久这类每个道具自己的数据放在ItemAttrs里, 值可以是整数、字符串或者嵌套的ItemAttrs.
+	带属性的道具不能堆叠: 新道具不会补到带属性的堆上, 整理和移动也不会合并它们, 数量大于1的堆不能设置属性.
+	要让修改同步给客户端并存盘, 需要通过容器的SetItemAttrs或ItemComponent.ModifyItemAttrs来改
+**/
+
+//>> 常用的属性key
+const (
+	AttrEnhanceLevel  = "enhance_level"  //>> 强化等级
+	AttrDurability    = "durability"     //>> 当前耐久
+	AttrMaxDurability = "max_durability" //>> 耐久上限
+	AttrAffixes       = "affixes"        //>> 随机词条, 每条词条是一个嵌套属性
+)
+
+//>> 道具实例属性, nil和空的ItemAttrs都表示没有属性
+type ItemAttrs struct {
+	Ints    map[string]int64      `json:"ints,omitempty"`
+	Strings map[string]string     `json:"strings,omitempty"`
+	Structs map[string]*ItemAttrs `json:"structs,omitempty"`
+}
+
+func NewItemAttrs() *ItemAttrs {
+	return &ItemAttrs{}
+}
+
+func (this *ItemAttrs) GetInt(key string) int64 {
+	if this == nil {
+		return 0
+	}
+	return this.Ints[key]
+}
+
+func (this *ItemAttrs) SetInt(key string, value int64) {
+	if this.Ints == nil {
+		this.Ints = make(map[string]int64)
+	}
+	this.Ints[key] = value
+}
+
+func (this *ItemAttrs) GetString(key string) string {
+	if this == nil {
+		return ""
+	}
+	return this.Strings[key]
+}
+
+func (this *ItemAttrs) SetString(key string, value string) {
+	if this.Strings == nil {
+		this.Strings = make(map[string]string)
+	}
+	this.Strings[key] = value
+}
+
+//>> 返回嵌套属性, 没有返回nil
+func (this *ItemAttrs) GetStruct(key string) *ItemAttrs {
+	if this == nil {
+		return nil
+	}
+	return this.Structs[key]
+}
+
+func (this *ItemAttrs) SetStruct(key string, value *ItemAttrs) {
+	if this.Structs == nil {
+		this.Structs = make(map[string]*ItemAttrs)
+	}
+	this.Structs[key] = value
+}
+
+//>> 删除key, 不管是哪种类型
+func (this *ItemAttrs) Del(key string) {
+	if this == nil {
+		return
+	}
+	delete(this.Ints, key)
+	delete(this.Strings, key)
+	delete(this.Structs, key)
+}
+
+func (this *ItemAttrs) IsEmpty() bool {
+	if this == nil {
+		return true
+	}
+	if len(this.Ints) > 0 || len(this.Strings) > 0 {
+		return false
+	}
+	for _, sub := range this.Structs {
+		if !sub.IsEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+//>> 深拷贝, 空属性返回nil
+func (this *ItemAttrs) Clone() *ItemAttrs {
+	if this.IsEmpty() {
+		return nil
+	}
+
+	ret := &ItemAttrs{}
+	for k, v := range this.Ints {
+		ret.SetInt(k, v)
+	}
+	for k, v := range this.Strings {
+		ret.SetString(k, v)
+	}
+	for k, v := range this.Structs {
+		if sub := v.Clone(); sub != nil {
+			ret.SetStruct(k, sub)
+		}
+	}
+	return ret
+}
+
+//>> 按key排好序编码, 保证同样的属性编码结果一样
+func (this *ItemAttrs) encode(w *byteWriter) {
+	if this.IsEmpty() {
+		w.bool(false)
+		return
+	}
+	w.bool(true)
+
+	ints := make([]string, 0, len(this.Ints))
+	for k := range this.Ints {
+		ints = append(ints, k)
+	}
+	sort.Strings(ints)
+	w.uvarint(uint64(len(ints)))
+	for _, k := range ints {
+		w.string(k)
+		w.varint(this.Ints[k])
+	}
+
+	strs := make([]string, 0, len(this.Strings))
+	for k := range this.Strings {
+		strs = append(strs, k)
+	}
+	sort.Strings(strs)
+	w.uvarint(uint64(len(strs)))
+	for _, k := range strs {
+		w.string(k)
+		w.string(this.Strings[k])
+	}
+
+	structs := make([]string, 0, len(this.Structs))
+	for k, v := range this.Structs {
+		if !v.IsEmpty() {
+			structs = append(structs, k)
+		}
+	}
+	sort.Strings(structs)
+	w.uvarint(uint64(len(structs)))
+	for _, k := range structs {
+		w.string(k)
+		this.Structs[k].encode(w)
+	}
+}
+
+func decodeItemAttrs(r *byteReader) *ItemAttrs {
+	if !r.bool() {
+		return nil
+	}
+
+	attrs := &ItemAttrs{}
+	n := r.length()
+	for i := 0; i < n && r.err == nil; i++ {
+		attrs.SetInt(r.string(), r.varint())
+	}
+	n = r.length()
+	for i := 0; i < n && r.err == nil; i++ {
+		attrs.SetString(r.string(), r.string())
+	}
+	n = r.length()
+	for i := 0; i < n && r.err == nil; i++ {
+		key := r.string()
+		attrs.SetStruct(key, decodeItemAttrs(r))
+	}
+	return attrs
+}
+
+//>> 修改道具属性, fn拿到的是属性的拷贝, 改完后整体替换, 同步客户端并存盘
+func (this *ItemComponent) ModifyItemAttrs(uid uint64, fn func(attrs *ItemAttrs)) ItemError {
+	for _, container := range this.containers {
+		item := container.GetItemByUID(uid)
+		if item == nil {
+			continue
+		}
+
+		attrs := item.GetAttrs().Clone()
+		if attrs == nil {
+			attrs = NewItemAttrs()
+		}
+		fn(attrs)
+		return container.SetItemAttrs(uid, attrs)
+	}
+	return NewItemError(ErrItemNotExist)
+}
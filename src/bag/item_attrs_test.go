@@ -0,0 +1,121 @@
+package bag_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"bag"
+)
+
+func TestItemAttrs(t *testing.T) {
+	if !bag.NewItemAttrs().IsEmpty() || bag.NewItemAttrs().Clone() != nil {
+		t.Fatal("new attrs should be empty and clone to nil")
+	}
+
+	affix := bag.NewItemAttrs()
+	affix.SetString("stat", "atk")
+	affix.SetInt("value", 12)
+	attrs := bag.NewItemAttrs()
+	attrs.SetInt(bag.AttrEnhanceLevel, 3)
+	attrs.SetStruct(bag.AttrAffixes, affix)
+
+	//>> 深拷贝, 改拷贝不影响原来的
+	clone := attrs.Clone()
+	clone.SetInt(bag.AttrEnhanceLevel, 4)
+	clone.GetStruct(bag.AttrAffixes).SetInt("value", 99)
+	if attrs.GetInt(bag.AttrEnhanceLevel) != 3 || attrs.GetStruct(bag.AttrAffixes).GetInt("value") != 12 {
+		t.Fatal("clone shares data with the original")
+	}
+	if attrs.GetStruct(bag.AttrAffixes).GetString("stat") != "atk" {
+		t.Fatal("nested string lost")
+	}
+
+	attrs.Del(bag.AttrEnhanceLevel)
+	attrs.Del(bag.AttrAffixes)
+	if !attrs.IsEmpty() {
+		t.Fatalf("attrs after Del = %+v", attrs)
+	}
+}
+
+func TestModifyItemAttrs(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	ores, _ := component.AddItem(bag.KContainerTypeBag, tidOre, 5, 1)
+	sword := swords[0]
+
+	if err := component.ModifyItemAttrs(sword.GetUID(), func(attrs *bag.ItemAttrs) {
+		attrs.SetInt(bag.AttrEnhanceLevel, 5)
+	}); err != nil {
+		t.Fatalf("ModifyItemAttrs: %v", err)
+	}
+	if sword.GetAttrs().GetInt(bag.AttrEnhanceLevel) != 5 {
+		t.Fatal("enhance level not set")
+	}
+
+	//>> 数量大于1的堆不能有属性
+	err := component.ModifyItemAttrs(ores[0].GetUID(), func(attrs *bag.ItemAttrs) { attrs.SetInt(bag.AttrDurability, 1) })
+	if err == nil || err.Code != bag.ErrInvalidCount {
+		t.Fatalf("attrs on a stack of 5: %v", err)
+	}
+	if err := component.ModifyItemAttrs(12345, func(*bag.ItemAttrs) {}); err == nil || err.Code != bag.ErrItemNotExist {
+		t.Fatalf("attrs on a missing item: %v", err)
+	}
+
+	//>> 回滚时属性也恢复
+	component.Atomic(func() bag.ItemError {
+		component.ModifyItemAttrs(sword.GetUID(), func(attrs *bag.ItemAttrs) { attrs.SetInt(bag.AttrEnhanceLevel, 6) })
+		return bag.NewItemError(bag.ErrItemNotExist)
+	})
+	if sword.GetAttrs().GetInt(bag.AttrEnhanceLevel) != 5 {
+		t.Fatal("attrs not rolled back")
+	}
+}
+
+func TestItemAttrsStacking(t *testing.T) {
+	container := bag.NewBag(10, 0)
+	ores, _ := container.AddItem(tidOre, 1, 1)
+	attrs := bag.NewItemAttrs()
+	attrs.SetInt(bag.AttrDurability, 80)
+	if err := container.SetItemAttrs(ores[0].GetUID(), attrs); err != nil {
+		t.Fatalf("SetItemAttrs: %v", err)
+	}
+
+	//>> 新加的不会补到带属性的堆上
+	added, _ := container.AddItem(tidOre, 3, 1)
+	if len(added) != 1 || added[0] == ores[0] || ores[0].GetCount() != 1 {
+		t.Fatalf("ore stacked onto the item with attrs, count %d", ores[0].GetCount())
+	}
+	if err := container.MoveItem(added[0].GetUID(), ores[0].GetPos()); err != nil || ores[0].GetCount() != 1 {
+		t.Fatalf("move onto the item with attrs merged them: %v", err)
+	}
+}
+
+func TestItemAttrsPersist(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	uid := swords[0].GetUID()
+	component.ModifyItemAttrs(uid, func(attrs *bag.ItemAttrs) {
+		affix := bag.NewItemAttrs()
+		affix.SetString("stat", "crit")
+		attrs.SetStruct(bag.AttrAffixes, affix)
+		attrs.SetInt(bag.AttrEnhanceLevel, 7)
+	})
+
+	jsonData, err := json.Marshal(component)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	for name, load := range map[string]func(c *bag.ItemComponent) error{
+		"binary": func(c *bag.ItemComponent) error { return c.Unmarshal(component.Marshal()) },
+		"json":   func(c *bag.ItemComponent) error { return json.Unmarshal(jsonData, c) },
+	} {
+		loaded := bag.NewItemComponent(1)
+		if err := load(loaded); err != nil {
+			t.Fatalf("%s: load: %v", name, err)
+		}
+		attrs := loaded.GetItemByUID(uid).GetAttrs()
+		if attrs.GetInt(bag.AttrEnhanceLevel) != 7 || attrs.GetStruct(bag.AttrAffixes).GetString("stat") != "crit" {
+			t.Fatalf("%s: attrs after load = %+v", name, attrs)
+		}
+	}
+}
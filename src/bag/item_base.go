@@ -19,6 +19,10 @@ type ItemInterface interface {
 	//>> 一些标记，比如是否是绑定的
 	GetWeight() int32
 	GetFlag() int
+	//>> 过期时间(unix秒), 0表示永不过期
+	GetExpireTime() int64
+	//>> 实例属性, 没有返回nil; 直接修改返回值不会同步客户端, 应该用容器的SetItemAttrs
+	GetAttrs() *ItemAttrs
 
 	SetTID(int32)
 	SetUID(uint64)
@@ -27,8 +31,16 @@ type ItemInterface interface {
 	SetPos(int16)
 	SetContainerType(ContainerType)
 	SetFlag(int)
+	SetExpireTime(int64)
+	SetAttrs(*ItemAttrs)
 }
 
+//>> 道具类型, 对应模板的Type
+const (
+	KItemTypeNormal   = 0 // 普通道具
+	KItemTypeCurrency = 1 // 货币, 放在钱包里, 没有堆叠上限
+)
+
 //>> 道具bit标记
 const (
 	IsBind = 1 << 0
@@ -44,22 +56,24 @@ type ItemBase struct {
 	pos          int16
 	containerTyp int16
 	flag         int
+	expireTime   int64
+	attrs        *ItemAttrs
 }
 
 func (this *ItemBase) GetTID() int32 {
-	panic("implement me")
+	return this.tid
 }
 
 func (this *ItemBase) GetUID() uint64 {
-	panic("implement me")
+	return this.uid
 }
 
 func (this *ItemBase) GetCount() int64 {
-	panic("implement me")
+	return this.count
 }
 
 func (this *ItemBase) GetCreateTime() int64 {
-	panic("implement me")
+	return this.createTime
 }
 
 func (this *ItemBase) GetType() int32 {
@@ -67,11 +81,11 @@ func (this *ItemBase) GetType() int32 {
 }
 
 func (this *ItemBase) GetPos() int16 {
-	panic("implement me")
+	return this.pos
 }
 
 func (this *ItemBase) GetContainerType() ContainerType {
-	panic("implement me")
+	return ContainerType(this.containerTyp)
 }
 
 func (this *ItemBase) GetWeight() int32 {
@@ -79,37 +93,53 @@ func (this *ItemBase) GetWeight() int32 {
 }
 
 func (this *ItemBase) GetFlag() int {
-	panic("implement me")
+	return this.flag
 }
 
-func (this *ItemBase) SetTID(int32) {
-	panic("implement me")
+func (this *ItemBase) SetTID(tid int32) {
+	this.tid = tid
 }
 
-func (this *ItemBase) SetUID(uint64) {
-	panic("implement me")
+func (this *ItemBase) SetUID(uid uint64) {
+	this.uid = uid
 }
 
-func (this *ItemBase) SetCount(int64) {
-	panic("implement me")
+func (this *ItemBase) SetCount(count int64) {
+	this.count = count
 }
 
-func (this *ItemBase) SetCreateTime(int64) {
-	panic("implement me")
+func (this *ItemBase) SetCreateTime(createTime int64) {
+	this.createTime = createTime
 }
 
+//>> 道具类型由模板决定, 不能单独修改
 func (this *ItemBase) SetType(int32) {
-	panic("implement me")
 }
 
-func (this *ItemBase) SetPos(int16) {
-	panic("implement me")
+func (this *ItemBase) SetPos(pos int16) {
+	this.pos = pos
+}
+
+func (this *ItemBase) SetContainerType(typ ContainerType) {
+	this.containerTyp = int16(typ)
+}
+
+func (this *ItemBase) SetFlag(flag int) {
+	this.flag = flag
+}
+
+func (this *ItemBase) GetExpireTime() int64 {
+	return this.expireTime
+}
+
+func (this *ItemBase) SetExpireTime(expireTime int64) {
+	this.expireTime = expireTime
 }
 
-func (this *ItemBase) SetContainerType(ContainerType) {
-	panic("implement me")
+func (this *ItemBase) GetAttrs() *ItemAttrs {
+	return this.attrs
 }
 
-func (this *ItemBase) SetFlag(int) {
-	panic("implement me")
+func (this *ItemBase) SetAttrs(attrs *ItemAttrs) {
+	this.attrs = attrs
 }
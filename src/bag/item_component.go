@@ -1,26 +1,152 @@
 package bag
 
-import "fmt"
+import (
+	"eventdispatcher"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"timer"
+)
+
+const (
+	bagDefaultMaxSize       = 100 //>> 背包默认格子数
+	warehouseDefaultMaxSize = 200 //>> 仓库默认格子数
+)
 
 type Bag struct {
 	ContainerBase
 }
 
+//>> maxLoad<=0表示不限负重
+func NewBag(maxSize, maxLoad int32) *Bag {
+	bag := &Bag{}
+	bag.init(KContainerTypeBag, maxSize, maxLoad)
+	return bag
+}
+
+//>> 仓库
+type Warehouse struct {
+	ContainerBase
+}
+
+func NewWarehouse(maxSize, maxLoad int32) *Warehouse {
+	warehouse := &Warehouse{}
+	warehouse.init(KContainerTypeWarehouse, maxSize, maxLoad)
+	return warehouse
+}
+
 //>> 背包组件
 type ItemComponent struct {
+	//>> 所属玩家
+	playerID uint64
+
 	//>> 容器
 	containers map[ContainerType]ContainerInterface
+
+	//>> 当前事务
+	tx *Transaction
+
+	//>> 道具过期定时器
+	expireTimers map[uint64]timer.HTimer
+	//>> 已经过期但因为冻结、锁定还没删掉的道具
+	expireBlocked map[uint64]bool
+
+	//>> 其他线程(比如timer回调)投递过来、在Update里执行的任务
+	tasks    []func()
+	taskLock sync.Mutex
+
+	//>> 把道具变化同步给客户端
+	syncHandler func(delta *ItemDelta)
+
+	//>> 审计日志
+	logSink ItemLogSink
+
+	//>> 定时增量存盘
+	flushTimer timer.HTimer
+
+	//>> 背包满时放不下的奖励
+	overflowPolicy OverflowPolicy
+	overflowTTL    int64 //>> 秒
+	overflow       []*OverflowMail
+	overflowTimers map[uint64]timer.HTimer
+
+	//>> 道具事件
+	dispatcher    *eventdispatcher.EventDispatcher
+	eventDelivery map[eventdispatcher.EventType]ItemEventDelivery
+
+	//>> 使用道具
+	levelProvider func() int32
+	cooldowns     map[int32]*itemCooldown
+
+	//>> 管理这个背包的actor, 没有时由调用者自己保证单线程
+	actor *ItemActor
+}
+
+func NewItemComponent(playerID uint64) *ItemComponent {
+	component := &ItemComponent{playerID: playerID}
+	component.Init()
+	return component
+}
+
+func (this *ItemComponent) GetPlayerID() uint64 {
+	return this.playerID
 }
 
 func (this *ItemComponent) Init() {
-	this.containers[KContainerTypeBag] = &Bag{}
+	this.containers = make(map[ContainerType]ContainerInterface)
+	this.containers[KContainerTypeBag] = NewBag(bagDefaultMaxSize, 0)
+	this.containers[KContainerTypeEquip] = NewEquipment(DefaultEquipSlots)
+	this.containers[KContainerTypeWarehouse] = NewWarehouse(warehouseDefaultMaxSize, 0)
+	this.containers[KContainerTypeWallet] = NewWallet()
+
+	for _, container := range this.containers {
+		if c, ok := container.(interface{ setOwner(*ItemComponent) }); ok {
+			c.setOwner(this)
+		}
+	}
+	this.watchAllExpire()
 }
 
 func (this *ItemComponent) Update() {
+	this.runTasks()
+
+	//>> 更新至客户端
+	if delta := this.BuildDelta(); delta != nil && this.syncHandler != nil {
+		this.syncHandler(delta)
+	}
+}
+
+//>> 开启跨容器事务，所有容器都加入同一个事务
+func (this *ItemComponent) Begin() *Transaction {
+	if this.tx != nil {
+		return nil
+	}
+
+	tx := NewTransaction()
 	for _, container := range this.containers {
-		//>> 更新至客户端
-		fmt.Println(container.(*ContainerBase).updateQueue)
+		if !tx.Join(container) {
+			tx.Rollback()
+			return nil
+		}
+	}
+	tx.onFinish = append(tx.onFinish, func() {
+		this.tx = nil
+	})
+	this.tx = tx
+	return tx
+}
+
+//>> 背包由actor管理时, 只有在Exclusive里才能从外面直接修改
+func (this *ItemComponent) checkExclusive() ItemError {
+	if this.actor != nil && atomic.LoadInt32(&this.actor.held) == 0 {
+		return NewItemError(ErrNotExclusive)
 	}
+	return nil
+}
+
+//>> 原子地执行fn，fn中对任意容器的修改要么全部生效要么全部撤销
+func (this *ItemComponent) Atomic(fn func() ItemError) ItemError {
+	return atomically(this.tx, this.Begin, fn)
 }
 
 func (this *ItemComponent) GetContainerByTID(tid int32) ContainerInterface {
@@ -51,6 +177,15 @@ func (this *ItemComponent) GetItemsByTID(tid int32) []ItemInterface {
 	return []ItemInterface{}
 }
 
+//>> 在typ容器里按条件查询道具
+func (this *ItemComponent) QueryItems(typ ContainerType, query *ItemQuery) *ItemQueryResult {
+	container := this.GetContainerByType(typ)
+	if container != nil {
+		return container.QueryItems(query)
+	}
+	return &ItemQueryResult{}
+}
+
 //>> 获取道具数量
 func (this *ItemComponent) GetItemCount(tid int32) int64 {
 	container := this.GetContainerByTID(tid)
@@ -60,41 +195,108 @@ func (this *ItemComponent) GetItemCount(tid int32) int64 {
 	return 0
 }
 
+//>> 货币总是在钱包里, 其他道具在typ指定的容器
+func (this *ItemComponent) routeType(typ ContainerType, tid int32) ContainerType {
+	if getItemContainerType(tid) == KContainerTypeWallet {
+		return KContainerTypeWallet
+	}
+	return typ
+}
+
+//>> 把一批道具按所在容器分组, 返回按容器类型排好序的分组
+func (this *ItemComponent) routeItems(typ ContainerType, items []ItemTidDesc) ([]ContainerInterface, [][]ItemTidDesc, ItemError) {
+	groups := make(map[ContainerType][]ItemTidDesc)
+	for _, item := range items {
+		t := this.routeType(typ, item.TID)
+		groups[t] = append(groups[t], item)
+	}
+
+	types := make([]ContainerType, 0, len(groups))
+	for t := range groups {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	containers := make([]ContainerInterface, 0, len(types))
+	ret := make([][]ItemTidDesc, 0, len(types))
+	for _, t := range types {
+		container := this.GetContainerByType(t)
+		if container == nil {
+			return nil, nil, NewItemError(ErrContainerNotExist)
+		}
+		containers = append(containers, container)
+		ret = append(ret, groups[t])
+	}
+	return containers, ret, nil
+}
+
 //>> 检查是否能加道具
 func (this *ItemComponent) TryAddItem(typ ContainerType, tid int32, count int64) ItemError {
-	container := this.GetContainerByType(typ)
+	container := this.GetContainerByType(this.routeType(typ, tid))
 	if container != nil {
 		return container.TryAddItem(tid, count)
 	}
 	return NewItemError(ErrContainerNotExist)
 }
 
-//>> 检查是否能加道具
+//>> 检查是否能加道具, 货币和道具可以混在一起
 func (this *ItemComponent) TryAddItems(typ ContainerType, items []ItemTidDesc) ItemError {
-	container := this.GetContainerByType(typ)
-	if container != nil {
-		return container.TryAddItems(items)
+	containers, groups, err := this.routeItems(typ, items)
+	if err != nil {
+		return err
 	}
-	return NewItemError(ErrContainerNotExist)
+	for i, container := range containers {
+		if err := container.TryAddItems(groups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //>> 增加道具，成功返回增加后的道具, 因为堆叠原因也可能有多个
 func (this *ItemComponent) AddItem(typ ContainerType, tid int32, count int64, reason ItemChangeReason) ([]ItemInterface, ItemError) {
-	container := this.GetContainerByType(typ)
+	container := this.GetContainerByType(this.routeType(typ, tid))
 	if container != nil {
 		return container.AddItem(tid, count, reason)
 	}
 	return nil, NewItemError(ErrContainerNotExist)
 }
 
-//>> 批量加道具, 成功返回增加后的道具切片
+//>> 批量加道具, 成功返回增加后的道具切片; 货币会加到钱包, 整批在一个事务里
+//>> 溢出策略为KOverflowMail时放不下的进溢出邮箱, 想知道哪些进了邮箱用AddItemsWithResult
 func (this *ItemComponent) AddItems(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) ([]ItemInterface, ItemError) {
-	container := this.GetContainerByType(typ)
-	if container != nil {
-		return container.AddItems(items, reason)
+	result, err := this.AddItemsWithResult(typ, items, reason)
+	if err != nil {
+		return nil, err
 	}
+	return result.Added, nil
+}
 
-	return nil, NewItemError(ErrContainerNotExist)
+//>> 不考虑溢出策略, 放不下就失败
+func (this *ItemComponent) addItems(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) ([]ItemInterface, ItemError) {
+	containers, groups, err := this.routeItems(typ, items)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 1 {
+		return containers[0].AddItems(groups[0], reason)
+	}
+
+	var ret []ItemInterface
+	err = this.Atomic(func() ItemError {
+		for i, container := range containers {
+			added, err := container.AddItems(groups[i], reason)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, added...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 //>> 检查是否能扣道具，成功返回nil
@@ -109,7 +311,7 @@ func (this *ItemComponent) TryReduceItemByUID(uid uint64, count int64) ItemError
 
 //>> 检查是否能扣道具，成功返回nil
 func (this *ItemComponent) TryReduceItemByTID(typ ContainerType, tid int32, count int64) ItemError {
-	container := this.GetContainerByType(typ)
+	container := this.GetContainerByType(this.routeType(typ, tid))
 	if container != nil {
 		return container.TryReduceItemByTID(tid, count)
 	}
@@ -118,18 +320,25 @@ func (this *ItemComponent) TryReduceItemByTID(typ ContainerType, tid int32, coun
 
 //>> 检查是否能扣道具，成功返回nil
 func (this *ItemComponent) TryReduceItems(typ ContainerType, items []ItemTidDesc) ItemError {
-	container := this.GetContainerByType(typ)
-	if container != nil {
-		return container.TryReduceItems(items)
+	containers, groups, err := this.routeItems(typ, items)
+	if err != nil {
+		return err
 	}
-	return NewItemError(ErrContainerNotExist)
+	for i, container := range containers {
+		if err := container.TryReduceItems(groups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //>> 扣道具，成功返回nil
 func (this *ItemComponent) ReduceItemByUID(uid uint64, count int64, reason ItemChangeReason) ItemError {
 	for _, container := range this.containers {
-		if container.ReduceItemByUID(uid, count, reason) == nil {
-			return nil
+		if item := container.GetItemByUID(uid); item != nil {
+			return this.reduceWithCooldown(reason, []int32{item.GetTID()}, func() ItemError {
+				return container.ReduceItemByUID(uid, count, reason)
+			})
 		}
 	}
 	return NewItemError(ErrItemNotExist)
@@ -137,36 +346,104 @@ func (this *ItemComponent) ReduceItemByUID(uid uint64, count int64, reason ItemC
 
 //>> 扣道具，成功返回nil
 func (this *ItemComponent) ReduceItemByTID(typ ContainerType, tid int32, count int64, reason ItemChangeReason) ItemError {
-	container := this.GetContainerByType(typ)
+	container := this.GetContainerByType(this.routeType(typ, tid))
 	if container != nil {
-		return container.ReduceItemByTID(tid, count, reason)
+		return this.reduceWithCooldown(reason, []int32{tid}, func() ItemError {
+			return container.ReduceItemByTID(tid, count, reason)
+		})
 	}
 	return NewItemError(ErrContainerNotExist)
 }
 
 //>> 扣道具，成功返回nil
 func (this *ItemComponent) ReduceItems(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) ItemError {
-	container := this.GetContainerByType(typ)
-	if container != nil {
-		return container.ReduceItems(items, reason)
+	if err := this.TryReduceItems(typ, items); err != nil {
+		return err
 	}
-	return NewItemError(ErrContainerNotExist)
+
+	containers, groups, err := this.routeItems(typ, items)
+	if err != nil {
+		return err
+	}
+	tids := make([]int32, 0, len(items))
+	for _, item := range items {
+		tids = append(tids, item.TID)
+	}
+	return this.reduceWithCooldown(reason, tids, func() ItemError {
+		return this.Atomic(func() ItemError {
+			for i, container := range containers {
+				if err := container.ReduceItems(groups[i], reason); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
 }
 
-//>> 扣并给道具，保证事务性
+//>> 扣并给道具，保证事务性, 货币和道具可以混在一起
 func (this *ItemComponent) ReduceAndAddItems(typ ContainerType, delItems, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError {
-	container := this.GetContainerByType(typ)
-	if container != nil {
-		return container.ReduceAndAddItems(delItems, giveItems, reason)
-	}
-	return NewItemError(ErrContainerNotExist)
+	return this.Atomic(func() ItemError {
+		if err := this.ReduceItems(typ, delItems, reason); err != nil {
+			return err
+		}
+
+		//>> 兑换类的操作放不下就失败, 不进溢出邮箱
+		_, err := this.addItems(typ, giveItems, reason)
+		return err
+	})
 }
 
-//>> 扣并给道具，保证事务性
+//>> 按uid扣typ容器里的道具并给道具，保证事务性, 给的货币进钱包
 func (this *ItemComponent) ReduceAndAddItemByUID(typ ContainerType, delUIDs []ItemUidDesc, giveItems []ItemTidDesc, reason ItemChangeReason) ItemError {
 	container := this.GetContainerByType(typ)
-	if container != nil {
-		return container.ReduceAndAddItemByUID(delUIDs, giveItems, reason)
+	if container == nil {
+		return NewItemError(ErrContainerNotExist)
 	}
-	return NewItemError(ErrContainerNotExist)
+	return this.Atomic(func() ItemError {
+		for _, desc := range delUIDs {
+			if err := container.ReduceItemByUID(desc.UID, desc.Count, reason); err != nil {
+				return err
+			}
+		}
+
+		_, err := this.addItems(typ, giveItems, reason)
+		return err
+	})
+}
+
+//>> 跨容器转移道具(穿脱装备、存取仓库), pos<0表示放到目标容器第一个能放的空格子
+//>> 目标格子已经有道具时，把它换回原容器的原位置
+func (this *ItemComponent) Transfer(uid uint64, fromType, toType ContainerType, pos int16) ItemError {
+	from := this.GetContainerByType(fromType)
+	to := this.GetContainerByType(toType)
+	if from == nil || to == nil {
+		return NewItemError(ErrContainerNotExist)
+	}
+	if from == to {
+		return from.MoveItem(uid, pos)
+	}
+
+	item := from.GetItemByUID(uid)
+	if item == nil {
+		return NewItemError(ErrItemNotExist)
+	}
+	srcPos := item.GetPos()
+
+	return this.Atomic(func() ItemError {
+		if _, err := from.SwapOut(uid); err != nil {
+			return err
+		}
+
+		if occupant := to.GetItemByPos(pos); pos >= 0 && occupant != nil {
+			if _, err := to.SwapOut(occupant.GetUID()); err != nil {
+				return err
+			}
+			if err := from.SwapIn(occupant, srcPos); err != nil {
+				return err
+			}
+		}
+
+		return to.SwapIn(item, pos)
+	})
 }
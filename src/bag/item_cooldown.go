@@ -0,0 +1,182 @@
+package bag
+
+import (
+	"sort"
+	"time"
+	"timer"
+)
+
+/**
+* @Description: 道具冷却
+	冷却按冷却组记录(比如所有回血药水一个组), 同组的道具共用冷却, 冷却组和时长配在模板的CDGroup/CDTime上.
+	结束时间用unix毫秒保存, 跟着Snapshot一起存档, 下线期间照常计时.
+	每个冷却组在timer里注册一个定时器, 到期后从表里删掉; 和道具过期一样, timer回调里只投递任务, 在Update里删除.
+	UseItem和ConsumeItem都通过withCooldown检查冷却, 成功提交后开始冷却.
+	ItemComponent上的ReduceItemByUID/ReduceItemByTID/ReduceItems原因是KItemChangeReasonUse时也一样;
+	其他原因(出售、合成、交易、过期等)不是使用道具, 冷却中也可以扣, 也不会开始冷却
+**/
+
+//>> 一个冷却组的存档
+type CooldownState struct {
+	Group   int32 `json:"group"`
+	EndTime int64 `json:"end_time"` //>> 冷却结束的unix毫秒
+}
+
+type itemCooldown struct {
+	endTime int64
+	handle  timer.HTimer
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+//>> 冷却组开始冷却ms毫秒, 已经在冷却中的取较晚的结束时间
+func (this *ItemComponent) StartCooldown(group int32, ms int64) {
+	if group <= 0 || ms <= 0 {
+		return
+	}
+
+	endTime := nowMs() + ms
+	if cd, ok := this.cooldowns[group]; ok && cd.endTime >= endTime {
+		return
+	}
+	this.watchCooldown(group, endTime)
+}
+
+//>> 冷却组还剩多少毫秒, 不在冷却中返回0
+func (this *ItemComponent) GetCooldownLeft(group int32) int64 {
+	cd, ok := this.cooldowns[group]
+	if !ok {
+		return 0
+	}
+	if left := cd.endTime - nowMs(); left > 0 {
+		return left
+	}
+	return 0
+}
+
+//>> 模板所在冷却组还剩多少毫秒
+func (this *ItemComponent) GetItemCooldownLeft(tid int32) int64 {
+	tmpl := GetItemTemplate(tid)
+	if tmpl == nil || tmpl.CDGroup <= 0 {
+		return 0
+	}
+	return this.GetCooldownLeft(tmpl.CDGroup)
+}
+
+//>> 清除冷却, 比如GM命令或者重置冷却的道具
+func (this *ItemComponent) ClearCooldown(group int32) {
+	if cd, ok := this.cooldowns[group]; ok {
+		timer.KillTimer(cd.handle)
+		delete(this.cooldowns, group)
+	}
+}
+
+//>> 所有还在冷却中的组, 按组id排序
+func (this *ItemComponent) GetCooldowns() []CooldownState {
+	now := nowMs()
+	states := make([]CooldownState, 0, len(this.cooldowns))
+	for group, cd := range this.cooldowns {
+		if cd.endTime > now {
+			states = append(states, CooldownState{Group: group, EndTime: cd.endTime})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Group < states[j].Group })
+	return states
+}
+
+//>> 扣掉count个道具并开始冷却, 用于不走UseHandler的消耗, 比如战斗中自动喝药
+func (this *ItemComponent) ConsumeItem(typ ContainerType, tid int32, count int64, reason ItemChangeReason) ItemError {
+	container := this.GetContainerByType(this.routeType(typ, tid))
+	if container == nil {
+		return NewItemError(ErrContainerNotExist)
+	}
+	return this.withCooldown([]int32{tid}, func() ItemError {
+		return container.ReduceItemByTID(tid, count, reason)
+	})
+}
+
+//>> 这些模板都不在冷却中时原子地执行fn, 成功提交后开始冷却; UseItem、ConsumeItem和使用原因的扣除共用
+func (this *ItemComponent) withCooldown(tids []int32, fn func() ItemError) ItemError {
+	for _, tid := range tids {
+		if err := this.checkCooldown(tid); err != nil {
+			return err
+		}
+	}
+	return this.Atomic(func() ItemError {
+		if err := fn(); err != nil {
+			return err
+		}
+		for _, tid := range tids {
+			this.startItemCooldownOnCommit(tid)
+		}
+		return nil
+	})
+}
+
+//>> 使用原因的扣除要检查并开始冷却, 其他原因直接扣
+func (this *ItemComponent) reduceWithCooldown(reason ItemChangeReason, tids []int32, fn func() ItemError) ItemError {
+	if reason != KItemChangeReasonUse {
+		return fn()
+	}
+	return this.withCooldown(tids, fn)
+}
+
+//>> 模板所在冷却组在冷却中返回ErrItemInCooldown
+func (this *ItemComponent) checkCooldown(tid int32) ItemError {
+	tmpl := GetItemTemplate(tid)
+	if tmpl == nil || tmpl.CDGroup <= 0 {
+		return nil
+	}
+	if left := this.GetCooldownLeft(tmpl.CDGroup); left > 0 {
+		err := NewItemError(ErrItemInCooldown)
+		err.Param = append(err.Param, int(tmpl.CDGroup), int(left))
+		return err
+	}
+	return nil
+}
+
+//>> 当前事务提交后开始模板的冷却, 回滚时不冷却
+func (this *ItemComponent) startItemCooldownOnCommit(tid int32) {
+	tmpl := GetItemTemplate(tid)
+	if tmpl == nil || tmpl.CDGroup <= 0 || tmpl.CDTime <= 0 {
+		return
+	}
+	this.tx.deferCommit(func() {
+		this.StartCooldown(tmpl.CDGroup, tmpl.CDTime)
+	})
+}
+
+//>> 记录冷却结束时间并注册定时器, 已经注册过的会先取消
+func (this *ItemComponent) watchCooldown(group int32, endTime int64) {
+	this.ClearCooldown(group)
+	if this.cooldowns == nil {
+		this.cooldowns = make(map[int32]*itemCooldown)
+	}
+
+	cd := &itemCooldown{endTime: endTime}
+	cd.handle = timer.SetTimer(endTime-nowMs(), 1, func(interface{}) bool {
+		this.post(func() {
+			if this.cooldowns[group] == cd {
+				delete(this.cooldowns, group)
+			}
+		})
+		return false
+	}, nil)
+	this.cooldowns[group] = cd
+}
+
+//>> 从存档恢复冷却, 已经结束的丢掉
+func (this *ItemComponent) restoreCooldowns(states []CooldownState) {
+	for group := range this.cooldowns {
+		this.ClearCooldown(group)
+	}
+
+	now := nowMs()
+	for _, state := range states {
+		if state.Group > 0 && state.EndTime > now {
+			this.watchCooldown(state.Group, state.EndTime)
+		}
+	}
+}
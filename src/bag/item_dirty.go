@@ -0,0 +1,250 @@
+package bag
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"timer"
+)
+
+/**
+* @Description: 增量存盘
+	容器的每次修改都会在脏集合里记下uid, 存盘时只写变化过的道具: 还在容器里的upsert, 不在了的delete.
+	key是(容器类型, uid), 道具跨容器转移时旧容器删、新容器写, 互不影响.
+	StartFlusher用timer定时把脏数据写到ItemStore(write-behind), 写失败的会留到下次重试.
+	格子数、负重上限和锁定的格子要用CapacityStore保存, 先于道具写入; 存储不支持时FlushDirty照常写道具, 但会返回errCapacityNotSaved
+**/
+
+var errCapacityNotSaved = errors.New("bag: item store cannot save container capacity")
+
+//>> 道具在存储中的key
+type ItemKey struct {
+	Container ContainerType `json:"container"`
+	UID       uint64        `json:"uid"`
+}
+
+//>> 存储中的一条道具
+type ItemRecord struct {
+	Container ContainerType `json:"container"`
+	Item      ItemState     `json:"item"`
+}
+
+//>> 存储中的容器容量
+type ContainerCapacity struct {
+	Container   ContainerType `json:"container"`
+	MaxSize     int32         `json:"max_size"`
+	MaxLoad     int32         `json:"max_load"`
+	LockedSlots []int16       `json:"locked_slots,omitempty"`
+}
+
+//>> 按道具增量存取的存储
+type ItemStore interface {
+	//>> 一次写入一批变化, 要么全部成功要么全部失败
+	WriteItems(playerID uint64, upserts []ItemRecord, deletes []ItemKey) error
+	//>> 读取玩家的所有道具
+	LoadItems(playerID uint64) ([]ItemRecord, error)
+}
+
+//>> 还能保存容器容量的存储
+type CapacityStore interface {
+	ItemStore
+	//>> 覆盖写入这些容器的容量
+	WriteCapacity(playerID uint64, capacity []ContainerCapacity) error
+	//>> 读取保存过的容器容量, 没保存过的容器不返回
+	LoadCapacity(playerID uint64) ([]ContainerCapacity, error)
+}
+
+//>> 支持增量存盘的容器
+type dirtyContainer interface {
+	ContainerInterface
+	drainDirty() []uint64
+	markDirty(uids []uint64)
+	drainCapacity() (ContainerCapacity, bool)
+	markCapacityDirty()
+}
+
+//>> 取出并清空脏集合, 事务没结束时不取
+func (this *ContainerBase) drainDirty() []uint64 {
+	if this.tx != nil || len(this.dirty) == 0 {
+		return nil
+	}
+
+	uids := make([]uint64, 0, len(this.dirty))
+	for uid := range this.dirty {
+		uids = append(uids, uid)
+	}
+	this.dirty = nil
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+//>> 重新标记为脏, 写失败时用
+func (this *ContainerBase) markDirty(uids []uint64) {
+	if this.dirty == nil {
+		this.dirty = make(map[uint64]bool, len(uids))
+	}
+	for _, uid := range uids {
+		this.dirty[uid] = true
+	}
+}
+
+//>> 永久容量改过还没存盘时取出当前容量, 事务没结束时不取
+func (this *ContainerBase) drainCapacity() (ContainerCapacity, bool) {
+	if this.tx != nil || !this.capacityUnsaved {
+		return ContainerCapacity{}, false
+	}
+	this.capacityUnsaved = false
+	return ContainerCapacity{
+		Container:   this.typ,
+		MaxSize:     this.maxSize,
+		MaxLoad:     this.maxLoad,
+		LockedSlots: this.GetLockedSlots(),
+	}, true
+}
+
+//>> 容量重新标记为没存盘, 写失败时用
+func (this *ContainerBase) markCapacityDirty() {
+	this.capacityUnsaved = true
+}
+
+//>> 把所有容器的脏数据写到store, 失败的会保留到下次
+func (this *ItemComponent) FlushDirty(store ItemStore) error {
+	var upserts []ItemRecord
+	var deletes []ItemKey
+	var capacity []ContainerCapacity
+	drained := make(map[ContainerType][]uint64)
+
+	for _, typ := range this.containerTypes() {
+		container, ok := this.containers[typ].(dirtyContainer)
+		if !ok {
+			continue
+		}
+
+		if c, ok := container.drainCapacity(); ok {
+			capacity = append(capacity, c)
+		}
+
+		uids := container.drainDirty()
+		if len(uids) == 0 {
+			continue
+		}
+		drained[typ] = uids
+
+		for _, uid := range uids {
+			if item := container.GetItemByUID(uid); item != nil {
+				upserts = append(upserts, ItemRecord{Container: typ, Item: newItemState(item)})
+			} else {
+				deletes = append(deletes, ItemKey{Container: typ, UID: uid})
+			}
+		}
+	}
+
+	//>> 容量先写, 存储里不会出现放在还没扩充的格子上的道具
+	capStore, canSaveCapacity := store.(CapacityStore)
+	if len(capacity) > 0 && canSaveCapacity {
+		if err := capStore.WriteCapacity(this.playerID, capacity); err != nil {
+			this.remarkDirty(drained, capacity)
+			return err
+		}
+		capacity = nil
+	}
+
+	if len(upserts) > 0 || len(deletes) > 0 {
+		if err := store.WriteItems(this.playerID, upserts, deletes); err != nil {
+			this.remarkDirty(drained, capacity)
+			return err
+		}
+	}
+
+	if len(capacity) > 0 {
+		this.remarkDirty(nil, capacity)
+		return errCapacityNotSaved
+	}
+	return nil
+}
+
+//>> 没写进去的道具和容量重新标记, 下次再写
+func (this *ItemComponent) remarkDirty(drained map[ContainerType][]uint64, capacity []ContainerCapacity) {
+	for typ, uids := range drained {
+		this.containers[typ].(dirtyContainer).markDirty(uids)
+	}
+	for _, c := range capacity {
+		this.containers[c.Container].(dirtyContainer).markCapacityDirty()
+	}
+}
+
+//>> 从增量存储加载所有道具; 存储是CapacityStore时同时加载容器容量, 没保存过容量的容器保持当前值
+func (this *ItemComponent) LoadItems(store ItemStore) error {
+	records, err := store.LoadItems(this.playerID)
+	if err != nil {
+		return err
+	}
+	var capacity []ContainerCapacity
+	if capStore, ok := store.(CapacityStore); ok {
+		if capacity, err = capStore.LoadCapacity(this.playerID); err != nil {
+			return err
+		}
+	}
+
+	snapshot := &ItemSnapshot{Version: itemSnapshotVersion, PlayerID: this.playerID}
+	//>> 增量存储只有容器里的道具, 溢出邮箱和冷却保持不变
+	for _, mail := range this.overflow {
+		snapshot.Overflow = append(snapshot.Overflow, *mail)
+	}
+	snapshot.Cooldowns = this.GetCooldowns()
+	index := make(map[ContainerType]int)
+	for _, typ := range this.containerTypes() {
+		container := this.containers[typ]
+		index[typ] = len(snapshot.Containers)
+		snapshot.Containers = append(snapshot.Containers, ContainerSnapshot{
+			Type:        typ,
+			MaxSize:     container.GetMaxSize(),
+			MaxLoad:     container.GetMaxLoad(),
+			LockedSlots: container.GetLockedSlots(),
+		})
+	}
+
+	for _, c := range capacity {
+		i, ok := index[c.Container]
+		if !ok {
+			log.Printf("player:%d LoadItems drop capacity of unknown container %d", this.playerID, c.Container)
+			continue
+		}
+		cs := &snapshot.Containers[i]
+		cs.MaxSize, cs.MaxLoad, cs.LockedSlots = c.MaxSize, c.MaxLoad, c.LockedSlots
+	}
+
+	for _, record := range records {
+		i, ok := index[record.Container]
+		if !ok {
+			log.Printf("player:%d LoadItems drop item %d of unknown container %d", this.playerID, record.Item.UID, record.Container)
+			continue
+		}
+		snapshot.Containers[i].Items = append(snapshot.Containers[i].Items, record.Item)
+	}
+
+	return this.Restore(snapshot)
+}
+
+//>> 开启定时增量存盘, interval单位毫秒; 定时器回调只投递任务, 真正的写盘在Update里
+func (this *ItemComponent) StartFlusher(store ItemStore, interval int64) {
+	this.StopFlusher()
+
+	this.flushTimer = timer.SetTimer(interval, math.MaxUint32, func(interface{}) bool {
+		this.post(func() {
+			if err := this.FlushDirty(store); err != nil {
+				log.Printf("player:%d FlushDirty failed: %v", this.playerID, err)
+			}
+		})
+		return true
+	}, nil)
+}
+
+//>> 停止定时存盘, 不会自动把剩下的脏数据写掉, 下线时应该再调一次FlushDirty
+func (this *ItemComponent) StopFlusher() {
+	if this.flushTimer != timer.InvalidHTimer {
+		timer.KillTimer(this.flushTimer)
+		this.flushTimer = timer.InvalidHTimer
+	}
+}
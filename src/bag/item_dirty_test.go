@@ -0,0 +1,120 @@
+package bag_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bag"
+)
+
+func TestFlushDirty(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kv")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.kv")
+	store := openKV(t, path)
+
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 150, 1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	if err := component.FlushDirty(store); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+	if records, _ := store.LoadItems(1); len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+
+	//>> 只写变化过的道具, 删掉的道具从存储里删
+	component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 60, 1)
+	component.ReduceItemByUID(swords[0].GetUID(), 1, 1)
+	if err := component.FlushDirty(store); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+	store.Close()
+
+	store = openKV(t, path)
+	defer store.Close()
+	loaded := bag.NewItemComponent(1)
+	if err := loaded.LoadItems(store); err != nil {
+		t.Fatalf("LoadItems: %v", err)
+	}
+	if loaded.GetItemCount(tidOre) != 90 || loaded.GetItemCount(tidSword) != 0 {
+		t.Fatalf("after reload: ore %d sword %d", loaded.GetItemCount(tidOre), loaded.GetItemCount(tidSword))
+	}
+}
+
+//>> 只能存道具的存储
+type itemsOnlyStore struct {
+	bag.ItemStore
+}
+
+func TestFlushDirtyCapacity(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kv")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.kv")
+	store := openKV(t, path)
+
+	component := bag.NewItemComponent(1)
+	container := component.GetContainerByType(bag.KContainerTypeBag)
+	container.ExpandSize(10)
+	container.LockSlot(3)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 150, 1)
+	if err := component.FlushDirty(store); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+
+	loaded := bag.NewItemComponent(1)
+	if err := loaded.LoadItems(store); err != nil {
+		t.Fatalf("LoadItems: %v", err)
+	}
+	c := loaded.GetContainerByType(bag.KContainerTypeBag)
+	if c.GetMaxSize() != container.GetMaxSize() || !reflect.DeepEqual(c.GetLockedSlots(), []int16{3}) {
+		t.Fatalf("capacity after load: max %d locked %v", c.GetMaxSize(), c.GetLockedSlots())
+	}
+	if got := loaded.GetItemCount(tidOre); got != 150 {
+		t.Fatalf("ore = %d, want 150", got)
+	}
+
+	//>> 存储存不了容量时道具照常写, 但要报错
+	container.UnlockSlot(3)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+	if err := component.FlushDirty(itemsOnlyStore{store}); err == nil {
+		t.Fatal("FlushDirty should report the capacity it could not save")
+	}
+	if records, _ := store.LoadItems(1); len(records) != 2 || records[1].Item.Count != 61 {
+		t.Fatalf("items not written: %+v", records)
+	}
+	if err := component.FlushDirty(store); err != nil {
+		t.Fatalf("FlushDirty retry: %v", err)
+	}
+
+	//>> 重新打开时从日志里恢复容量
+	store.Close()
+	store = openKV(t, path)
+	defer store.Close()
+	if capacity, _ := store.LoadCapacity(1); len(capacity) != 1 || capacity[0].MaxSize != container.GetMaxSize() || len(capacity[0].LockedSlots) != 0 {
+		t.Fatalf("capacity after reopen: %+v", capacity)
+	}
+}
+
+func TestDebuffNotSaved(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kv")
+	defer os.RemoveAll(dir)
+	store := openKV(t, filepath.Join(dir, "items.kv"))
+	defer store.Close()
+
+	component := bag.NewItemComponent(1)
+	component.BuildDelta()
+	container := component.GetContainerByType(bag.KContainerTypeBag)
+	container.SetCapacityDebuff(5, 0)
+
+	//>> 减益只同步给客户端, 不用存容量
+	if err := component.FlushDirty(itemsOnlyStore{store}); err != nil {
+		t.Fatalf("debuff marked the capacity unsaved: %v", err)
+	}
+	if delta := component.BuildDelta(); delta == nil || len(delta.Containers) != 1 || delta.Containers[0].UsableSize != container.GetUsableSize() {
+		t.Fatalf("debuff not synced: %+v", delta)
+	}
+}
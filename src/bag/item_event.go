@@ -0,0 +1,93 @@
+package bag
+
+import (
+	"eventdispatcher"
+)
+
+/**
+* @Description: 道具事件
+	设置了EventDispatcher后, 道具数量的每次变化都会抛出事件, 任务、成就等系统监听这些事件:
+		EventEnumItemAdded 获得新道具(0->n), EventEnumItemRemoved 道具被删除(n->0),
+		EventEnumItemCountChanged 已有道具数量变化, EventEnumItemEquipped 道具放进装备栏.
+	跨容器转移也会在两边各抛一次删除和获得, Reason为KItemChangeReasonTransfer, 只关心真正获得的系统需要自己过滤.
+	事务中的事件在提交后才抛出, 被回滚的不会抛. 每种事件可以选择立即派发还是下一帧派发, 默认下一帧;
+	立即派发时回调在修改过程中被调用, 回调里不要再修改背包
+**/
+
+//>> 事件参数
+type ItemEvent struct {
+	PlayerID  uint64
+	Container ContainerType
+	UID       uint64
+	TID       int32
+	Before    int64
+	After     int64
+	Delta     int64
+	Reason    ItemChangeReason
+}
+
+//>> 事件派发方式
+type ItemEventDelivery int8
+
+const (
+	KItemEventNextFrame ItemEventDelivery = iota // DispatchEvent, 下一帧派发
+	KItemEventImmediate                          // DispatchEventNoDelay, 立即派发
+)
+
+//>> 设置事件派发器, nil表示不抛事件
+func (this *ItemComponent) SetEventDispatcher(dispatcher *eventdispatcher.EventDispatcher) {
+	this.dispatcher = dispatcher
+}
+
+//>> 设置某种事件的派发方式
+func (this *ItemComponent) SetEventDelivery(typ eventdispatcher.EventType, delivery ItemEventDelivery) {
+	if this.eventDelivery == nil {
+		this.eventDelivery = make(map[eventdispatcher.EventType]ItemEventDelivery)
+	}
+	this.eventDelivery[typ] = delivery
+}
+
+//>> 按数量变化抛出获得/删除/数量变化事件
+func (this *ContainerBase) publishChange(item ItemInterface, before, after int64, reason ItemChangeReason) {
+	switch {
+	case before == after:
+		return
+	case before == 0:
+		this.publish(eventdispatcher.EventEnumItemAdded, item, before, after, reason)
+	case after == 0:
+		this.publish(eventdispatcher.EventEnumItemRemoved, item, before, after, reason)
+	default:
+		this.publish(eventdispatcher.EventEnumItemCountChanged, item, before, after, reason)
+	}
+}
+
+func (this *ContainerBase) publish(typ eventdispatcher.EventType, item ItemInterface, before, after int64, reason ItemChangeReason) {
+	if this.owner == nil || this.owner.dispatcher == nil {
+		return
+	}
+
+	evt := &ItemEvent{
+		PlayerID:  this.owner.playerID,
+		Container: this.GetType(),
+		UID:       item.GetUID(),
+		TID:       item.GetTID(),
+		Before:    before,
+		After:     after,
+		Delta:     after - before,
+		Reason:    reason,
+	}
+
+	dispatcher := this.owner.dispatcher
+	dispatch := dispatcher.DispatchEvent
+	if this.owner.eventDelivery[typ] == KItemEventImmediate {
+		dispatch = dispatcher.DispatchEventNoDelay
+	}
+
+	if this.tx != nil {
+		this.tx.deferCommit(func() {
+			dispatch(typ, evt)
+		})
+		return
+	}
+	dispatch(typ, evt)
+}
@@ -0,0 +1,143 @@
+package bag
+
+import (
+	"time"
+	"timer"
+)
+
+/**
+* @Description: 道具过期
+	有过期时间的道具加入容器时在timer里注册一个定时器, 到期后走正常的delItem流程删除,
+	原因为KItemChangeReasonExpire, 客户端会收到KItemUpdateTypeDel.
+	timer的回调在timer自己的线程里, 所以回调里只投递任务, 真正的删除在ItemComponent.Update里做.
+	到期时道具被冻结或交易锁定删不掉的, 等解冻、解锁时再检查, 同时每隔expireRetryDelay重试一次
+**/
+
+//>> 过期道具删除失败后的重试间隔, 毫秒
+const expireRetryDelay = 5000
+
+//>> 注册道具的过期定时器, 已经注册过的会先取消
+func (this *ItemComponent) watchExpire(item ItemInterface) {
+	uid := item.GetUID()
+	this.unwatchExpire(uid)
+
+	expire := item.GetExpireTime()
+	if expire <= 0 {
+		return
+	}
+
+	this.setExpireTimer(uid, (expire-time.Now().Unix())*1000)
+}
+
+//>> interval毫秒后检查道具是否过期
+func (this *ItemComponent) setExpireTimer(uid uint64, interval int64) {
+	if this.expireTimers == nil {
+		this.expireTimers = make(map[uint64]timer.HTimer)
+	}
+
+	handle := timer.SetTimer(interval, 1, func(interface{}) bool {
+		this.post(func() {
+			delete(this.expireTimers, uid)
+			this.expireItem(uid)
+		})
+		return false
+	}, nil)
+
+	if handle != timer.InvalidHTimer {
+		this.expireTimers[uid] = handle
+	}
+}
+
+//>> 取消道具的过期定时器
+func (this *ItemComponent) unwatchExpire(uid uint64) {
+	if handle, ok := this.expireTimers[uid]; ok {
+		timer.KillTimer(handle)
+		delete(this.expireTimers, uid)
+	}
+}
+
+//>> 给所有容器里的道具重新注册过期定时器, 比如从存档加载完之后
+func (this *ItemComponent) watchAllExpire() {
+	for _, container := range this.containers {
+		if c, ok := container.(interface{ getAllItems() []ItemInterface }); ok {
+			for _, item := range c.getAllItems() {
+				this.watchExpire(item)
+			}
+		}
+	}
+}
+
+//>> 删除过期道具, 过期时间被改到以后的重新注册
+func (this *ItemComponent) expireItem(uid uint64) {
+	delete(this.expireBlocked, uid)
+	for _, container := range this.containers {
+		item := container.GetItemByUID(uid)
+		if item == nil {
+			continue
+		}
+
+		expire := item.GetExpireTime()
+		if expire <= 0 {
+			return
+		}
+		if expire > time.Now().Unix() {
+			this.watchExpire(item)
+			return
+		}
+
+		if err := container.ReduceItemByUID(uid, item.GetCount(), KItemChangeReasonExpire); err != nil {
+			if this.expireBlocked == nil {
+				this.expireBlocked = make(map[uint64]bool)
+			}
+			this.expireBlocked[uid] = true
+			this.unwatchExpire(uid)
+			this.setExpireTimer(uid, expireRetryDelay)
+		}
+		return
+	}
+}
+
+//>> 有道具解冻或解锁, 下一次Update重新检查删除失败的过期道具
+func (this *ItemComponent) recheckExpire() {
+	if len(this.expireBlocked) == 0 {
+		return
+	}
+	this.post(func() {
+		uids := make([]uint64, 0, len(this.expireBlocked))
+		for uid := range this.expireBlocked {
+			uids = append(uids, uid)
+		}
+		for _, uid := range uids {
+			this.expireItem(uid)
+		}
+	})
+}
+
+//>> 修改道具的过期时间, 0表示永不过期
+func (this *ItemComponent) SetItemExpireTime(uid uint64, expireTime int64) ItemError {
+	for _, container := range this.containers {
+		if container.GetItemByUID(uid) != nil {
+			return container.SetItemExpireTime(uid, expireTime)
+		}
+	}
+	return NewItemError(ErrItemNotExist)
+}
+
+//>> 投递一个任务到下一次Update执行, 可以在其他线程调用
+func (this *ItemComponent) post(task func()) {
+	this.taskLock.Lock()
+	this.tasks = append(this.tasks, task)
+	this.taskLock.Unlock()
+}
+
+//>> 执行投递过来的任务
+func (this *ItemComponent) runTasks() {
+	this.taskLock.Lock()
+	tasks := this.tasks
+	this.tasks = nil
+	this.taskLock.Unlock()
+
+	for _, task := range tasks {
+		task()
+	}
+}
@@ -0,0 +1,50 @@
+package bag_test
+
+import (
+	"testing"
+	"time"
+
+	"bag"
+)
+
+func TestExpire(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	uid := swords[0].GetUID()
+
+	component.SetItemExpireTime(uid, time.Now().Unix()+3600)
+	component.Update()
+	if component.GetItemByUID(uid) == nil {
+		t.Fatal("sword expired early")
+	}
+
+	component.SetItemExpireTime(uid, time.Now().Unix()-1)
+	component.Update()
+	if component.GetItemByUID(uid) != nil {
+		t.Fatal("expired sword not removed")
+	}
+}
+
+func TestExpireFrozenItem(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	ores, _ := component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+	uid := ores[0].GetUID()
+
+	var pending *bag.ReduceReservation
+	component.SetAsyncReduceHandler(func(res *bag.ReduceReservation) { pending = res }, 0)
+	component.AsyncReduceItem(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 8}}, 1, func(bag.ItemError) {})
+
+	component.SetItemExpireTime(uid, time.Now().Unix()-1)
+	component.Update()
+	if component.GetItemCount(tidOre) != 10 {
+		t.Fatal("frozen ore removed by expiry")
+	}
+
+	//>> ConfirmReduce在Update里解冻, 过期检查再投递到下一次Update
+	component.ConfirmReduce(pending.ID, bag.NewItemError(bag.ErrReduceTimeout))
+	component.Update()
+	component.Update()
+	if got := component.GetItemCount(tidOre); got != 0 {
+		t.Fatalf("ore = %d after unfreeze, want 0", got)
+	}
+}
@@ -0,0 +1,130 @@
+package bag
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+* @Description: 道具变化审计日志
+	每一次数量变化(加、扣、过期、转移)都会生成一条记录交给ItemLogSink, 用于经济排查和GM回档.
+	事务中的修改在提交时才写日志, 被回滚的修改不会出现在日志里
+**/
+
+//>> 一条道具变化记录
+type ItemLogRecord struct {
+	PlayerID  uint64           `json:"player_id"`
+	Container ContainerType    `json:"container"`
+	UID       uint64           `json:"uid"`
+	TID       int32            `json:"tid"`
+	Before    int64            `json:"before"`
+	After     int64            `json:"after"`
+	Delta     int64            `json:"delta"`
+	Reason    ItemChangeReason `json:"reason"`
+	Time      int64            `json:"time"` //>> unix毫秒
+}
+
+//>> 日志输出
+type ItemLogSink interface {
+	Write(record *ItemLogRecord)
+}
+
+//>> 追加写文件, 一行一条json
+type FileLogSink struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewFileLogSink(path string) (*FileLogSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLogSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (this *FileLogSink) Write(record *ItemLogRecord) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return
+	}
+	if err := this.encoder.Encode(record); err != nil {
+		log.Printf("FileLogSink write %+v failed: %v", record, err)
+	}
+}
+
+func (this *FileLogSink) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+//>> 内存日志, 测试用
+type MemoryLogSink struct {
+	lock    sync.Mutex
+	records []ItemLogRecord
+}
+
+func (this *MemoryLogSink) Write(record *ItemLogRecord) {
+	this.lock.Lock()
+	this.records = append(this.records, *record)
+	this.lock.Unlock()
+}
+
+//>> 已写入的记录
+func (this *MemoryLogSink) Records() []ItemLogRecord {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]ItemLogRecord(nil), this.records...)
+}
+
+func (this *MemoryLogSink) Reset() {
+	this.lock.Lock()
+	this.records = nil
+	this.lock.Unlock()
+}
+
+//>> 设置审计日志输出, nil表示不记录
+func (this *ItemComponent) SetLogSink(sink ItemLogSink) {
+	this.logSink = sink
+}
+
+//>> 记录道具数量变化
+func (this *ContainerBase) logChange(item ItemInterface, before, after int64, reason ItemChangeReason) {
+	if this.owner == nil || this.owner.logSink == nil || before == after {
+		return
+	}
+
+	record := &ItemLogRecord{
+		PlayerID:  this.owner.playerID,
+		Container: this.GetType(),
+		UID:       item.GetUID(),
+		TID:       item.GetTID(),
+		Before:    before,
+		After:     after,
+		Delta:     after - before,
+		Reason:    reason,
+		Time:      time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	sink := this.owner.logSink
+	if this.tx != nil {
+		this.tx.deferCommit(func() {
+			sink.Write(record)
+		})
+		return
+	}
+	sink.Write(record)
+}
@@ -0,0 +1,88 @@
+package bag_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bag"
+)
+
+func TestItemLog(t *testing.T) {
+	component := bag.NewItemComponent(7)
+	sink := &bag.MemoryLogSink{}
+	component.SetLogSink(sink)
+
+	ores, _ := component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+	component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 3, 2)
+	records := sink.Records()
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	add, reduce := records[0], records[1]
+	if add.PlayerID != 7 || add.UID != ores[0].GetUID() || add.Before != 0 || add.After != 10 || add.Delta != 10 || add.Reason != 1 {
+		t.Fatalf("add record = %+v", add)
+	}
+	if reduce.Before != 10 || reduce.After != 7 || reduce.Delta != -3 || reduce.Reason != 2 {
+		t.Fatalf("reduce record = %+v", reduce)
+	}
+
+	//>> 回滚的修改不写日志
+	sink.Reset()
+	component.Atomic(func() bag.ItemError {
+		component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 7, 3)
+		return bag.NewItemError(bag.ErrItemNotExist)
+	})
+	if records := sink.Records(); len(records) != 0 {
+		t.Fatalf("rolled back change was logged: %+v", records)
+	}
+
+	//>> 事务提交时才写
+	component.Atomic(func() bag.ItemError {
+		component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 7, 3)
+		if len(sink.Records()) != 0 {
+			t.Error("record written before commit")
+		}
+		return nil
+	})
+	if records := sink.Records(); len(records) != 1 || records[0].After != 0 {
+		t.Fatalf("committed records = %+v", records)
+	}
+}
+
+func TestFileLogSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "item.log")
+	sink, err := bag.NewFileLogSink(path)
+	if err != nil {
+		t.Fatalf("NewFileLogSink: %v", err)
+	}
+	component := bag.NewItemComponent(1)
+	component.SetLogSink(sink)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 5, 1)
+	component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	//>> 关闭后写入直接丢弃
+	component.AddItem(bag.KContainerTypeBag, tidPotion, 1, 1)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	defer file.Close()
+	var tids []int32
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record bag.ItemLogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("bad log line %q: %v", scanner.Text(), err)
+		}
+		tids = append(tids, record.TID)
+	}
+	if len(tids) != 2 || tids[0] != tidOre || tids[1] != tidSword {
+		t.Fatalf("logged tids = %v, want [ore sword]", tids)
+	}
+}
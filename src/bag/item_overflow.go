@@ -0,0 +1,235 @@
+package bag
+
+import (
+	"time"
+	"timer"
+)
+
+/**
+* @Description: 溢出邮箱
+	背包满了加不下的奖励按溢出策略处理: 默认直接失败; KOverflowMail时能放下的照常加, 放不下的部分打包成一封溢出邮件,
+	玩家腾出空间后用ClaimOverflow领取. 邮件有过期时间, 到期没领就删掉; 邮件跟着Snapshot一起存档
+**/
+
+//>> 溢出策略
+type OverflowPolicy int8
+
+const (
+	KOverflowReject OverflowPolicy = iota // 放不下整批失败
+	KOverflowMail                         // 放不下的进溢出邮箱
+)
+
+//>> 溢出邮件默认保留7天
+const overflowDefaultTTL = 7 * 24 * 3600
+
+//>> 一封溢出邮件
+type OverflowMail struct {
+	ID         uint64           `json:"id"`
+	Container  ContainerType    `json:"container"` //>> 原本要放的容器
+	Items      []ItemTidDesc    `json:"items"`
+	Reason     ItemChangeReason `json:"reason"`
+	CreateTime int64            `json:"create_time"`
+	ExpireTime int64            `json:"expire_time"`
+}
+
+//>> 加道具的结果
+type AddResult struct {
+	Added    []ItemInterface
+	Overflow *OverflowMail //>> 放不下进了邮箱的部分, 没有为nil
+}
+
+//>> 设置溢出策略, ttl为邮件保留秒数, <=0表示用默认的7天
+func (this *ItemComponent) SetOverflowPolicy(policy OverflowPolicy, ttl int64) {
+	this.overflowPolicy = policy
+	this.overflowTTL = ttl
+}
+
+//>> 批量加道具, 按溢出策略处理放不下的道具, 返回实际加进容器的和进了邮箱的
+func (this *ItemComponent) AddItemsWithResult(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) (*AddResult, ItemError) {
+	err := this.TryAddItems(typ, items)
+	if err == nil || this.overflowPolicy != KOverflowMail || !isOverflowError(err) {
+		if err != nil {
+			return nil, err
+		}
+		added, err := this.addItems(typ, items, reason)
+		if err != nil {
+			return nil, err
+		}
+		return &AddResult{Added: added}, nil
+	}
+
+	result := &AddResult{}
+	err = this.Atomic(func() ItemError {
+		var rest []ItemTidDesc
+		for _, item := range items {
+			n := this.maxAddable(typ, item)
+			if n > 0 {
+				added, err := this.addItems(typ, []ItemTidDesc{{TID: item.TID, Count: n}}, reason)
+				if err != nil {
+					return err
+				}
+				result.Added = append(result.Added, added...)
+			}
+			if n < item.Count {
+				rest = append(rest, ItemTidDesc{TID: item.TID, Count: item.Count - n})
+			}
+		}
+
+		if len(rest) > 0 {
+			result.Overflow = this.sendOverflow(typ, rest, reason)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//>> 能放下多少个, 二分查找
+func (this *ItemComponent) maxAddable(typ ContainerType, item ItemTidDesc) int64 {
+	lo, hi := int64(0), item.Count
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if this.TryAddItems(typ, []ItemTidDesc{{TID: item.TID, Count: mid}}) == nil {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+//>> 只有空间、负重、持有上限不够才进邮箱, 其他错误(比如数量非法)照常返回
+func isOverflowError(err ItemError) bool {
+	switch err.Code {
+	case ErrContainerFull, ErrOverLoad, ErrExceedLimit:
+		return true
+	}
+	return false
+}
+
+//>> 生成溢出邮件, 事务中回滚时撤销
+func (this *ItemComponent) sendOverflow(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason) *OverflowMail {
+	ttl := this.overflowTTL
+	if ttl <= 0 {
+		ttl = overflowDefaultTTL
+	}
+
+	now := time.Now().Unix()
+	mail := &OverflowMail{
+		ID:         nextUID(),
+		Container:  typ,
+		Items:      items,
+		Reason:     reason,
+		CreateTime: now,
+		ExpireTime: now + ttl,
+	}
+	this.overflow = append(this.overflow, mail)
+
+	if this.tx != nil {
+		this.tx.record(func() {
+			this.removeOverflow(mail.ID)
+		})
+		this.tx.deferCommit(func() {
+			this.watchOverflow(mail)
+		})
+	} else {
+		this.watchOverflow(mail)
+	}
+	return mail
+}
+
+//>> 溢出邮箱里的邮件
+func (this *ItemComponent) GetOverflow() []*OverflowMail {
+	return append([]*OverflowMail(nil), this.overflow...)
+}
+
+//>> 领取溢出邮件, 必须整封都放得下
+func (this *ItemComponent) ClaimOverflow(id uint64) ItemError {
+	var mail *OverflowMail
+	for _, m := range this.overflow {
+		if m.ID == id {
+			mail = m
+			break
+		}
+	}
+	if mail == nil {
+		return NewItemError(ErrItemNotExist)
+	}
+
+	err := this.Atomic(func() ItemError {
+		if _, err := this.addItems(mail.Container, mail.Items, mail.Reason); err != nil {
+			return err
+		}
+
+		this.removeOverflow(id)
+		this.tx.record(func() {
+			this.overflow = append(this.overflow, mail)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	this.unwatchOverflow(id)
+	return nil
+}
+
+func (this *ItemComponent) removeOverflow(id uint64) {
+	for i, mail := range this.overflow {
+		if mail.ID == id {
+			this.overflow = append(this.overflow[:i], this.overflow[i+1:]...)
+			return
+		}
+	}
+}
+
+//>> 注册邮件过期定时器
+func (this *ItemComponent) watchOverflow(mail *OverflowMail) {
+	this.unwatchOverflow(mail.ID)
+	if this.overflowTimers == nil {
+		this.overflowTimers = make(map[uint64]timer.HTimer)
+	}
+
+	id := mail.ID
+	interval := (mail.ExpireTime - time.Now().Unix()) * 1000
+	handle := timer.SetTimer(interval, 1, func(interface{}) bool {
+		this.post(func() {
+			delete(this.overflowTimers, id)
+			this.removeOverflow(id)
+		})
+		return false
+	}, nil)
+
+	if handle != timer.InvalidHTimer {
+		this.overflowTimers[id] = handle
+	}
+}
+
+func (this *ItemComponent) unwatchOverflow(id uint64) {
+	if handle, ok := this.overflowTimers[id]; ok {
+		timer.KillTimer(handle)
+		delete(this.overflowTimers, id)
+	}
+}
+
+//>> 从存档恢复溢出邮箱, 已经过期的直接丢掉
+func (this *ItemComponent) restoreOverflow(mails []OverflowMail) {
+	for id := range this.overflowTimers {
+		this.unwatchOverflow(id)
+	}
+
+	now := time.Now().Unix()
+	this.overflow = nil
+	for i := range mails {
+		if mails[i].ExpireTime <= now {
+			continue
+		}
+		mail := mails[i]
+		mail.Items = append([]ItemTidDesc(nil), mail.Items...)
+		this.overflow = append(this.overflow, &mail)
+		this.watchOverflow(&mail)
+	}
+}
@@ -0,0 +1,508 @@
+package bag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"timer"
+)
+
+/**
+* @Description: 背包存档
+	ItemComponent可以整体编码成二进制(Marshal)或json(json.Marshal), 两种格式都带版本号.
+	结构变化时提升itemSnapshotVersion, 并用RegisterSnapshotMigration注册旧版本到新版本的升级函数,
+	加载旧存档时会依次升级到当前版本
+**/
+
+//>> 当前存档版本
+//>> 2: 道具增加实例属性
+//>> 3: 增加溢出邮箱
+//>> 4: 增加道具冷却
+//>> 5: 容器增加锁定的格子
+const itemSnapshotVersion = 5
+
+//>> 二进制存档的文件头
+var snapshotMagic = []byte("BAG")
+
+var errBadSnapshot = errors.New("bag: bad snapshot data")
+
+//>> 单个容器的存档
+type ContainerSnapshot struct {
+	Type        ContainerType `json:"type"`
+	MaxSize     int32         `json:"max_size"`
+	MaxLoad     int32         `json:"max_load"`
+	Items       []ItemState   `json:"items"`
+	LockedSlots []int16       `json:"locked_slots,omitempty"`
+}
+
+//>> 整个背包的存档
+type ItemSnapshot struct {
+	Version    int                 `json:"version"`
+	PlayerID   uint64              `json:"player_id"`
+	Containers []ContainerSnapshot `json:"containers"`
+	Overflow   []OverflowMail      `json:"overflow,omitempty"`
+	Cooldowns  []CooldownState     `json:"cooldowns,omitempty"`
+}
+
+//>> 存档升级函数, 把from版本的存档升级到from+1
+type SnapshotMigration func(snapshot *ItemSnapshot) error
+
+var snapshotMigrations = map[int]SnapshotMigration{
+	//>> 1版本的道具都没有实例属性, 不需要转换
+	1: func(*ItemSnapshot) error { return nil },
+	//>> 2版本没有溢出邮箱
+	2: func(*ItemSnapshot) error { return nil },
+	//>> 3版本没有冷却, 当作都不在冷却中
+	3: func(*ItemSnapshot) error { return nil },
+	//>> 4版本没有锁定的格子
+	4: func(*ItemSnapshot) error { return nil },
+}
+
+//>> 注册from版本升级到from+1的函数
+func RegisterSnapshotMigration(from int, migration SnapshotMigration) {
+	snapshotMigrations[from] = migration
+}
+
+func migrateSnapshot(snapshot *ItemSnapshot) error {
+	if snapshot.Version > itemSnapshotVersion || snapshot.Version <= 0 {
+		return fmt.Errorf("bag: unsupported snapshot version %d", snapshot.Version)
+	}
+
+	for snapshot.Version < itemSnapshotVersion {
+		migration, ok := snapshotMigrations[snapshot.Version]
+		if !ok {
+			return fmt.Errorf("bag: no migration from snapshot version %d", snapshot.Version)
+		}
+		if err := migration(snapshot); err != nil {
+			return err
+		}
+		snapshot.Version++
+	}
+	return nil
+}
+
+//>> 可以存档的容器
+type persistContainer interface {
+	ContainerInterface
+	getAllItems() []ItemInterface
+	prepareRestore(snapshot *ContainerSnapshot) (*containerRestore, error)
+	applyRestore(state *containerRestore)
+}
+
+//>> 当前背包的存档
+func (this *ItemComponent) Snapshot() *ItemSnapshot {
+	snapshot := &ItemSnapshot{Version: itemSnapshotVersion, PlayerID: this.playerID}
+	for _, typ := range this.containerTypes() {
+		container, ok := this.containers[typ].(persistContainer)
+		if !ok {
+			continue
+		}
+
+		cs := ContainerSnapshot{
+			Type:        typ,
+			MaxSize:     container.GetMaxSize(),
+			MaxLoad:     container.GetMaxLoad(),
+			LockedSlots: container.GetLockedSlots(),
+		}
+		for _, item := range container.getAllItems() {
+			cs.Items = append(cs.Items, newItemState(item))
+		}
+		sortItemStates(cs.Items)
+		snapshot.Containers = append(snapshot.Containers, cs)
+	}
+
+	for _, mail := range this.overflow {
+		m := *mail
+		m.Items = append([]ItemTidDesc(nil), mail.Items...)
+		snapshot.Overflow = append(snapshot.Overflow, m)
+	}
+	snapshot.Cooldowns = this.GetCooldowns()
+	return snapshot
+}
+
+//>> 从存档恢复, 存档里没有的容器会被清空.
+//>> 先把所有容器的新状态算出来并校验, 全部通过才一起替换, 失败时背包保持原样
+func (this *ItemComponent) Restore(snapshot *ItemSnapshot) error {
+	if err := migrateSnapshot(snapshot); err != nil {
+		return err
+	}
+	if this.tx != nil {
+		return errors.New("bag: restore during transaction")
+	}
+	if snapshot.PlayerID != this.playerID {
+		return fmt.Errorf("bag: snapshot of player %d restored to player %d", snapshot.PlayerID, this.playerID)
+	}
+
+	found := make(map[ContainerType]*ContainerSnapshot)
+	for i := range snapshot.Containers {
+		cs := &snapshot.Containers[i]
+		if _, ok := this.containers[cs.Type].(persistContainer); !ok {
+			return fmt.Errorf("bag: snapshot has unknown container type %d", cs.Type)
+		}
+		found[cs.Type] = cs
+	}
+
+	prepared := make(map[ContainerType]*containerRestore)
+	owners := make(map[uint64]ContainerType)
+	for _, typ := range this.containerTypes() {
+		container, ok := this.containers[typ].(persistContainer)
+		if !ok {
+			continue
+		}
+
+		cs := found[typ]
+		if cs == nil {
+			cs = &ContainerSnapshot{Type: typ, MaxSize: container.GetMaxSize(), MaxLoad: container.GetMaxLoad(), LockedSlots: container.GetLockedSlots()}
+		}
+		state, err := container.prepareRestore(cs)
+		if err != nil {
+			return err
+		}
+		for uid := range state.items {
+			if other, ok := owners[uid]; ok {
+				return fmt.Errorf("bag: item uid %d in both container %d and %d", uid, other, typ)
+			}
+			owners[uid] = typ
+		}
+		prepared[typ] = state
+	}
+
+	//>> 重启后生成器从存档里最大的uid之后继续, 不会发出重复的uid
+	maxUID := uint64(0)
+	for uid := range owners {
+		if uid > maxUID {
+			maxUID = uid
+		}
+	}
+	for _, mail := range snapshot.Overflow {
+		if mail.ID > maxUID {
+			maxUID = mail.ID
+		}
+	}
+	SeedUID(maxUID)
+
+	for uid := range this.expireTimers {
+		this.unwatchExpire(uid)
+	}
+	this.expireBlocked = nil
+	for typ, state := range prepared {
+		this.containers[typ].(persistContainer).applyRestore(state)
+	}
+
+	this.watchAllExpire()
+	this.restoreOverflow(snapshot.Overflow)
+	this.restoreCooldowns(snapshot.Cooldowns)
+	return nil
+}
+
+//>> 编码成带版本号的二进制存档
+func (this *ItemComponent) Marshal() []byte {
+	return this.Snapshot().Marshal()
+}
+
+//>> 从二进制存档恢复
+func (this *ItemComponent) Unmarshal(data []byte) error {
+	snapshot, err := UnmarshalItemSnapshot(data)
+	if err != nil {
+		return err
+	}
+	return this.Restore(snapshot)
+}
+
+func (this *ItemComponent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.Snapshot())
+}
+
+func (this *ItemComponent) UnmarshalJSON(data []byte) error {
+	snapshot := &ItemSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return err
+	}
+	return this.Restore(snapshot)
+}
+
+func (this *ItemSnapshot) Marshal() []byte {
+	w := &byteWriter{}
+	w.buf = append(w.buf, snapshotMagic...)
+	w.uvarint(uint64(this.Version))
+	w.uvarint(this.PlayerID)
+	w.uvarint(uint64(len(this.Containers)))
+	for i := range this.Containers {
+		cs := &this.Containers[i]
+		w.varint(int64(cs.Type))
+		w.varint(int64(cs.MaxSize))
+		w.varint(int64(cs.MaxLoad))
+		w.uvarint(uint64(len(cs.Items)))
+		for j := range cs.Items {
+			cs.Items[j].encode(w)
+		}
+		w.uvarint(uint64(len(cs.LockedSlots)))
+		for _, pos := range cs.LockedSlots {
+			w.varint(int64(pos))
+		}
+	}
+
+	w.uvarint(uint64(len(this.Overflow)))
+	for i := range this.Overflow {
+		mail := &this.Overflow[i]
+		w.uvarint(mail.ID)
+		w.varint(int64(mail.Container))
+		w.varint(int64(mail.Reason))
+		w.varint(mail.CreateTime)
+		w.varint(mail.ExpireTime)
+		w.uvarint(uint64(len(mail.Items)))
+		for _, item := range mail.Items {
+			w.varint(int64(item.TID))
+			w.varint(item.Count)
+		}
+	}
+
+	w.uvarint(uint64(len(this.Cooldowns)))
+	for _, cd := range this.Cooldowns {
+		w.varint(int64(cd.Group))
+		w.varint(cd.EndTime)
+	}
+	return w.buf
+}
+
+//>> 解码二进制存档, 旧版本的存档需要在Restore时升级
+func UnmarshalItemSnapshot(data []byte) (*ItemSnapshot, error) {
+	if len(data) < len(snapshotMagic) || string(data[:len(snapshotMagic)]) != string(snapshotMagic) {
+		return nil, errBadSnapshot
+	}
+
+	r := &byteReader{buf: data[len(snapshotMagic):]}
+	snapshot := &ItemSnapshot{Version: int(r.uvarint()), PlayerID: r.uvarint()}
+	n := r.length()
+	for i := 0; i < n && r.err == nil; i++ {
+		cs := ContainerSnapshot{
+			Type:    ContainerType(r.varint()),
+			MaxSize: int32(r.varint()),
+			MaxLoad: int32(r.varint()),
+		}
+		m := r.length()
+		for j := 0; j < m && r.err == nil; j++ {
+			cs.Items = append(cs.Items, decodeItemState(r, snapshot.Version))
+		}
+		if snapshot.Version >= 5 {
+			m = r.length()
+			for j := 0; j < m && r.err == nil; j++ {
+				cs.LockedSlots = append(cs.LockedSlots, int16(r.varint()))
+			}
+		}
+		snapshot.Containers = append(snapshot.Containers, cs)
+	}
+
+	if snapshot.Version >= 3 {
+		n = r.length()
+		for i := 0; i < n && r.err == nil; i++ {
+			mail := OverflowMail{
+				ID:         r.uvarint(),
+				Container:  ContainerType(r.varint()),
+				Reason:     ItemChangeReason(r.varint()),
+				CreateTime: r.varint(),
+				ExpireTime: r.varint(),
+			}
+			m := r.length()
+			for j := 0; j < m && r.err == nil; j++ {
+				mail.Items = append(mail.Items, ItemTidDesc{TID: int32(r.varint()), Count: r.varint()})
+			}
+			snapshot.Overflow = append(snapshot.Overflow, mail)
+		}
+	}
+
+	if snapshot.Version >= 4 {
+		n = r.length()
+		for i := 0; i < n && r.err == nil; i++ {
+			snapshot.Cooldowns = append(snapshot.Cooldowns, CooldownState{Group: int32(r.varint()), EndTime: r.varint()})
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.buf) != 0 {
+		return nil, errBadSnapshot
+	}
+	return snapshot, nil
+}
+
+//>> 校验过的容器新状态, applyRestore时整体替换
+type containerRestore struct {
+	maxSize, maxLoad int32
+	items            map[uint64]ItemInterface
+	tid2UIDs         map[int32][]uint64
+	pos2UID          map[int16]uint64
+	lockedSlots      map[int16]bool
+	curSize          int32
+	curLoad          int64
+}
+
+//>> 根据存档算出容器的新状态并校验, 不修改容器
+func (this *ContainerBase) prepareRestore(snapshot *ContainerSnapshot) (*containerRestore, error) {
+	items := make(map[uint64]ItemInterface, len(snapshot.Items))
+	tid2UIDs := make(map[int32][]uint64)
+	pos2UID := make(map[int16]uint64, len(snapshot.Items))
+	curSize, curLoad := int32(0), int64(0)
+
+	states := append([]ItemState(nil), snapshot.Items...)
+	sortItemStates(states)
+	for _, state := range states {
+		if _, ok := items[state.UID]; ok {
+			return nil, fmt.Errorf("bag: container %d duplicate item uid %d", snapshot.Type, state.UID)
+		}
+		if _, ok := pos2UID[state.Pos]; ok {
+			return nil, fmt.Errorf("bag: container %d duplicate item pos %d", snapshot.Type, state.Pos)
+		}
+		if state.Pos < 0 || (snapshot.MaxSize > 0 && int32(state.Pos) >= snapshot.MaxSize) {
+			return nil, fmt.Errorf("bag: container %d item %d pos %d out of range", snapshot.Type, state.UID, state.Pos)
+		}
+		if GetItemTemplate(state.TID) == nil {
+			return nil, fmt.Errorf("bag: container %d item %d unknown tid %d", snapshot.Type, state.UID, state.TID)
+		}
+		if state.Count <= 0 {
+			return nil, fmt.Errorf("bag: container %d item %d invalid count %d", snapshot.Type, state.UID, state.Count)
+		}
+		if state.Count > 1 && !state.Attrs.IsEmpty() {
+			return nil, fmt.Errorf("bag: container %d item %d has attrs but count %d", snapshot.Type, state.UID, state.Count)
+		}
+
+		item := newItemFromState(state, this.GetType())
+		items[state.UID] = item
+		tid2UIDs[state.TID] = append(tid2UIDs[state.TID], state.UID)
+		pos2UID[state.Pos] = state.UID
+		curSize++
+		curLoad += int64(item.GetWeight()) * item.GetCount()
+	}
+
+	var lockedSlots map[int16]bool
+	for _, pos := range snapshot.LockedSlots {
+		if pos < 0 || (snapshot.MaxSize > 0 && int32(pos) >= snapshot.MaxSize) {
+			return nil, fmt.Errorf("bag: container %d invalid locked slot %d", snapshot.Type, pos)
+		}
+		if lockedSlots == nil {
+			lockedSlots = make(map[int16]bool)
+		}
+		lockedSlots[pos] = true
+	}
+
+	return &containerRestore{
+		maxSize:     snapshot.MaxSize,
+		maxLoad:     snapshot.MaxLoad,
+		items:       items,
+		tid2UIDs:    tid2UIDs,
+		pos2UID:     pos2UID,
+		lockedSlots: lockedSlots,
+		curSize:     curSize,
+		curLoad:     curLoad,
+	}, nil
+}
+
+//>> 替换成prepareRestore算好的状态, 不产生更新记录和日志.
+//>> 旧道具上的冻结、交易锁定都作废, 还没确认的异步扣除以ErrReservationNotExist结束
+func (this *ContainerBase) applyRestore(state *containerRestore) {
+	this.maxSize, this.maxLoad = state.maxSize, state.maxLoad
+	this.lockedSlots = state.lockedSlots
+	this.items, this.tid2UIDs, this.pos2UID = state.items, state.tid2UIDs, state.pos2UID
+	this.curSize, this.curLoad = state.curSize, state.curLoad
+	this.rebuildIndexes()
+	this.updateQueue = nil
+	this.dirty = nil
+	this.capacityUnsaved = false
+
+	reservations := this.reservations
+	this.frozen, this.locked, this.lockedTotal, this.reservations = nil, nil, nil, nil
+	for _, res := range reservations {
+		if res.timer != timer.InvalidHTimer {
+			timer.KillTimer(res.timer)
+			res.timer = timer.InvalidHTimer
+		}
+		res.cb(NewItemError(ErrReservationNotExist))
+	}
+}
+
+//>> 按存档数据创建道具
+func newItemFromState(state ItemState, typ ContainerType) ItemInterface {
+	return &ItemBase{
+		tid:          state.TID,
+		uid:          state.UID,
+		count:        state.Count,
+		createTime:   state.CreateTime,
+		pos:          state.Pos,
+		containerTyp: int16(typ),
+		flag:         state.Flag,
+		expireTime:   state.ExpireTime,
+		attrs:        state.Attrs.Clone(),
+	}
+}
+
+//>> 按格子排序, 保证存档内容稳定
+func sortItemStates(states []ItemState) {
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Pos != states[j].Pos {
+			return states[i].Pos < states[j].Pos
+		}
+		return states[i].UID < states[j].UID
+	})
+}
+
+//>> 存储接口, 按玩家存取整个背包的存档
+type Store interface {
+	//>> 保存存档
+	Save(playerID uint64, data []byte) error
+	//>> 读取存档, 没有存档返回nil, nil
+	Load(playerID uint64) ([]byte, error)
+}
+
+//>> 每个玩家一个文件
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (this *FileStore) path(playerID uint64) string {
+	return filepath.Join(this.dir, strconv.FormatUint(playerID, 10)+".bag")
+}
+
+//>> 先写临时文件再改名, 写一半宕机也不会破坏旧存档
+func (this *FileStore) Save(playerID uint64, data []byte) error {
+	path := this.path(playerID)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (this *FileStore) Load(playerID uint64) ([]byte, error) {
+	data, err := ioutil.ReadFile(this.path(playerID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+//>> 保存到store
+func (this *ItemComponent) Save(store Store) error {
+	return store.Save(this.playerID, this.Marshal())
+}
+
+//>> 从store加载, 没有存档时保持当前状态
+func (this *ItemComponent) Load(store Store) error {
+	data, err := store.Load(this.playerID)
+	if err != nil || data == nil {
+		return err
+	}
+	return this.Unmarshal(data)
+}
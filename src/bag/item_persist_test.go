@@ -0,0 +1,172 @@
+package bag_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"bag"
+)
+
+func TestRestoreRejectsBadSnapshot(t *testing.T) {
+	source := bag.NewItemComponent(1)
+	source.AddItem(bag.KContainerTypeBag, tidOre, 30, 1)
+	source.AddItem(bag.KContainerTypeWarehouse, tidSword, 1, 1)
+
+	for name, corrupt := range map[string]func(s *bag.ItemSnapshot){
+		"player": func(s *bag.ItemSnapshot) { s.PlayerID = 2 },
+		"tid": func(s *bag.ItemSnapshot) {
+			warehouse := findContainer(s, bag.KContainerTypeWarehouse)
+			warehouse.Items[0].TID = 9999
+		},
+		"pos": func(s *bag.ItemSnapshot) {
+			warehouse := findContainer(s, bag.KContainerTypeWarehouse)
+			warehouse.Items[0].Pos = int16(warehouse.MaxSize)
+		},
+		"uid": func(s *bag.ItemSnapshot) {
+			bagItems := findContainer(s, bag.KContainerTypeBag).Items
+			findContainer(s, bag.KContainerTypeWarehouse).Items[0].UID = bagItems[0].UID
+		},
+	} {
+		component := bag.NewItemComponent(1)
+		component.AddItem(bag.KContainerTypeBag, tidPotion, 5, 1)
+
+		snapshot := source.Snapshot()
+		corrupt(snapshot)
+		if err := component.Restore(snapshot); err == nil {
+			t.Errorf("%s: Restore should fail", name)
+			continue
+		}
+		if got := component.GetItemCount(tidPotion); got != 5 {
+			t.Errorf("%s: potion = %d after failed restore, want 5", name, got)
+		}
+		if got := component.GetItemCount(tidOre); got != 0 {
+			t.Errorf("%s: ore = %d after failed restore, want 0", name, got)
+		}
+	}
+}
+
+func TestRestoreClearsReservations(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+	snapshot := component.Snapshot()
+
+	component.SetAsyncReduceHandler(func(res *bag.ReduceReservation) {}, 0)
+	var result bag.ItemError
+	component.AsyncReduceItem(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 8}}, 1, func(err bag.ItemError) {
+		result = err
+	})
+
+	if err := component.Restore(snapshot); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if result == nil || result.Code != bag.ErrReservationNotExist {
+		t.Fatalf("pending reservation finished with %v", result)
+	}
+	frozen := component.GetContainerByType(bag.KContainerTypeBag).(interface{ GetFrozenCount(int32) int64 })
+	if got := frozen.GetFrozenCount(tidOre); got != 0 {
+		t.Fatalf("frozen = %d after restore, want 0", got)
+	}
+	if err := component.TryReduceItemByTID(bag.KContainerTypeBag, tidOre, 10); err != nil {
+		t.Fatalf("restored ore should be reducible: %v", err)
+	}
+}
+
+func findContainer(snapshot *bag.ItemSnapshot, typ bag.ContainerType) *bag.ContainerSnapshot {
+	for i := range snapshot.Containers {
+		if snapshot.Containers[i].Type == typ {
+			return &snapshot.Containers[i]
+		}
+	}
+	return nil
+}
+
+//>> 按1版本的格式手写一份二进制存档: 道具没有实例属性, 没有锁定格子、溢出邮箱和冷却
+func snapshotV1(playerID uint64, maxSize int32, uid uint64, tid int32, count int64) []byte {
+	buf := []byte("BAG")
+	buf = binary.AppendUvarint(buf, 1)
+	buf = binary.AppendUvarint(buf, playerID)
+	buf = binary.AppendUvarint(buf, 1)
+	buf = binary.AppendVarint(buf, int64(bag.KContainerTypeBag))
+	buf = binary.AppendVarint(buf, int64(maxSize))
+	buf = binary.AppendVarint(buf, 0)
+	buf = binary.AppendUvarint(buf, 1)
+	buf = binary.AppendUvarint(buf, uid)
+	for _, v := range []int64{int64(tid), count, 0, 0, 0, 0} { //>> tid count createTime pos flag expireTime
+		buf = binary.AppendVarint(buf, v)
+	}
+	return buf
+}
+
+func TestSnapshotMigrateV1(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	maxSize := component.GetContainerByType(bag.KContainerTypeBag).GetMaxSize()
+	if err := component.Unmarshal(snapshotV1(1, maxSize, 42, tidOre, 30)); err != nil {
+		t.Fatalf("load v1 snapshot: %v", err)
+	}
+	ore := component.GetItemByUID(42)
+	if ore == nil || ore.GetTID() != tidOre || ore.GetCount() != 30 || ore.GetPos() != 0 {
+		t.Fatalf("ore after migration = %+v", ore)
+	}
+
+	//>> 再存一次就是当前版本
+	snapshot, err := bag.UnmarshalItemSnapshot(component.Marshal())
+	if err != nil || snapshot.Version != 5 {
+		t.Fatalf("re-encoded snapshot version: %v", err)
+	}
+}
+
+func TestSnapshotMigrateRegistered(t *testing.T) {
+	var called []int
+	for from := 1; from < 5; from++ {
+		from := from
+		bag.RegisterSnapshotMigration(from, func(snapshot *bag.ItemSnapshot) error {
+			called = append(called, from)
+			return nil
+		})
+	}
+	defer func() {
+		for from := 1; from < 5; from++ {
+			bag.RegisterSnapshotMigration(from, func(*bag.ItemSnapshot) error { return nil })
+		}
+	}()
+
+	component := bag.NewItemComponent(1)
+	maxSize := component.GetContainerByType(bag.KContainerTypeBag).GetMaxSize()
+	if err := component.Unmarshal(snapshotV1(1, maxSize, 42, tidOre, 30)); err != nil {
+		t.Fatalf("load v1 snapshot: %v", err)
+	}
+	if len(called) != 4 || called[0] != 1 || called[3] != 4 {
+		t.Fatalf("migrations called %v, want [1 2 3 4]", called)
+	}
+
+	//>> 升级失败时背包不变
+	called = nil
+	bag.RegisterSnapshotMigration(4, func(*bag.ItemSnapshot) error { return errors.New("broken") })
+	if err := component.Unmarshal(snapshotV1(1, maxSize, 43, tidPotion, 5)); err == nil {
+		t.Fatal("failed migration should fail the load")
+	}
+	if component.GetItemByUID(42) == nil || component.GetItemByUID(43) != nil {
+		t.Fatal("bag changed after a failed migration")
+	}
+	if len(called) != 3 {
+		t.Fatalf("migrations called %v, want to stop at 4", called)
+	}
+}
+
+func TestSnapshotUnsupportedVersion(t *testing.T) {
+	source := bag.NewItemComponent(1)
+	source.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+
+	for _, version := range []int{0, 6} {
+		snapshot := source.Snapshot()
+		snapshot.Version = version
+		component := bag.NewItemComponent(1)
+		if err := component.Restore(snapshot); err == nil {
+			t.Errorf("version %d should be rejected", version)
+		}
+		if component.GetItemCount(tidOre) != 0 {
+			t.Errorf("version %d: bag changed after rejected restore", version)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package bag
+
+import "sort"
+
+/**
+* @Description: 道具同步
+	每帧把容器的updateQueue合并成增量消息发给客户端, 同一个uid一帧内的多次操作会合并:
+		add+update=add, add+del=无, update+del=del, del+add=update
+	登录、重连时发全量快照. 消息可以用Marshal编成二进制, 也可以直接json.Marshal
+**/
+
+//>> 道具的完整状态
+type ItemState struct {
+	UID        uint64     `json:"uid"`
+	TID        int32      `json:"tid"`
+	Count      int64      `json:"count"`
+	CreateTime int64      `json:"create_time"`
+	Pos        int16      `json:"pos"`
+	Flag       int        `json:"flag"`
+	ExpireTime int64      `json:"expire_time,omitempty"`
+	Attrs      *ItemAttrs `json:"attrs,omitempty"`
+}
+
+//>> 单个容器的变化
+type ContainerDelta struct {
+	Type        ContainerType `json:"type"`
+	Size        int32         `json:"size"`
+	MaxSize     int32         `json:"max_size"`
+	Load        int32         `json:"load"`
+	MaxLoad     int32         `json:"max_load"`
+	UsableSize  int32         `json:"usable_size"` //>> 去掉锁定格子和减益后的格子数
+	UsableLoad  int32         `json:"usable_load"`
+	LockedSlots []int16       `json:"locked_slots,omitempty"`
+	Added       []ItemState   `json:"added,omitempty"`
+	Updated     []ItemState   `json:"updated,omitempty"`
+	Deleted     []uint64      `json:"deleted,omitempty"`
+}
+
+//>> 同步给客户端的消息, Full为true表示全量快照, 客户端应该先清空本地数据
+type ItemDelta struct {
+	Full       bool             `json:"full"`
+	Containers []ContainerDelta `json:"containers"`
+}
+
+//>> 需要同步的容器
+type syncContainer interface {
+	ContainerInterface
+	getAllItems() []ItemInterface
+	drainUpdateQueue() []ItemOpRecord
+	drainCapacityChanged() bool
+}
+
+func newItemState(item ItemInterface) ItemState {
+	return ItemState{
+		UID:        item.GetUID(),
+		TID:        item.GetTID(),
+		Count:      item.GetCount(),
+		CreateTime: item.GetCreateTime(),
+		Pos:        item.GetPos(),
+		Flag:       item.GetFlag(),
+		ExpireTime: item.GetExpireTime(),
+		Attrs:      item.GetAttrs().Clone(),
+	}
+}
+
+func newContainerDelta(container ContainerInterface) ContainerDelta {
+	return ContainerDelta{
+		Type:        container.GetType(),
+		Size:        container.GetSize(),
+		MaxSize:     container.GetMaxSize(),
+		Load:        container.GetLoad(),
+		MaxLoad:     container.GetMaxLoad(),
+		UsableSize:  container.GetUsableSize(),
+		UsableLoad:  container.GetUsableLoad(),
+		LockedSlots: container.GetLockedSlots(),
+	}
+}
+
+//>> 合并一帧内同一个uid的操作, 返回值按uid第一次出现的顺序
+func coalesceOps(ops []ItemOpRecord) []ItemOpRecord {
+	const none = ItemUpdateType(-1)
+
+	index := make(map[uint64]int)
+	var ret []ItemOpRecord
+	for _, op := range ops {
+		i, ok := index[op.UID]
+		if !ok {
+			index[op.UID] = len(ret)
+			ret = append(ret, op)
+			continue
+		}
+
+		cur := &ret[i].Operation
+		switch {
+		case *cur == none:
+			*cur = op.Operation
+		case *cur == KItemUpdateTypeAdd && op.Operation == KItemUpdateTypeDel:
+			*cur = none
+		case *cur == KItemUpdateTypeAdd:
+			//>> add+update还是add
+		case *cur == KItemUpdateTypeDel && op.Operation != KItemUpdateTypeDel:
+			*cur = KItemUpdateTypeUpdate
+		case op.Operation == KItemUpdateTypeDel:
+			*cur = KItemUpdateTypeDel
+		}
+	}
+
+	n := 0
+	for _, op := range ret {
+		if op.Operation != none {
+			ret[n] = op
+			n++
+		}
+	}
+	return ret[:n]
+}
+
+//>> 取出一帧的变化, 没有变化返回nil; 只有容量变化时也会发一条不带道具的消息
+func buildContainerDelta(container syncContainer) *ContainerDelta {
+	ops := container.drainUpdateQueue()
+	changed := container.drainCapacityChanged()
+	if len(ops) == 0 && !changed {
+		return nil
+	}
+
+	delta := newContainerDelta(container)
+	for _, op := range coalesceOps(ops) {
+		if op.Operation == KItemUpdateTypeDel {
+			delta.Deleted = append(delta.Deleted, op.UID)
+			continue
+		}
+
+		item := container.GetItemByUID(op.UID)
+		if item == nil {
+			continue
+		}
+		if op.Operation == KItemUpdateTypeAdd {
+			delta.Added = append(delta.Added, newItemState(item))
+		} else {
+			delta.Updated = append(delta.Updated, newItemState(item))
+		}
+	}
+	return &delta
+}
+
+//>> 全量快照
+func buildContainerSnapshot(container syncContainer) ContainerDelta {
+	container.drainUpdateQueue()
+	container.drainCapacityChanged()
+
+	delta := newContainerDelta(container)
+	for _, item := range container.getAllItems() {
+		delta.Added = append(delta.Added, newItemState(item))
+	}
+	sort.Slice(delta.Added, func(i, j int) bool { return delta.Added[i].Pos < delta.Added[j].Pos })
+	return delta
+}
+
+//>> 取出所有容器这一帧的变化, 没有变化返回nil
+func (this *ItemComponent) BuildDelta() *ItemDelta {
+	var ret *ItemDelta
+	for _, typ := range this.containerTypes() {
+		container, ok := this.containers[typ].(syncContainer)
+		if !ok {
+			continue
+		}
+		if delta := buildContainerDelta(container); delta != nil {
+			if ret == nil {
+				ret = &ItemDelta{}
+			}
+			ret.Containers = append(ret.Containers, *delta)
+		}
+	}
+	return ret
+}
+
+//>> 全量快照, 登录和重连时用, 会清掉还没同步的变化
+func (this *ItemComponent) BuildSnapshot() *ItemDelta {
+	ret := &ItemDelta{Full: true}
+	for _, typ := range this.containerTypes() {
+		if container, ok := this.containers[typ].(syncContainer); ok {
+			ret.Containers = append(ret.Containers, buildContainerSnapshot(container))
+		}
+	}
+	return ret
+}
+
+//>> 设置同步回调, Update时有变化就调用
+func (this *ItemComponent) SetSyncHandler(handler func(delta *ItemDelta)) {
+	this.syncHandler = handler
+}
+
+//>> 按类型排好序的容器类型, 保证消息里容器的顺序固定
+func (this *ItemComponent) containerTypes() []ContainerType {
+	types := make([]ContainerType, 0, len(this.containers))
+	for typ := range this.containers {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+//>> 编码成紧凑的二进制
+func (this *ItemDelta) Marshal() []byte {
+	w := &byteWriter{}
+	w.bool(this.Full)
+	w.uvarint(uint64(len(this.Containers)))
+	for i := range this.Containers {
+		c := &this.Containers[i]
+		w.varint(int64(c.Type))
+		w.varint(int64(c.Size))
+		w.varint(int64(c.MaxSize))
+		w.varint(int64(c.Load))
+		w.varint(int64(c.MaxLoad))
+		w.varint(int64(c.UsableSize))
+		w.varint(int64(c.UsableLoad))
+		w.uvarint(uint64(len(c.LockedSlots)))
+		for _, pos := range c.LockedSlots {
+			w.varint(int64(pos))
+		}
+		for _, states := range [][]ItemState{c.Added, c.Updated} {
+			w.uvarint(uint64(len(states)))
+			for j := range states {
+				states[j].encode(w)
+			}
+		}
+		w.uvarint(uint64(len(c.Deleted)))
+		for _, uid := range c.Deleted {
+			w.uvarint(uid)
+		}
+	}
+	return w.buf
+}
+
+//>> 从Marshal的结果解码
+func UnmarshalItemDelta(data []byte) (*ItemDelta, error) {
+	r := &byteReader{buf: data}
+	delta := &ItemDelta{Full: r.bool()}
+	n := r.length()
+	for i := 0; i < n && r.err == nil; i++ {
+		c := ContainerDelta{
+			Type:       ContainerType(r.varint()),
+			Size:       int32(r.varint()),
+			MaxSize:    int32(r.varint()),
+			Load:       int32(r.varint()),
+			MaxLoad:    int32(r.varint()),
+			UsableSize: int32(r.varint()),
+			UsableLoad: int32(r.varint()),
+		}
+		m := r.length()
+		for j := 0; j < m && r.err == nil; j++ {
+			c.LockedSlots = append(c.LockedSlots, int16(r.varint()))
+		}
+		for _, states := range []*[]ItemState{&c.Added, &c.Updated} {
+			m := r.length()
+			for j := 0; j < m && r.err == nil; j++ {
+				*states = append(*states, decodeItemState(r, itemSnapshotVersion))
+			}
+		}
+		m = r.length()
+		for j := 0; j < m && r.err == nil; j++ {
+			c.Deleted = append(c.Deleted, r.uvarint())
+		}
+		delta.Containers = append(delta.Containers, c)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return delta, nil
+}
+
+func (this *ItemState) encode(w *byteWriter) {
+	w.uvarint(this.UID)
+	w.varint(int64(this.TID))
+	w.varint(this.Count)
+	w.varint(this.CreateTime)
+	w.varint(int64(this.Pos))
+	w.varint(int64(this.Flag))
+	w.varint(this.ExpireTime)
+	this.Attrs.encode(w)
+}
+
+//>> version是编码时的存档版本, 1版本还没有实例属性
+func decodeItemState(r *byteReader, version int) ItemState {
+	state := ItemState{
+		UID:        r.uvarint(),
+		TID:        int32(r.varint()),
+		Count:      r.varint(),
+		CreateTime: r.varint(),
+		Pos:        int16(r.varint()),
+		Flag:       int(r.varint()),
+		ExpireTime: r.varint(),
+	}
+	if version >= 2 {
+		state.Attrs = decodeItemAttrs(r)
+	}
+	return state
+}
@@ -0,0 +1,87 @@
+package bag_test
+
+import (
+	"testing"
+
+	"bag"
+)
+
+func TestBuildDelta(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	if delta := component.BuildDelta(); delta != nil {
+		t.Fatalf("new component has delta %+v", delta)
+	}
+
+	ores, _ := component.AddItem(bag.KContainerTypeBag, tidOre, 5, 1)
+	swords, _ := component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	ore, sword := ores[0], swords[0]
+	component.BuildDelta()
+
+	//>> update+del=del
+	component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 2, 1)
+	component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 3, 1)
+	//>> del+add=update: 存进仓库又取回来
+	component.Transfer(sword.GetUID(), bag.KContainerTypeBag, bag.KContainerTypeWarehouse, -1)
+	component.Transfer(sword.GetUID(), bag.KContainerTypeWarehouse, bag.KContainerTypeBag, -1)
+
+	delta := component.BuildDelta()
+	if delta == nil || delta.Full {
+		t.Fatalf("delta = %+v, want an incremental delta", delta)
+	}
+	bagDelta := findDelta(delta, bag.KContainerTypeBag)
+	if bagDelta == nil {
+		t.Fatal("no bag delta")
+	}
+	if len(bagDelta.Deleted) != 1 || bagDelta.Deleted[0] != ore.GetUID() {
+		t.Fatalf("deleted = %v, want the ore", bagDelta.Deleted)
+	}
+	if len(bagDelta.Added) != 0 || len(bagDelta.Updated) != 1 || bagDelta.Updated[0].UID != sword.GetUID() {
+		t.Fatalf("added %+v updated %+v, want the sword updated", bagDelta.Added, bagDelta.Updated)
+	}
+
+	if delta := component.BuildDelta(); delta != nil {
+		t.Fatalf("second BuildDelta in the same frame = %+v", delta)
+	}
+}
+
+func TestBuildSnapshot(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 150, 1)
+	component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+
+	snapshot := component.BuildSnapshot()
+	if !snapshot.Full {
+		t.Fatal("snapshot should be full")
+	}
+	added := findDelta(snapshot, bag.KContainerTypeBag).Added
+	if len(added) != 3 {
+		t.Fatalf("bag snapshot has %d items, want 3", len(added))
+	}
+	for i := 1; i < len(added); i++ {
+		if added[i-1].Pos >= added[i].Pos {
+			t.Fatalf("snapshot not ordered by pos: %+v", added)
+		}
+	}
+	//>> 全量快照会清掉还没同步的变化
+	if delta := component.BuildDelta(); delta != nil {
+		t.Fatalf("delta after snapshot = %+v", delta)
+	}
+
+	data := snapshot.Marshal()
+	decoded, err := bag.UnmarshalItemDelta(data)
+	if err != nil || !decoded.Full || len(findDelta(decoded, bag.KContainerTypeBag).Added) != 3 {
+		t.Fatalf("UnmarshalItemDelta: %v", err)
+	}
+	if _, err := bag.UnmarshalItemDelta(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated delta should fail to decode")
+	}
+}
+
+func findDelta(delta *bag.ItemDelta, typ bag.ContainerType) *bag.ContainerDelta {
+	for i := range delta.Containers {
+		if delta.Containers[i].Type == typ {
+			return &delta.Containers[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package bag
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+* @Description: 道具模板(配置表), 容器根据模板计算堆叠、负重、类型
+**/
+
+//>> 道具模板，对应配置表中的一行
+type ItemTemplate struct {
+	TID        int32 `json:"tid"`
+	Type       int32 `json:"type"`        //>> 道具类型
+	Weight     int32 `json:"weight"`      //>> 单个负重
+	MaxOverlap int64 `json:"max_overlap"` //>> 最大堆叠, <=1表示不可堆叠
+	EquipSlot  int32 `json:"equip_slot"`  //>> 装备部位, 0表示不能装备
+	Duration   int64 `json:"duration"`    //>> 获得后多少秒过期, 0表示不过期
+	ExpireAt   int64 `json:"expire_at"`   //>> 固定的过期时间点(unix秒), 优先于Duration
+	MaxHold    int64 `json:"max_hold"`    //>> 持有上限, 0表示不限, 货币用来限制余额
+	UseLevel   int32 `json:"use_level"`   //>> 使用需要的等级, 0表示不限
+	CDGroup    int32 `json:"cd_group"`    //>> 冷却组, 同组的道具共用冷却, 0表示没有冷却
+	CDTime     int64 `json:"cd_time"`     //>> 使用后冷却多少毫秒
+}
+
+//>> 道具模板提供者，可以从配置文件加载，也可以接入项目自己的配置系统
+type ItemTemplateProvider interface {
+	GetItemTemplate(tid int32) *ItemTemplate
+}
+
+//>> 默认的模板表实现
+type ItemTemplateTable map[int32]*ItemTemplate
+
+func (this ItemTemplateTable) GetItemTemplate(tid int32) *ItemTemplate {
+	return this[tid]
+}
+
+var templateProvider ItemTemplateProvider = ItemTemplateTable{}
+
+//>> 设置全局道具模板提供者
+func SetItemTemplateProvider(provider ItemTemplateProvider) {
+	if provider == nil {
+		provider = ItemTemplateTable{}
+	}
+	templateProvider = provider
+}
+
+//>> 返回全局模板提供者中的模板, 没有返回nil
+func GetItemTemplate(tid int32) *ItemTemplate {
+	return templateProvider.GetItemTemplate(tid)
+}
+
+//>> 从json文件加载模板表, 格式为模板数组
+func LoadItemTemplateJSON(path string) (ItemTemplateTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []*ItemTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, err
+	}
+
+	table := make(ItemTemplateTable, len(templates))
+	for _, tmpl := range templates {
+		if _, ok := table[tmpl.TID]; ok {
+			return nil, fmt.Errorf("duplicate item template tid:%d", tmpl.TID)
+		}
+		table[tmpl.TID] = tmpl
+	}
+	return table, nil
+}
+
+//>> 从csv文件加载模板表, 首行为表头: tid,type,weight,max_overlap,equip_slot,duration,expire_at,max_hold,use_level,cd_group,cd_time (列顺序不限)
+func LoadItemTemplateCSV(path string) (ItemTemplateTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return ItemTemplateTable{}, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := columns["tid"]; !ok {
+		return nil, fmt.Errorf("%s: missing column tid", path)
+	}
+
+	field := func(record []string, name string) (int64, error) {
+		idx, ok := columns[name]
+		if !ok || idx >= len(record) || strings.TrimSpace(record[idx]) == "" {
+			return 0, nil
+		}
+		return strconv.ParseInt(strings.TrimSpace(record[idx]), 10, 64)
+	}
+
+	table := make(ItemTemplateTable, len(records)-1)
+	for line, record := range records[1:] {
+		var values [11]int64
+		for i, name := range []string{"tid", "type", "weight", "max_overlap", "equip_slot", "duration", "expire_at", "max_hold", "use_level", "cd_group", "cd_time"} {
+			if values[i], err = field(record, name); err != nil {
+				return nil, fmt.Errorf("%s:%d column %s: %v", path, line+2, name, err)
+			}
+		}
+
+		tmpl := &ItemTemplate{
+			TID:        int32(values[0]),
+			Type:       int32(values[1]),
+			Weight:     int32(values[2]),
+			MaxOverlap: values[3],
+			EquipSlot:  int32(values[4]),
+			Duration:   values[5],
+			ExpireAt:   values[6],
+			MaxHold:    values[7],
+			UseLevel:   int32(values[8]),
+			CDGroup:    int32(values[9]),
+			CDTime:     values[10],
+		}
+		if _, ok := table[tmpl.TID]; ok {
+			return nil, fmt.Errorf("%s:%d duplicate item template tid:%d", path, line+2, tmpl.TID)
+		}
+		table[tmpl.TID] = tmpl
+	}
+	return table, nil
+}
@@ -0,0 +1,323 @@
+package bag
+
+/**
+* @Description: 玩家交易
+	TradeSession把双方要交出的道具锁定(按uid锁单个道具, 按tid冻结数量), 锁定期间这些道具不能被扣除、移出或合并.
+	双方都放好后Commit: 两个ItemComponent各开一个事务, 先扣掉双方交出的道具, 再检查并加给对方, 任何一步失败两边一起回滚并恢复锁定.
+	整堆按uid交出的道具原样转移(保留uid和实例属性), 其他的按数量扣除再给对方加新道具.
+	按tid交出时锁定阶段就挑好具体扣哪几堆(跳过绑定的), 提交时按uid扣这几堆, 不走绑定优先的扣除规则.
+	所有变化的原因都是KItemChangeReasonTrade, 审计日志在提交后写入.
+	TradeSession直接修改双方的ItemComponent, 背包由ItemActor管理时, Offer/Commit/Abort都要放在涉及的actor的Exclusive里调用, 否则返回ErrNotExclusive.
+	绑定的道具不能交易
+**/
+
+//>> 一方交出的道具, 都从背包(货币从钱包)里出
+type TradeOffer struct {
+	UIDs []ItemUidDesc //>> 按uid交出, 装备等有实例属性的道具用这个
+	TIDs []ItemTidDesc //>> 按模板交出, 货币、材料用这个
+}
+
+type tradeSide struct {
+	component *ItemComponent
+	offer     TradeOffer
+	locked    bool
+
+	lockedUIDs []lockedUID //>> 已经锁定的部分, 解锁时按这个还原
+	picked     []lockedUID //>> 按tid交出时挑中的堆, 提交时按这个扣
+}
+
+type TradeSession struct {
+	ID       uint64
+	sides    [2]*tradeSide
+	finished bool
+}
+
+func NewTradeSession(a, b *ItemComponent) *TradeSession {
+	return &TradeSession{
+		ID:    nextUID(),
+		sides: [2]*tradeSide{{component: a}, {component: b}},
+	}
+}
+
+//>> 放入(或替换)component这一方交出的道具并锁定
+func (this *TradeSession) Offer(component *ItemComponent, offer TradeOffer) ItemError {
+	if this.finished {
+		return NewItemError(ErrTradeClosed)
+	}
+	side := this.side(component)
+	if side == nil {
+		return NewItemError(ErrContainerNotExist)
+	}
+	if err := component.checkExclusive(); err != nil {
+		return err
+	}
+
+	side.unlock()
+	side.offer = TradeOffer{
+		UIDs: append([]ItemUidDesc(nil), offer.UIDs...),
+		TIDs: append([]ItemTidDesc(nil), offer.TIDs...),
+	}
+	if err := side.lock(); err != nil {
+		side.offer = TradeOffer{}
+		return err
+	}
+	return nil
+}
+
+//>> 交换双方的道具, 要么都成功要么都不变
+func (this *TradeSession) Commit() ItemError {
+	if this.finished || !this.sides[0].locked || !this.sides[1].locked {
+		return NewItemError(ErrTradeClosed)
+	}
+	if err := this.checkExclusive(); err != nil {
+		return err
+	}
+
+	a, b := this.sides[0].component, this.sides[1].component
+	txA := a.Begin()
+	if txA == nil {
+		return NewItemError(ErrTransactionConflict)
+	}
+	txB := b.Begin()
+	if txB == nil {
+		txA.Rollback()
+		return NewItemError(ErrTransactionConflict)
+	}
+
+	this.sides[0].unlock()
+	this.sides[1].unlock()
+	if err := this.exchange(); err != nil {
+		txA.Rollback()
+		txB.Rollback()
+		this.sides[0].lock()
+		this.sides[1].lock()
+		return err
+	}
+
+	txA.Commit()
+	txB.Commit()
+	this.finished = true
+	return nil
+}
+
+//>> 取消交易, 解除双方的锁定
+func (this *TradeSession) Abort() ItemError {
+	if this.finished {
+		return nil
+	}
+	if err := this.checkExclusive(); err != nil {
+		return err
+	}
+	this.sides[0].unlock()
+	this.sides[1].unlock()
+	this.finished = true
+	return nil
+}
+
+func (this *TradeSession) checkExclusive() ItemError {
+	for _, side := range this.sides {
+		if err := side.component.checkExclusive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *TradeSession) side(component *ItemComponent) *tradeSide {
+	for _, side := range this.sides {
+		if side.component == component {
+			return side
+		}
+	}
+	return nil
+}
+
+//>> 在两边的事务里扣掉交出的道具再加给对方
+func (this *TradeSession) exchange() ItemError {
+	var moved [2][]ItemInterface
+	var given [2][]ItemTidDesc
+
+	for i, side := range this.sides {
+		component := side.component
+		container, ok := component.GetContainerByType(KContainerTypeBag).(tradeContainer)
+		if !ok {
+			return NewItemError(ErrContainerNotExist)
+		}
+
+		for _, desc := range side.offer.UIDs {
+			item := container.GetItemByUID(desc.UID)
+			if item == nil {
+				return NewItemError(ErrItemNotExist)
+			}
+			if desc.Count == item.GetCount() {
+				if _, err := container.swapOut(desc.UID, KItemChangeReasonTrade); err != nil {
+					return err
+				}
+				moved[i] = append(moved[i], item)
+				continue
+			}
+
+			if err := container.ReduceItemByUID(desc.UID, desc.Count, KItemChangeReasonTrade); err != nil {
+				return err
+			}
+			given[i] = append(given[i], ItemTidDesc{TID: item.GetTID(), Count: desc.Count})
+		}
+
+		//>> 按tid交出的只扣锁定时挑中的不绑定的堆
+		for _, desc := range side.picked {
+			if err := component.GetContainerByType(desc.Type).ReduceItemByUID(desc.UID, desc.Count, KItemChangeReasonTrade); err != nil {
+				return err
+			}
+		}
+		given[i] = append(given[i], side.offer.TIDs...)
+	}
+
+	for i, side := range this.sides {
+		receiver, from := side.component, 1-i
+
+		//>> 整体检查一次放不放得下, 转移过来的道具按数量估算
+		descs := append([]ItemTidDesc(nil), given[from]...)
+		for _, item := range moved[from] {
+			descs = append(descs, ItemTidDesc{TID: item.GetTID(), Count: item.GetCount()})
+		}
+		if err := receiver.TryAddItems(KContainerTypeBag, descs); err != nil {
+			return err
+		}
+
+		for _, item := range moved[from] {
+			container, ok := receiver.GetContainerByType(receiver.routeType(KContainerTypeBag, item.GetTID())).(tradeContainer)
+			if !ok {
+				return NewItemError(ErrContainerNotExist)
+			}
+			if err := container.swapIn(item, -1, KItemChangeReasonTrade); err != nil {
+				return err
+			}
+		}
+		if _, err := receiver.addItems(KContainerTypeBag, given[from], KItemChangeReasonTrade); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type lockedUID struct {
+	ItemUidDesc
+	TID  int32
+	Type ContainerType //>> 道具所在的容器, 货币在钱包里
+}
+
+//>> 能参与交易的容器
+type tradeContainer interface {
+	ContainerInterface
+	swapOut(uid uint64, reason ItemChangeReason) (ItemInterface, ItemError)
+	swapIn(item ItemInterface, pos int16, reason ItemChangeReason) ItemError
+	lockItem(uid uint64, tid int32, count int64)
+	unlockedCount(uid uint64) int64
+}
+
+//>> 检查并锁定交出的道具, 失败时不留下任何锁定
+func (this *tradeSide) lock() ItemError {
+	component := this.component
+	bag, ok := component.GetContainerByType(KContainerTypeBag).(tradeContainer)
+	if !ok {
+		return NewItemError(ErrContainerNotExist)
+	}
+
+	for _, desc := range this.offer.UIDs {
+		if err := bag.TryReduceItemByUID(desc.UID, desc.Count); err != nil {
+			this.unlock()
+			return err
+		}
+		item := bag.GetItemByUID(desc.UID)
+		tid := item.GetTID()
+		if item.GetFlag()&IsBind != 0 {
+			this.unlock()
+			err := NewItemError(ErrItemBound)
+			err.Param = append(err.Param, int(tid))
+			return err
+		}
+		bag.lockItem(desc.UID, tid, desc.Count)
+		this.lockedUIDs = append(this.lockedUIDs, lockedUID{desc, tid, KContainerTypeBag})
+	}
+
+	this.picked = nil
+	for _, desc := range this.offer.TIDs {
+		typ := component.routeType(KContainerTypeBag, desc.TID)
+		container, ok := component.GetContainerByType(typ).(tradeContainer)
+		if !ok {
+			this.unlock()
+			return NewItemError(ErrContainerNotExist)
+		}
+		if err := container.TryReduceItemByTID(desc.TID, desc.Count); err != nil {
+			this.unlock()
+			return err
+		}
+
+		//>> 总数够了还要不绑定的堆够, 否则就得扣到绑定的
+		need := desc.Count
+		for _, item := range container.GetItemsByTID(desc.TID) {
+			if need == 0 {
+				break
+			}
+			if item.GetFlag()&IsBind != 0 {
+				continue
+			}
+			n := container.unlockedCount(item.GetUID())
+			if n > need {
+				n = need
+			}
+			if n <= 0 {
+				continue
+			}
+			locked := lockedUID{ItemUidDesc{UID: item.GetUID(), Count: n}, desc.TID, typ}
+			container.lockItem(locked.UID, locked.TID, locked.Count)
+			this.lockedUIDs = append(this.lockedUIDs, locked)
+			this.picked = append(this.picked, locked)
+			need -= n
+		}
+		if need > 0 {
+			this.unlock()
+			err := NewItemError(ErrItemBound)
+			err.Param = append(err.Param, int(desc.TID))
+			return err
+		}
+	}
+	this.locked = true
+	return nil
+}
+
+//>> 解除锁定, 只解除lock里已经加上的部分
+func (this *tradeSide) unlock() {
+	component := this.component
+	for _, desc := range this.lockedUIDs {
+		component.GetContainerByType(desc.Type).(tradeContainer).lockItem(desc.UID, desc.TID, -desc.Count)
+	}
+	this.lockedUIDs = nil
+	this.locked = false
+}
+
+//>> 按uid锁定count个道具, count为负数表示解锁; 道具在锁定期间可能已经过期删除, 所以tid由调用者记下
+func (this *ContainerBase) lockItem(uid uint64, tid int32, count int64) {
+	if this.locked == nil {
+		this.locked = make(map[uint64]int64)
+		this.lockedTotal = make(map[int32]int64)
+	}
+	if this.locked[uid] += count; this.locked[uid] <= 0 {
+		delete(this.locked, uid)
+	}
+	if this.lockedTotal[tid] += count; this.lockedTotal[tid] <= 0 {
+		delete(this.lockedTotal, tid)
+	}
+	if count < 0 && this.owner != nil {
+		this.owner.recheckExpire()
+	}
+}
+
+//>> 道具没被交易锁定的数量
+func (this *ContainerBase) unlockedCount(uid uint64) int64 {
+	item := this.GetItemByUID(uid)
+	if item == nil {
+		return 0
+	}
+	return item.GetCount() - this.locked[uid]
+}
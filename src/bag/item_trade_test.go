@@ -0,0 +1,88 @@
+package bag_test
+
+import (
+	"testing"
+	"time"
+
+	"bag"
+)
+
+func TestTradeRejectsBoundItem(t *testing.T) {
+	a, b := bag.NewItemComponent(1), bag.NewItemComponent(2)
+	swords, _ := a.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	swords[0].SetFlag(bag.IsBind)
+
+	trade := bag.NewTradeSession(a, b)
+	err := trade.Offer(a, bag.TradeOffer{UIDs: []bag.ItemUidDesc{{UID: swords[0].GetUID(), Count: 1}}})
+	if err == nil || err.Code != bag.ErrItemBound {
+		t.Fatalf("offer bound sword: %v", err)
+	}
+	if err := a.ReduceItemByUID(swords[0].GetUID(), 1, 1); err != nil {
+		t.Fatalf("rejected offer left the sword locked: %v", err)
+	}
+}
+
+func TestTradeBetweenActors(t *testing.T) {
+	a, b := bag.NewItemComponent(1), bag.NewItemComponent(2)
+	actorA := bag.NewItemActor(a, 16, time.Millisecond)
+	actorB := bag.NewItemActor(b, 16, time.Millisecond)
+	defer actorA.Stop()
+	defer actorB.Stop()
+	actorA.AddItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 10}}, 1)
+	actorB.AddItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidGold, Count: 100}}, 1)
+
+	trade := bag.NewTradeSession(a, b)
+	if err := trade.Offer(a, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidOre, Count: 4}}}); err == nil || err.Code != bag.ErrNotExclusive {
+		t.Fatalf("offer outside Exclusive: %v", err)
+	}
+
+	actors := []*bag.ItemActor{actorB, actorA}
+	err := bag.Exclusive(actors, func() bag.ItemError {
+		if err := trade.Offer(a, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidOre, Count: 4}}}); err != nil {
+			return err
+		}
+		if err := trade.Offer(b, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidGold, Count: 30}}}); err != nil {
+			return err
+		}
+		return trade.Commit()
+	})
+	if err != nil {
+		t.Fatalf("trade: %v", err)
+	}
+	if actorA.GetItemCount(tidGold) != 30 || actorB.GetItemCount(tidOre) != 4 {
+		t.Fatalf("after trade: a gold %d, b ore %d", actorA.GetItemCount(tidGold), actorB.GetItemCount(tidOre))
+	}
+}
+
+func TestTradeTIDSkipsBoundStacks(t *testing.T) {
+	a, b := bag.NewItemComponent(1), bag.NewItemComponent(2)
+	ores, _ := a.AddItem(bag.KContainerTypeBag, tidOre, 119, 1)
+	if len(ores) != 2 {
+		t.Fatalf("ore stacks: %d", len(ores))
+	}
+	bound := ores[0]
+	bound.SetFlag(bag.IsBind)
+
+	trade := bag.NewTradeSession(a, b)
+	err := trade.Offer(a, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidOre, Count: 30}}})
+	if err == nil || err.Code != bag.ErrItemBound {
+		t.Fatalf("offer more than the unbound ore: %v", err)
+	}
+
+	if err := trade.Offer(a, bag.TradeOffer{TIDs: []bag.ItemTidDesc{{TID: tidOre, Count: 15}}}); err != nil {
+		t.Fatalf("offer unbound ore: %v", err)
+	}
+	if err := trade.Offer(b, bag.TradeOffer{}); err != nil {
+		t.Fatalf("empty offer: %v", err)
+	}
+	if err := trade.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	if got := a.GetItemByUID(bound.GetUID()); got == nil || got.GetCount() != 99 {
+		t.Fatalf("bound stack was traded: %v", got)
+	}
+	if a.GetItemCount(tidOre) != 104 || b.GetItemCount(tidOre) != 15 {
+		t.Fatalf("after trade: a ore %d, b ore %d", a.GetItemCount(tidOre), b.GetItemCount(tidOre))
+	}
+}
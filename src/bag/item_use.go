@@ -0,0 +1,146 @@
+package bag
+
+/**
+* @Description: 道具使用
+	UseItem根据模板id找到注册的UseHandler(开宝箱、喝药水、礼包...), 检查等级后在一个事务里先扣道具再调用handler,
+	handler返回错误时扣掉的道具和handler里加的道具一起回滚. 加buff这类不能回滚的操作用UseContext.OnCommit放到提交之后.
+	冷却和ConsumeItem走同一套(见item_cooldown.go): 冷却中不能用, 提交成功后模板所在的冷却组开始冷却.
+	handler只依赖UseContext, 测试时new一个ItemComponent就能跑, 不需要整个游戏服.
+	handler注册表是全局的, 和模板表一样在启动时注册, 不是线程安全的
+**/
+
+//>> 使用效果, 扣除道具之后在同一个事务里调用
+type UseHandler func(ctx *UseContext) ItemError
+
+//>> 使用道具时交给handler的上下文
+type UseContext struct {
+	Component *ItemComponent
+	Item      ItemInterface //>> 被使用的道具, 全部用掉时已经不在容器里了
+	Count     int64         //>> 使用个数
+	Target    interface{}   //>> 使用目标, 由业务定义, 比如宠物id
+	Result    *UseResult
+
+	tx *Transaction
+}
+
+//>> 使用结果
+type UseResult struct {
+	UID      uint64
+	TID      int32
+	Consumed int64
+	Added    []ItemInterface //>> 使用后获得的道具
+	Overflow []*OverflowMail //>> 背包放不下进了溢出邮箱的部分
+	Effects  []interface{}   //>> handler自定义的效果, 比如加了哪个buff
+}
+
+var useHandlers = map[int32]UseHandler{}
+
+//>> 注册模板的使用效果, handler为nil表示取消注册
+func RegisterUseHandler(tid int32, handler UseHandler) {
+	if handler == nil {
+		delete(useHandlers, tid)
+		return
+	}
+	useHandlers[tid] = handler
+}
+
+//>> 礼包: 每用一个获得一份items
+func GiftPackHandler(items []ItemTidDesc) UseHandler {
+	return func(ctx *UseContext) ItemError {
+		gifts := make([]ItemTidDesc, 0, len(items))
+		for _, item := range items {
+			gifts = append(gifts, ItemTidDesc{TID: item.TID, Count: item.Count * ctx.Count})
+		}
+		return ctx.AddItems(gifts)
+	}
+}
+
+//>> 把道具加到背包, 结果记到Result里; 放不下时按溢出策略处理
+func (this *UseContext) AddItems(items []ItemTidDesc) ItemError {
+	result, err := this.Component.AddItemsWithResult(KContainerTypeBag, items, KItemChangeReasonUse)
+	if err != nil {
+		return err
+	}
+	this.Result.Added = append(this.Result.Added, result.Added...)
+	if result.Overflow != nil {
+		this.Result.Overflow = append(this.Result.Overflow, result.Overflow)
+	}
+	return nil
+}
+
+//>> 使用成功提交之后再执行fn, 失败回滚时不执行
+func (this *UseContext) OnCommit(fn func()) {
+	this.tx.deferCommit(fn)
+}
+
+//>> 记录一个自定义效果
+func (this *UseContext) AddEffect(effect interface{}) {
+	this.Result.Effects = append(this.Result.Effects, effect)
+}
+
+//>> 设置玩家等级的来源, 没设置时等级当作0
+func (this *ItemComponent) SetLevelProvider(provider func() int32) {
+	this.levelProvider = provider
+}
+
+//>> 使用背包里的道具
+func (this *ItemComponent) UseItem(uid uint64, count int64, target interface{}) (*UseResult, ItemError) {
+	container := this.GetContainerByType(KContainerTypeBag)
+	if container == nil {
+		return nil, NewItemError(ErrContainerNotExist)
+	}
+	item := container.GetItemByUID(uid)
+	if item == nil {
+		return nil, NewItemError(ErrItemNotExist)
+	}
+
+	tid := item.GetTID()
+	handler := useHandlers[tid]
+	if handler == nil {
+		err := NewItemError(ErrItemCannotUse)
+		err.Param = append(err.Param, int(tid))
+		return nil, err
+	}
+	if err := this.checkLevel(tid); err != nil {
+		return nil, err
+	}
+
+	ctx := &UseContext{
+		Component: this,
+		Item:      item,
+		Count:     count,
+		Target:    target,
+		Result:    &UseResult{UID: uid, TID: tid, Consumed: count},
+	}
+	err := this.withCooldown([]int32{tid}, func() ItemError {
+		if err := container.ReduceItemByUID(uid, count, KItemChangeReasonUse); err != nil {
+			return err
+		}
+
+		ctx.tx = this.tx
+		return handler(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Result, nil
+}
+
+//>> 检查使用等级
+func (this *ItemComponent) checkLevel(tid int32) ItemError {
+	tmpl := GetItemTemplate(tid)
+	if tmpl == nil || tmpl.UseLevel <= 0 {
+		return nil
+	}
+
+	level := int32(0)
+	if this.levelProvider != nil {
+		level = this.levelProvider()
+	}
+	if level < tmpl.UseLevel {
+		err := NewItemError(ErrLevelNotEnough)
+		err.Param = append(err.Param, int(tid), int(tmpl.UseLevel))
+		return err
+	}
+	return nil
+}
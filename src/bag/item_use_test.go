@@ -0,0 +1,43 @@
+package bag_test
+
+import (
+	"testing"
+
+	"bag"
+)
+
+func TestUseItemCooldown(t *testing.T) {
+	fail := true
+	bag.RegisterUseHandler(tidElixir, func(ctx *bag.UseContext) bag.ItemError {
+		if fail {
+			return bag.NewItemError(bag.ErrInvalidCount)
+		}
+		return nil
+	})
+	defer bag.RegisterUseHandler(tidElixir, nil)
+
+	component := bag.NewItemComponent(1)
+	component.SetLevelProvider(func() int32 { return 10 })
+	elixirs, _ := component.AddItem(bag.KContainerTypeBag, tidElixir, 5, 1)
+	uid := elixirs[0].GetUID()
+
+	//>> handler失败不进入冷却
+	if _, err := component.UseItem(uid, 1, nil); err == nil {
+		t.Fatal("failing handler should fail the use")
+	}
+	if left := component.GetItemCooldownLeft(tidElixir); left != 0 {
+		t.Fatalf("cooldown started by failed use: %d", left)
+	}
+
+	fail = false
+	if _, err := component.UseItem(uid, 1, nil); err != nil {
+		t.Fatalf("use elixir: %v", err)
+	}
+	//>> 使用和消耗共用冷却组
+	if err := component.ConsumeItem(bag.KContainerTypeBag, tidElixir, 1, 1); err == nil || err.Code != bag.ErrItemInCooldown {
+		t.Fatalf("consume after use: %v", err)
+	}
+	if got := component.GetItemCount(tidElixir); got != 4 {
+		t.Fatalf("elixir = %d, want 4", got)
+	}
+}
@@ -0,0 +1,398 @@
+package bag
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+/**
+* @Description: 本地嵌入式kv文件, 实现ItemStore
+	只追加写的日志文件, 每次WriteItems是一条带crc的记录, 写一半宕机重启时会截掉残缺的尾巴.
+	只有文件末尾的残缺记录才会被截掉; 中间的记录校验失败、解不开或者是新版本写的, 打开直接失败, 不动文件.
+	打开时重放日志在内存里建索引, 废数据太多时Compact重写文件.
+	实现了CapacityStore, 容器容量和道具记在同一个日志里
+**/
+
+const (
+	kvOpUpsert   = 1
+	kvOpDelete   = 2
+	kvOpCapacity = 3
+
+	//>> 废记录超过活记录的倍数时自动压缩
+	kvCompactRatio = 4
+	kvCompactMin   = 1024
+)
+
+var errKVClosed = errors.New("bag: kv store closed")
+
+type KVFileStore struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	index    map[uint64]map[ItemKey]ItemState
+	capacity map[uint64]map[ContainerType]ContainerCapacity
+	live     int //>> 活着的道具数和容量记录数
+	garbage  int //>> 被覆盖或删除的记录数
+}
+
+//>> 打开或创建kv文件
+func OpenKVFileStore(path string) (*KVFileStore, error) {
+	store := &KVFileStore{
+		path:     path,
+		index:    make(map[uint64]map[ItemKey]ItemState),
+		capacity: make(map[uint64]map[ContainerType]ContainerCapacity),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := store.replay(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	//>> 截掉末尾残缺的记录
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store.file = file
+	return store, nil
+}
+
+func (this *KVFileStore) WriteItems(playerID uint64, upserts []ItemRecord, deletes []ItemKey) error {
+	return this.write(&kvBatch{playerID: playerID, upserts: upserts, deletes: deletes})
+}
+
+func (this *KVFileStore) WriteCapacity(playerID uint64, capacity []ContainerCapacity) error {
+	return this.write(&kvBatch{playerID: playerID, capacity: capacity})
+}
+
+func (this *KVFileStore) LoadCapacity(playerID uint64) ([]ContainerCapacity, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return nil, errKVClosed
+	}
+
+	capacity := make([]ContainerCapacity, 0, len(this.capacity[playerID]))
+	for _, c := range this.capacity[playerID] {
+		capacity = append(capacity, c)
+	}
+	sort.Slice(capacity, func(i, j int) bool { return capacity[i].Container < capacity[j].Container })
+	return capacity, nil
+}
+
+func (this *KVFileStore) write(batch *kvBatch) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return errKVClosed
+	}
+
+	if _, err := this.file.Write(batch.encode()); err != nil {
+		return err
+	}
+	if err := this.file.Sync(); err != nil {
+		return err
+	}
+
+	this.apply(batch)
+	//>> 这批已经写进去了, 压缩失败不算写失败, 下次写的时候再试
+	if this.garbage > kvCompactMin && this.garbage > this.live*kvCompactRatio {
+		if err := this.compact(); err != nil {
+			log.Printf("kv store %s compact failed: %v", this.path, err)
+		}
+	}
+	return nil
+}
+
+func (this *KVFileStore) LoadItems(playerID uint64) ([]ItemRecord, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return nil, errKVClosed
+	}
+
+	items := this.index[playerID]
+	records := make([]ItemRecord, 0, len(items))
+	for key, state := range items {
+		records = append(records, ItemRecord{Container: key.Container, Item: state})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Container != records[j].Container {
+			return records[i].Container < records[j].Container
+		}
+		return records[i].Item.UID < records[j].Item.UID
+	})
+	return records, nil
+}
+
+//>> 重写文件, 只保留活着的数据
+func (this *KVFileStore) Compact() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return errKVClosed
+	}
+	return this.compact()
+}
+
+func (this *KVFileStore) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+func (this *KVFileStore) compact() error {
+	tmp := this.path + ".compact"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for playerID, items := range this.index {
+		batch := &kvBatch{playerID: playerID, upserts: make([]ItemRecord, 0, len(items))}
+		for key, state := range items {
+			batch.upserts = append(batch.upserts, ItemRecord{Container: key.Container, Item: state})
+		}
+		if _, err := w.Write(batch.encode()); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	for playerID, capacity := range this.capacity {
+		batch := &kvBatch{playerID: playerID, capacity: make([]ContainerCapacity, 0, len(capacity))}
+		for _, c := range capacity {
+			batch.capacity = append(batch.capacity, c)
+		}
+		if _, err := w.Write(batch.encode()); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, this.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	this.file.Close()
+	this.file = file
+	this.garbage = 0
+	return nil
+}
+
+func (this *KVFileStore) apply(batch *kvBatch) {
+	playerID := batch.playerID
+	if len(batch.capacity) > 0 {
+		capacity := this.capacity[playerID]
+		if capacity == nil {
+			capacity = make(map[ContainerType]ContainerCapacity)
+			this.capacity[playerID] = capacity
+		}
+		for _, c := range batch.capacity {
+			if _, ok := capacity[c.Container]; ok {
+				this.garbage++
+			} else {
+				this.live++
+			}
+			capacity[c.Container] = c
+		}
+	}
+	if len(batch.upserts) == 0 && len(batch.deletes) == 0 {
+		return
+	}
+
+	items := this.index[playerID]
+	if items == nil {
+		items = make(map[ItemKey]ItemState)
+		this.index[playerID] = items
+	}
+
+	for _, record := range batch.upserts {
+		key := ItemKey{Container: record.Container, UID: record.Item.UID}
+		if _, ok := items[key]; ok {
+			this.garbage++
+		} else {
+			this.live++
+		}
+		items[key] = record.Item
+	}
+	for _, key := range batch.deletes {
+		if _, ok := items[key]; ok {
+			delete(items, key)
+			this.live--
+			this.garbage++
+		}
+		//>> 删除记录本身也是废数据
+		this.garbage++
+	}
+
+	if len(items) == 0 {
+		delete(this.index, playerID)
+	}
+}
+
+//>> 重放日志, 返回完整记录的结束位置; 只有末尾的残缺记录会被忽略, 其他坏记录返回错误
+func (this *KVFileStore) replay(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(file)
+	valid := int64(0)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		size := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		//>> 长度超过文件剩下的部分, 说明长度本身没写完整, 按残缺的尾巴处理, 也避免按坏长度分配大内存
+		if int64(size) > info.Size()-valid-int64(len(header)) {
+			return valid, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if crc32.ChecksumIEEE(payload) != sum {
+			//>> 最后一条记录写了一半(长度写进去了, 内容没写完)才算残缺的尾巴
+			if _, err := r.Peek(1); err == io.EOF {
+				return valid, nil
+			}
+			return 0, fmt.Errorf("bag: kv store %s bad checksum at offset %d", this.path, valid)
+		}
+
+		batch, err := decodeKVBatch(payload)
+		if err != nil {
+			return 0, fmt.Errorf("bag: kv store %s bad record at offset %d: %v", this.path, valid, err)
+		}
+		this.apply(batch)
+		valid += int64(len(header)) + int64(size)
+	}
+}
+
+//>> 一次写入的一批修改
+type kvBatch struct {
+	playerID uint64
+	upserts  []ItemRecord
+	deletes  []ItemKey
+	capacity []ContainerCapacity
+}
+
+//>> 编码成一条记录: [长度4字节][crc4字节][payload], payload以道具编码的版本号开头
+func (this *kvBatch) encode() []byte {
+	w := &byteWriter{}
+	w.uvarint(itemSnapshotVersion)
+	w.uvarint(this.playerID)
+	w.uvarint(uint64(len(this.upserts) + len(this.deletes) + len(this.capacity)))
+	for i := range this.upserts {
+		w.buf = append(w.buf, kvOpUpsert)
+		w.varint(int64(this.upserts[i].Container))
+		this.upserts[i].Item.encode(w)
+	}
+	for _, key := range this.deletes {
+		w.buf = append(w.buf, kvOpDelete)
+		w.varint(int64(key.Container))
+		w.uvarint(key.UID)
+	}
+	for _, c := range this.capacity {
+		w.buf = append(w.buf, kvOpCapacity)
+		w.varint(int64(c.Container))
+		w.varint(int64(c.MaxSize))
+		w.varint(int64(c.MaxLoad))
+		w.uvarint(uint64(len(c.LockedSlots)))
+		for _, pos := range c.LockedSlots {
+			w.varint(int64(pos))
+		}
+	}
+
+	record := make([]byte, 8, 8+len(w.buf))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(w.buf)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(w.buf))
+	return append(record, w.buf...)
+}
+
+func decodeKVBatch(payload []byte) (*kvBatch, error) {
+	r := &byteReader{buf: payload}
+	version := int(r.uvarint())
+	if version <= 0 || version > itemSnapshotVersion {
+		return nil, fmt.Errorf("bag: unsupported kv record version %d", version)
+	}
+	batch := &kvBatch{playerID: r.uvarint()}
+	n := r.length()
+
+	for i := 0; i < n && r.err == nil; i++ {
+		if len(r.buf) == 0 {
+			return nil, errShortBuffer
+		}
+		op := r.buf[0]
+		r.buf = r.buf[1:]
+
+		container := ContainerType(r.varint())
+		switch op {
+		case kvOpUpsert:
+			batch.upserts = append(batch.upserts, ItemRecord{Container: container, Item: decodeItemState(r, version)})
+		case kvOpDelete:
+			batch.deletes = append(batch.deletes, ItemKey{Container: container, UID: r.uvarint()})
+		case kvOpCapacity:
+			c := ContainerCapacity{Container: container, MaxSize: int32(r.varint()), MaxLoad: int32(r.varint())}
+			if m := r.length(); m > 0 {
+				c.LockedSlots = make([]int16, 0, m)
+				for j := 0; j < m && r.err == nil; j++ {
+					c.LockedSlots = append(c.LockedSlots, int16(r.varint()))
+				}
+			}
+			batch.capacity = append(batch.capacity, c)
+		default:
+			return nil, errBadSnapshot
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return batch, nil
+}
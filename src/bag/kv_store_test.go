@@ -0,0 +1,135 @@
+package bag_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bag"
+)
+
+func openKV(t *testing.T, path string) *bag.KVFileStore {
+	store, err := bag.OpenKVFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenKVFileStore: %v", err)
+	}
+	return store
+}
+
+func writeOre(t *testing.T, store *bag.KVFileStore, uid uint64, count int64) {
+	record := bag.ItemRecord{Container: bag.KContainerTypeBag, Item: bag.ItemState{UID: uid, TID: tidOre, Count: count}}
+	if err := store.WriteItems(1, []bag.ItemRecord{record}, nil); err != nil {
+		t.Fatalf("WriteItems: %v", err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVReplayTornTail(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kv")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.kv")
+
+	store := openKV(t, path)
+	writeOre(t, store, 1, 10)
+	writeOre(t, store, 2, 20)
+	store.Close()
+	size := fileSize(t, path)
+
+	//>> 末尾写了一半的记录在打开时被截掉
+	appendFile(t, path, []byte{40, 0, 0, 0, 1, 2})
+	store = openKV(t, path)
+	records, _ := store.LoadItems(1)
+	store.Close()
+	if len(records) != 2 || fileSize(t, path) != size {
+		t.Fatalf("after torn tail: %d records, size %d want %d", len(records), fileSize(t, path), size)
+	}
+	//>> 长度写坏了的尾巴也截掉, 不按这个长度分配内存
+	appendFile(t, path, []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5})
+	store = openKV(t, path)
+	records, _ = store.LoadItems(1)
+	store.Close()
+	if len(records) != 2 || fileSize(t, path) != size {
+		t.Fatalf("after oversized tail: %d records, size %d want %d", len(records), fileSize(t, path), size)
+	}
+}
+
+func TestKVReplayCorruption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kv")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.kv")
+
+	store := openKV(t, path)
+	writeOre(t, store, 1, 10)
+	writeOre(t, store, 2, 20)
+	store.Close()
+
+	//>> 中间的记录坏了, 打开失败且文件不变
+	data, _ := ioutil.ReadFile(path)
+	corrupt := append([]byte(nil), data...)
+	corrupt[10] ^= 0xff
+	ioutil.WriteFile(path, corrupt, 0644)
+	if _, err := bag.OpenKVFileStore(path); err == nil {
+		t.Fatal("open with a corrupt middle record should fail")
+	}
+	if got, _ := ioutil.ReadFile(path); len(got) != len(data) {
+		t.Fatalf("corrupt file truncated to %d bytes", len(got))
+	}
+
+	//>> 新版本写的记录, 哪怕在末尾也不能截掉
+	ioutil.WriteFile(path, data, 0644)
+	payload := []byte{99, 1, 0}
+	record := make([]byte, 8)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	appendFile(t, path, append(record, payload...))
+	size := fileSize(t, path)
+	if _, err := bag.OpenKVFileStore(path); err == nil {
+		t.Fatal("open with a newer record version should fail")
+	}
+	if fileSize(t, path) != size {
+		t.Fatal("file with a newer record was truncated")
+	}
+}
+
+func TestKVCompactFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kv")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.kv")
+
+	//>> 让压缩的临时文件建不出来
+	os.Mkdir(path+".compact", 0755)
+	store := openKV(t, path)
+	defer store.Close()
+
+	records := make([]bag.ItemRecord, 2000)
+	for i := range records {
+		records[i] = bag.ItemRecord{Container: bag.KContainerTypeBag, Item: bag.ItemState{UID: 1, TID: tidOre, Count: int64(i + 1)}}
+	}
+	if err := store.WriteItems(1, records, nil); err != nil {
+		t.Fatalf("WriteItems should succeed when only compaction fails: %v", err)
+	}
+	if loaded, _ := store.LoadItems(1); len(loaded) != 1 || loaded[0].Item.Count != 2000 {
+		t.Fatalf("loaded %+v", loaded)
+	}
+}
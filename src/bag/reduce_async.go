@@ -0,0 +1,212 @@
+package bag
+
+import (
+	"timer"
+)
+
+/**
+* @Description: 异步扣除
+	有些一级货币在外部系统里(比如平台充值币), 不能同步扣. AsyncReduceItem先冻结要扣的数量,
+	冻结期间TryReduce和SwapOut都把冻结的部分当作不可用, 然后通过AsyncReduceHandler通知外部去扣.
+	外部扣完调用ConfirmReduce: 成功才真正从容器里删道具, 失败或超时解除冻结, 最后都会调用cb.
+	超时用timer实现, 和过期一样只在回调里投递任务, 所以只有挂在ItemComponent下的容器才有超时
+**/
+
+//>> 一次异步扣除的预扣记录
+type ReduceReservation struct {
+	ID        uint64
+	Container ContainerType
+	Items     []ItemTidDesc
+	Reason    ItemChangeReason
+
+	cb    func(err ItemError)
+	timer timer.HTimer
+}
+
+//>> 通知外部系统扣除, 外部处理完后用res.ID调用ConfirmReduce
+type AsyncReduceHandler func(res *ReduceReservation)
+
+//>> 设置异步扣除的外部处理, timeout为等待确认的毫秒数, <=0表示不超时
+//>> handler为nil时AsyncReduceItem直接同步扣除
+func (this *ContainerBase) SetAsyncReduceHandler(handler AsyncReduceHandler, timeout int64) {
+	this.asyncReduce = handler
+	this.asyncTimeout = timeout
+}
+
+//>> 异步扣道具, 先冻结数量, 外部确认后再扣, 结果通过cb返回
+func (this *ContainerBase) AsyncReduceItem(items []ItemTidDesc, reason ItemChangeReason, cb func(err ItemError)) {
+	if cb == nil {
+		cb = func(ItemError) {}
+	}
+
+	if this.asyncReduce == nil {
+		cb(atomically(this.tx, this.Begin, func() ItemError {
+			return this.ReduceItems(items, reason)
+		}))
+		return
+	}
+
+	if err := this.TryReduceItems(items); err != nil {
+		cb(err)
+		return
+	}
+
+	res := &ReduceReservation{
+		ID:        nextUID(),
+		Container: this.GetType(),
+		Items:     append([]ItemTidDesc(nil), items...),
+		Reason:    reason,
+		cb:        cb,
+	}
+	this.freeze(res)
+
+	//>> 事务中发起的预扣, 等事务提交后再通知外部, 回滚就当没发生过
+	if this.tx != nil {
+		this.tx.record(func() {
+			this.unfreeze(res)
+		})
+		this.tx.deferCommit(func() {
+			this.startReduce(res)
+		})
+		return
+	}
+	this.startReduce(res)
+}
+
+//>> 外部确认异步扣除的结果, err为nil时扣掉冻结的道具, 否则解除冻结; 都会调用发起时的cb
+func (this *ContainerBase) ConfirmReduce(id uint64, err ItemError) ItemError {
+	res, ok := this.reservations[id]
+	if !ok {
+		return NewItemError(ErrReservationNotExist)
+	}
+
+	this.unfreeze(res)
+	if res.timer != timer.InvalidHTimer {
+		timer.KillTimer(res.timer)
+		res.timer = timer.InvalidHTimer
+	}
+
+	if err == nil {
+		err = atomically(this.tx, this.Begin, func() ItemError {
+			return this.ReduceItems(res.Items, res.Reason)
+		})
+	}
+	res.cb(err)
+	return nil
+}
+
+//>> 冻结数量
+func (this *ContainerBase) GetFrozenCount(tid int32) int64 {
+	return this.frozen[tid]
+}
+
+//>> 通知外部并开始计时
+func (this *ContainerBase) startReduce(res *ReduceReservation) {
+	if this.asyncTimeout > 0 && this.owner != nil {
+		owner := this.owner
+		res.timer = timer.SetTimer(this.asyncTimeout, 1, func(interface{}) bool {
+			owner.post(func() {
+				res.timer = timer.InvalidHTimer
+				err := NewItemError(ErrReduceTimeout)
+				err.Param = append(err.Param, int(uint32(res.ID)))
+				this.ConfirmReduce(res.ID, err)
+			})
+			return false
+		}, nil)
+	}
+
+	this.asyncReduce(res)
+}
+
+func (this *ContainerBase) freeze(res *ReduceReservation) {
+	if this.reservations == nil {
+		this.reservations = make(map[uint64]*ReduceReservation)
+	}
+
+	for _, item := range res.Items {
+		this.addFrozen(item.TID, item.Count)
+	}
+	this.reservations[res.ID] = res
+}
+
+func (this *ContainerBase) addFrozen(tid int32, count int64) {
+	if this.frozen == nil {
+		this.frozen = make(map[int32]int64)
+	}
+	if this.frozen[tid] += count; this.frozen[tid] <= 0 {
+		delete(this.frozen, tid)
+	}
+	if count < 0 && this.owner != nil {
+		this.owner.recheckExpire()
+	}
+}
+
+func (this *ContainerBase) unfreeze(res *ReduceReservation) {
+	if _, ok := this.reservations[res.ID]; !ok {
+		return
+	}
+
+	for _, item := range res.Items {
+		this.addFrozen(item.TID, -item.Count)
+	}
+	delete(this.reservations, res.ID)
+}
+
+//>> 扣掉count个之后剩下的不能少于冻结的数量, 按uid锁定的部分不算在剩下的里面
+func (this *ContainerBase) checkFrozen(tid int32, count int64) ItemError {
+	frozen := this.frozen[tid]
+	if frozen <= 0 {
+		return nil
+	}
+
+	if left := this.GetItemCount(tid) - count - this.lockedTotal[tid]; left < frozen {
+		err := NewItemError(ErrItemNotEnough)
+		err.Param = append(err.Param, int(tid), int(frozen-left))
+		return err
+	}
+	return nil
+}
+
+//>> 异步扣道具, 结果通过cb返回. 货币从钱包扣; 一次预扣只对应一个容器, 货币和道具混在一起时返回ErrMixedContainers
+func (this *ItemComponent) AsyncReduceItem(typ ContainerType, items []ItemTidDesc, reason ItemChangeReason, cb func(err ItemError)) {
+	if cb == nil {
+		cb = func(ItemError) {}
+	}
+
+	containers, groups, err := this.routeItems(typ, items)
+	if err != nil {
+		cb(err)
+		return
+	}
+	switch len(containers) {
+	case 0:
+		//>> 没有要扣的, 直接成功, 不用预扣也不用通知外部
+		cb(nil)
+	case 1:
+		containers[0].AsyncReduceItem(groups[0], reason, cb)
+	default:
+		cb(NewItemError(ErrMixedContainers))
+	}
+}
+
+//>> 外部确认异步扣除的结果, 可以在其他线程调用, 在下一次Update里处理
+func (this *ItemComponent) ConfirmReduce(id uint64, err ItemError) {
+	this.post(func() {
+		for _, container := range this.containers {
+			if container.ConfirmReduce(id, err) == nil {
+				return
+			}
+		}
+	})
+}
+
+//>> 给所有容器设置异步扣除的外部处理
+func (this *ItemComponent) SetAsyncReduceHandler(handler AsyncReduceHandler, timeout int64) {
+	for _, container := range this.containers {
+		if c, ok := container.(interface {
+			SetAsyncReduceHandler(AsyncReduceHandler, int64)
+		}); ok {
+			c.SetAsyncReduceHandler(handler, timeout)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package bag_test
+
+import (
+	"testing"
+	"time"
+
+	"bag"
+)
+
+func TestAsyncReduceRouting(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidGold, 100, 1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+
+	var pending *bag.ReduceReservation
+	component.SetAsyncReduceHandler(func(res *bag.ReduceReservation) { pending = res }, 0)
+
+	var mixed bag.ItemError
+	component.AsyncReduceItem(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidGold, Count: 10}, {TID: tidOre, Count: 1}}, 1, func(err bag.ItemError) {
+		mixed = err
+	})
+	if mixed == nil || mixed.Code != bag.ErrMixedContainers || pending != nil {
+		t.Fatalf("mixed reduce: %v", mixed)
+	}
+
+	//>> 什么都不扣时直接成功, 不通知外部
+	empty := bag.NewItemError(bag.ErrReduceTimeout)
+	component.AsyncReduceItem(bag.KContainerTypeBag, nil, 1, func(err bag.ItemError) {
+		empty = err
+	})
+	if empty != nil || pending != nil {
+		t.Fatalf("empty reduce: err %v reservation %+v", empty, pending)
+	}
+
+	//>> 货币从钱包扣
+	var result bag.ItemError
+	done := false
+	component.AsyncReduceItem(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidGold, Count: 30}}, 1, func(err bag.ItemError) {
+		result, done = err, true
+	})
+	if pending == nil || pending.Container != bag.KContainerTypeWallet {
+		t.Fatalf("gold reservation: %+v", pending)
+	}
+	component.ConfirmReduce(pending.ID, nil)
+	component.Update()
+	if !done || result != nil {
+		t.Fatalf("confirm: done %v err %v", done, result)
+	}
+	if got := component.GetItemCount(tidGold); got != 70 {
+		t.Fatalf("gold = %d, want 70", got)
+	}
+}
+
+func TestAsyncReduceTimeout(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+	component.SetAsyncReduceHandler(func(res *bag.ReduceReservation) {}, 20)
+
+	var result bag.ItemError
+	done := false
+	component.AsyncReduceItem(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 8}}, 1, func(err bag.ItemError) {
+		result, done = err, true
+	})
+
+	for deadline := time.Now().Add(time.Second); !done && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		component.Update()
+	}
+	if !done || result == nil || result.Code != bag.ErrReduceTimeout {
+		t.Fatalf("timeout: done %v err %v", done, result)
+	}
+	if got := component.GetItemCount(tidOre); got != 10 {
+		t.Fatalf("ore = %d after timeout, want 10", got)
+	}
+	if err := component.TryReduceItemByTID(bag.KContainerTypeBag, tidOre, 10); err != nil {
+		t.Fatalf("ore still frozen after timeout: %v", err)
+	}
+}
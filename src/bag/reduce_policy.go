@@ -0,0 +1,133 @@
+package bag
+
+import "sort"
+
+/**
+* @Description: 扣除策略, 同一模板有多个堆时决定先扣哪个
+	默认顺序: 绑定的优先 -> 快过期的优先 -> 先获得的优先 -> 数量少的优先
+	策划有特殊规则时实现ReducePolicy, 或者用ReducePolicyChain自己组合规则
+**/
+
+//>> 扣除策略
+type ReducePolicy interface {
+	//>> a比b先扣返回true
+	Less(a, b ItemInterface) bool
+}
+
+//>> 单条扣除规则, a先扣返回负数, b先扣返回正数, 分不出先后返回0
+type ReduceRule func(a, b ItemInterface) int
+
+//>> 规则链，前面的规则分不出先后时再看后面的
+type ReducePolicyChain []ReduceRule
+
+func (this ReducePolicyChain) Less(a, b ItemInterface) bool {
+	for _, rule := range this {
+		if ret := rule(a, b); ret != 0 {
+			return ret < 0
+		}
+	}
+	return false
+}
+
+//>> 绑定的优先扣
+func ReduceBindFirst(a, b ItemInterface) int {
+	return compareBool(a.GetFlag()&IsBind != 0, b.GetFlag()&IsBind != 0)
+}
+
+//>> 快过期的优先扣, 不过期的最后扣
+func ReduceExpireFirst(a, b ItemInterface) int {
+	ea, eb := a.GetExpireTime(), b.GetExpireTime()
+	switch {
+	case ea == eb:
+		return 0
+	case ea == 0:
+		return 1
+	case eb == 0:
+		return -1
+	case ea < eb:
+		return -1
+	default:
+		return 1
+	}
+}
+
+//>> 先获得的优先扣
+func ReduceOldestFirst(a, b ItemInterface) int {
+	return compareInt64(a.GetCreateTime(), b.GetCreateTime())
+}
+
+//>> 数量少的优先扣, 尽快腾出格子
+func ReduceSmallestFirst(a, b ItemInterface) int {
+	return compareInt64(a.GetCount(), b.GetCount())
+}
+
+var DefaultReducePolicy ReducePolicy = ReducePolicyChain{
+	ReduceBindFirst,
+	ReduceExpireFirst,
+	ReduceOldestFirst,
+	ReduceSmallestFirst,
+}
+
+//>> 设置容器的扣除策略, nil表示用默认策略
+func (this *ContainerBase) SetReducePolicy(policy ReducePolicy) {
+	this.reducePolicy = policy
+}
+
+//>> 按扣除策略排好序的同模板道具
+func (this *ContainerBase) getItemsForReduce(tid int32) []ItemInterface {
+	policy := this.reducePolicy
+	if policy == nil {
+		policy = DefaultReducePolicy
+	}
+
+	items := this.GetItemsByTID(tid)
+	sort.SliceStable(items, func(i, j int) bool { return policy.Less(items[i], items[j]) })
+	return items
+}
+
+//>> 按扣除策略依次从多个堆里扣, 调用前需要检查数量足够
+func (this *ContainerBase) reduceByTID(tid int32, count int64, reason ItemChangeReason) {
+	for _, item := range this.getItemsForReduce(tid) {
+		if count <= 0 {
+			break
+		}
+
+		//>> 交易锁定的部分不能扣
+		n := item.GetCount() - this.locked[item.GetUID()]
+		if n > count {
+			n = count
+		}
+		if n <= 0 {
+			continue
+		}
+		this.delItem(item.GetUID(), n, reason)
+		count -= n
+	}
+
+	if count > 0 {
+		panic("(this *ContainerBase) reduceByTID item not enough")
+	}
+}
+
+//>> true排前面
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
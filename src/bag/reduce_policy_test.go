@@ -0,0 +1,65 @@
+package bag_test
+
+import (
+	"testing"
+	"time"
+
+	"bag"
+)
+
+func TestReducePolicy(t *testing.T) {
+	container := bag.NewBag(10, 0)
+	ores, _ := container.AddItem(tidOre, 40, 1)
+	plain := ores[0]
+	soon, _ := container.SplitItem(plain.GetUID(), 10, -1)
+	later, _ := container.SplitItem(plain.GetUID(), 10, -1)
+	bound, _ := container.SplitItem(plain.GetUID(), 10, -1)
+
+	now := time.Now().Unix()
+	soon.SetExpireTime(now + 100)
+	later.SetExpireTime(now + 200)
+	bound.SetExpireTime(now + 300)
+	bound.SetFlag(bag.IsBind)
+
+	//>> 绑定的先扣完, 再扣快过期的
+	if err := container.ReduceItemByTID(tidOre, 15, 1); err != nil {
+		t.Fatalf("reduce 15: %v", err)
+	}
+	if container.GetItemByUID(bound.GetUID()) != nil || soon.GetCount() != 5 || later.GetCount() != 10 || plain.GetCount() != 10 {
+		t.Fatalf("after 15: soon %d later %d plain %d", soon.GetCount(), later.GetCount(), plain.GetCount())
+	}
+	//>> 不过期的最后扣
+	if err := container.ReduceItemByTID(tidOre, 10, 1); err != nil {
+		t.Fatalf("reduce 10: %v", err)
+	}
+	if container.GetItemByUID(soon.GetUID()) != nil || later.GetCount() != 5 || plain.GetCount() != 10 {
+		t.Fatalf("after 25: later %d plain %d", later.GetCount(), plain.GetCount())
+	}
+
+	//>> 自定义策略: 只按数量
+	container.SetReducePolicy(bag.ReducePolicyChain{bag.ReduceSmallestFirst})
+	if err := container.ReduceItemByTID(tidOre, 5, 1); err != nil {
+		t.Fatalf("reduce 5: %v", err)
+	}
+	if container.GetItemByUID(later.GetUID()) != nil || plain.GetCount() != 10 {
+		t.Fatalf("smallest first should take the 5-stack, plain %d", plain.GetCount())
+	}
+}
+
+func TestReduceRules(t *testing.T) {
+	a, b := bag.NewItem(tidOre, 1), bag.NewItem(tidOre, 2)
+	if bag.ReduceSmallestFirst(a, b) >= 0 || bag.ReduceSmallestFirst(b, a) <= 0 {
+		t.Fatal("smaller stack should come first")
+	}
+	if bag.ReduceExpireFirst(a, b) != 0 {
+		t.Fatal("two stacks without expiry should tie")
+	}
+	b.SetExpireTime(100)
+	if bag.ReduceExpireFirst(a, b) <= 0 {
+		t.Fatal("expiring stack should come before a permanent one")
+	}
+	a.SetFlag(bag.IsBind)
+	if !bag.DefaultReducePolicy.Less(a, b) {
+		t.Fatal("bind should outrank expiry in the default chain")
+	}
+}
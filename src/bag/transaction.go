@@ -0,0 +1,138 @@
+package bag
+
+/**
+* @Description: 道具事务
+	Begin之后容器的每一次修改(items, tid2UIDs, 格子/负重, 道具数量, updateQueue)都会记一条撤销操作,
+	Rollback按相反顺序撤销, 容器恢复到Begin时的样子; Commit丢弃撤销记录.
+	一个事务可以加入多个容器, 跨容器的操作要么全成功要么全撤销.
+**/
+
+//>> 可以加入事务的容器
+type transactional interface {
+	getTransaction() *Transaction
+	setTransaction(tx *Transaction)
+}
+
+type Transaction struct {
+	undo     []func()
+	members  []transactional
+	onCommit []func() //>> 提交后才执行的操作, 比如写审计日志
+	onFinish []func()
+	finished bool
+}
+
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+//>> 把容器加入事务，容器已经在别的事务中或不支持事务返回false
+func (this *Transaction) Join(container ContainerInterface) bool {
+	if this.finished {
+		return false
+	}
+
+	member, ok := container.(transactional)
+	if !ok {
+		return false
+	}
+
+	if cur := member.getTransaction(); cur != nil {
+		return cur == this
+	}
+
+	member.setTransaction(this)
+	this.members = append(this.members, member)
+	return true
+}
+
+//>> 提交，所有修改生效
+func (this *Transaction) Commit() {
+	if this.finished {
+		return
+	}
+	this.undo = nil
+	onCommit := this.onCommit
+	this.onCommit = nil
+	this.finish()
+
+	for _, fn := range onCommit {
+		fn()
+	}
+}
+
+//>> 回滚，撤销事务中的所有修改
+func (this *Transaction) Rollback() {
+	if this.finished {
+		return
+	}
+	this.rollbackTo(0)
+	this.onCommit = nil
+	this.finish()
+}
+
+//>> 记录一条撤销操作
+func (this *Transaction) record(undo func()) {
+	this.undo = append(this.undo, undo)
+}
+
+//>> 提交后再执行fn, 回滚时丢弃
+func (this *Transaction) deferCommit(fn func()) {
+	n := len(this.onCommit)
+	this.onCommit = append(this.onCommit, fn)
+	this.record(func() {
+		this.onCommit = this.onCommit[:n]
+	})
+}
+
+//>> 当前撤销记录位置，配合rollbackTo实现事务内的部分回滚
+func (this *Transaction) savepoint() int {
+	return len(this.undo)
+}
+
+func (this *Transaction) rollbackTo(savepoint int) {
+	for i := len(this.undo) - 1; i >= savepoint; i-- {
+		this.undo[i]()
+	}
+	this.undo = this.undo[:savepoint]
+}
+
+func (this *Transaction) finish() {
+	this.finished = true
+	for _, member := range this.members {
+		member.setTransaction(nil)
+	}
+	this.members = nil
+	for _, fn := range this.onFinish {
+		fn()
+	}
+	this.onFinish = nil
+}
+
+//>> 原子地执行fn: 已经在事务中就并入该事务, fn失败时只撤销fn自己的修改; 否则用begin新开一个事务.
+//>> fn panic时和失败一样撤销, 然后继续panic
+func atomically(cur *Transaction, begin func() *Transaction, fn func() ItemError) ItemError {
+	if cur != nil {
+		savepoint := cur.savepoint()
+		done := false
+		defer func() {
+			if !done {
+				cur.rollbackTo(savepoint)
+			}
+		}()
+		err := fn()
+		done = err == nil
+		return err
+	}
+
+	tx := begin()
+	if tx == nil {
+		return NewItemError(ErrTransactionConflict)
+	}
+	defer tx.Rollback() //>> 已经结束时什么都不做, 只在panic时生效
+	if err := fn(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
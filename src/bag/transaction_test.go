@@ -0,0 +1,107 @@
+package bag_test
+
+import (
+	"testing"
+	"time"
+
+	"bag"
+)
+
+func TestAtomicPanicRollsBack(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic should propagate")
+			}
+		}()
+		component.Atomic(func() bag.ItemError {
+			component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 4, 1)
+			panic("boom")
+		})
+	}()
+
+	if got := component.GetItemCount(tidOre); got != 10 {
+		t.Fatalf("ore = %d after panic, want 10", got)
+	}
+	if err := component.Atomic(func() bag.ItemError { return nil }); err != nil {
+		t.Fatalf("component still in transaction: %v", err)
+	}
+}
+
+func TestActorPanicInTransaction(t *testing.T) {
+	actor := bag.NewItemActor(bag.NewItemComponent(1), 16, time.Millisecond)
+	defer actor.Stop()
+	actor.AddItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 10}}, 1)
+
+	err := actor.Call(func(component *bag.ItemComponent) bag.ItemError {
+		component.Begin()
+		component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 4, 1)
+		panic("boom")
+	})
+	if err == nil {
+		t.Fatal("panicking op should fail")
+	}
+
+	if got := actor.GetItemCount(tidOre); got != 10 {
+		t.Fatalf("ore = %d after panic, want 10", got)
+	}
+	if _, err := actor.AddItems(bag.KContainerTypeBag, []bag.ItemTidDesc{{TID: tidOre, Count: 1}}, 1); err != nil {
+		t.Fatalf("actor wedged after panic: %v", err)
+	}
+}
+
+func TestReduceAndAddRollback(t *testing.T) {
+	container := bag.NewBag(2, 0)
+	container.AddItem(tidOre, 50, 1)
+	container.AddItem(tidSword, 1, 1)
+
+	//>> 扣掉的矿石腾出一格, 放得下一把剑
+	if err := container.ReduceAndAddItems([]bag.ItemTidDesc{{TID: tidOre, Count: 50}}, []bag.ItemTidDesc{{TID: tidSword, Count: 1}}, 1); err != nil {
+		t.Fatalf("ReduceAndAddItems: %v", err)
+	}
+	if container.GetItemCount(tidOre) != 0 || container.GetItemCount(tidSword) != 2 {
+		t.Fatalf("after exchange: ore %d sword %d", container.GetItemCount(tidOre), container.GetItemCount(tidSword))
+	}
+
+	//>> 放不下时扣掉的也还回来, 原来的道具和格子不变
+	container = bag.NewBag(2, 0)
+	ores, _ := container.AddItem(tidOre, 50, 1)
+	container.AddItem(tidSword, 1, 1)
+	pos := ores[0].GetPos()
+	if err := container.ReduceAndAddItems([]bag.ItemTidDesc{{TID: tidOre, Count: 10}}, []bag.ItemTidDesc{{TID: tidSword, Count: 1}}, 1); err == nil || err.Code != bag.ErrContainerFull {
+		t.Fatalf("exchange into a full bag: %v", err)
+	}
+	if container.GetItemByUID(ores[0].GetUID()) != ores[0] || ores[0].GetCount() != 50 || ores[0].GetPos() != pos {
+		t.Fatalf("ore after rollback: count %d pos %d", ores[0].GetCount(), ores[0].GetPos())
+	}
+	if container.GetSize() != 2 || container.GetItemCount(tidSword) != 1 {
+		t.Fatalf("after rollback: size %d sword %d", container.GetSize(), container.GetItemCount(tidSword))
+	}
+}
+
+func TestNestedAtomic(t *testing.T) {
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidOre, 10, 1)
+
+	err := component.Atomic(func() bag.ItemError {
+		component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 3, 1)
+		//>> 内层失败只撤销内层的修改
+		inner := component.Atomic(func() bag.ItemError {
+			component.ReduceItemByTID(bag.KContainerTypeBag, tidOre, 5, 1)
+			return bag.NewItemError(bag.ErrInvalidCount)
+		})
+		if inner == nil {
+			t.Error("inner Atomic should fail")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("outer Atomic: %v", err)
+	}
+	if got := component.GetItemCount(tidOre); got != 7 {
+		t.Fatalf("ore = %d, want 7", got)
+	}
+}
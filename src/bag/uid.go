@@ -0,0 +1,105 @@
+package bag
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+* @Description: 道具uid生成
+	默认用雪花算法: 41位毫秒时间戳 | 10位服务器id | 12位序列号
+	同一毫秒序列号用完或者时钟回拨时借用下一毫秒, 保证单调递增; 不同服务器靠服务器id区分
+	进程重启后内存里的进度没了, 时钟回拨或者之前借用过未来的毫秒都可能发出重复的uid,
+	所以启动时要用已经发出的最大uid调SeedUID, 之后发的uid都比它大. 从存档恢复背包时也会用存档里的uid播种
+**/
+
+//>> uid生成器，可以替换成项目自己的全局id服务
+type UIDGenerator interface {
+	NextUID() uint64
+}
+
+//>> 可以从已经发出的最大uid继续的生成器
+type SeedableUIDGenerator interface {
+	UIDGenerator
+	Seed(last uint64)
+}
+
+const (
+	snowflakeServerBits   = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxServerID  = 1<<snowflakeServerBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+//>> 时间戳起点 2020-01-01 00:00:00 UTC, 41位毫秒可以用69年
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+
+type SnowflakeGenerator struct {
+	lock     sync.Mutex
+	serverID uint64
+	lastTime int64
+	sequence uint64
+}
+
+//>> serverID取值[0, 1023], 超出返回nil
+func NewSnowflakeGenerator(serverID uint32) *SnowflakeGenerator {
+	if serverID > snowflakeMaxServerID {
+		return nil
+	}
+	return &SnowflakeGenerator{serverID: uint64(serverID)}
+}
+
+func (this *SnowflakeGenerator) NextUID() uint64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now().UnixNano()/int64(time.Millisecond) - snowflakeEpoch
+	if now > this.lastTime {
+		this.lastTime = now
+		this.sequence = 0
+	} else {
+		//>> 同一毫秒或时钟回拨, 继续用上次的时间戳
+		this.sequence++
+		if this.sequence > snowflakeMaxSequence {
+			this.lastTime++
+			this.sequence = 0
+		}
+	}
+
+	return uint64(this.lastTime)<<(snowflakeServerBits+snowflakeSequenceBits) |
+		this.serverID<<snowflakeSequenceBits |
+		this.sequence
+}
+
+//>> 之后发的uid都比last大
+func (this *SnowflakeGenerator) Seed(last uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	//>> 把last所在的毫秒当作序列号已经用完, 下一个uid至少从下一毫秒开始
+	if t := int64(last >> (snowflakeServerBits + snowflakeSequenceBits)); t >= this.lastTime {
+		this.lastTime = t
+		this.sequence = snowflakeMaxSequence
+	}
+}
+
+var uidGenerator UIDGenerator = NewSnowflakeGenerator(0)
+
+//>> 设置全局uid生成器, 多服部署时应该用带各自服务器id的生成器
+func SetUIDGenerator(generator UIDGenerator) {
+	if generator == nil {
+		generator = NewSnowflakeGenerator(0)
+	}
+	uidGenerator = generator
+}
+
+func nextUID() uint64 {
+	return uidGenerator.NextUID()
+}
+
+//>> 用已经发出的最大uid给全局生成器播种, 生成器不支持时忽略
+func SeedUID(last uint64) {
+	if generator, ok := uidGenerator.(SeedableUIDGenerator); ok {
+		generator.Seed(last)
+	}
+}
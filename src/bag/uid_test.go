@@ -0,0 +1,106 @@
+package bag_test
+
+import (
+	"testing"
+	"time"
+
+	"bag"
+)
+
+type seqGenerator struct {
+	next uint64
+}
+
+func (this *seqGenerator) NextUID() uint64 {
+	this.next++
+	return this.next
+}
+
+func TestSnowflakeGenerator(t *testing.T) {
+	if bag.NewSnowflakeGenerator(1024) != nil {
+		t.Fatal("server id 1024 should be rejected")
+	}
+
+	//>> 超过一毫秒的序列号数量, 借用下一毫秒也要单调递增
+	generator := bag.NewSnowflakeGenerator(7)
+	last := uint64(0)
+	for i := 0; i < 10000; i++ {
+		uid := generator.NextUID()
+		if uid <= last {
+			t.Fatalf("uid %d after %d is not increasing", uid, last)
+		}
+		if serverID := uid >> 12 & 1023; serverID != 7 {
+			t.Fatalf("uid %d carries server id %d, want 7", uid, serverID)
+		}
+		last = uid
+	}
+
+	//>> 不同服务器同时生成也不会重复
+	other := bag.NewSnowflakeGenerator(8)
+	if a, b := generator.NextUID(), other.NextUID(); a == b {
+		t.Fatalf("two servers generated the same uid %d", a)
+	}
+}
+
+func TestSplitItemUID(t *testing.T) {
+	bag.SetUIDGenerator(&seqGenerator{next: 100})
+	defer bag.SetUIDGenerator(nil)
+
+	container := bag.NewBag(10, 0)
+	ores, _ := container.AddItem(tidOre, 10, 1)
+	ore := ores[0]
+	if ore.GetUID() != 101 {
+		t.Fatalf("uid = %d, want 101 from the installed generator", ore.GetUID())
+	}
+
+	split, err := container.SplitItem(ore.GetUID(), 3, -1)
+	if err != nil {
+		t.Fatalf("SplitItem: %v", err)
+	}
+	if split.GetUID() != 102 || split.GetCount() != 3 || ore.GetCount() != 7 {
+		t.Fatalf("split uid %d count %d, ore %d", split.GetUID(), split.GetCount(), ore.GetCount())
+	}
+	if container.GetItemByUID(split.GetUID()) != split || split.GetPos() == ore.GetPos() {
+		t.Fatal("split stack not placed in its own slot")
+	}
+
+	for _, count := range []int64{0, 7, 8} {
+		if _, err := container.SplitItem(ore.GetUID(), count, -1); err == nil || err.Code != bag.ErrInvalidCount {
+			t.Fatalf("split %d of 7: %v", count, err)
+		}
+	}
+}
+
+func TestSnowflakeSeed(t *testing.T) {
+	//>> 上次运行借用了未来一小时的毫秒, 重启后时钟落后也不能发出更小的uid
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := uint64(time.Since(epoch)/time.Millisecond+60*60*1000)<<22 | 7<<12 | 5
+	generator := bag.NewSnowflakeGenerator(3)
+	generator.Seed(last)
+	if uid := generator.NextUID(); uid <= last {
+		t.Fatalf("uid %d after seed %d", uid, last)
+	}
+
+	//>> 从存档恢复时用存档里的uid播种
+	generator = bag.NewSnowflakeGenerator(3)
+	bag.SetUIDGenerator(generator)
+	defer bag.SetUIDGenerator(nil)
+
+	component := bag.NewItemComponent(1)
+	component.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	snapshot := component.Snapshot()
+	for i := range snapshot.Containers {
+		for j := range snapshot.Containers[i].Items {
+			snapshot.Containers[i].Items[j].UID = last
+		}
+	}
+
+	restored := bag.NewItemComponent(1)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	swords, _ := restored.AddItem(bag.KContainerTypeBag, tidSword, 1, 1)
+	if swords[0].GetUID() <= last {
+		t.Fatalf("uid %d after restoring %d", swords[0].GetUID(), last)
+	}
+}
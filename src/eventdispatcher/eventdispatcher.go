@@ -28,6 +28,12 @@ func (typ EventType) isValid() bool {
 const (
 	EventEnumNone EventType = iota
 
+	// 道具, 参数为*bag.ItemEvent
+	EventEnumItemAdded        // 获得新道具
+	EventEnumItemRemoved      // 道具被删除
+	EventEnumItemCountChanged // 已有道具数量变化
+	EventEnumItemEquipped     // 穿上装备
+
 	EventEnumCount
 )
 
@@ -0,0 +1,298 @@
+package loot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+
+	"bag"
+)
+
+/**
+* @Description: 掉落表
+	一张掉落表由必掉项和权重随机项组成, 每一项可以是一个道具(数量在[Min,Max]里随机), 也可以是另一张掉落表.
+	保底: Pity>0时, 连续Pity-1次没有抽到Rare项, 下一次只在Rare项里抽. 保底计数由调用方保存(PityState).
+	Resolver用固定种子时结果是确定的, 方便测试; Resolver不是线程安全的
+**/
+
+//>> 嵌套掉落表的最大深度, 加载时已经检查过环, 这里只是兜底
+const maxDepth = 16
+
+//>> 掉落项
+type Entry struct {
+	TID    int32 `json:"tid"`    //>> 掉落的道具, 和Table二选一
+	Table  int32 `json:"table"`  //>> 嵌套的掉落表
+	Min    int64 `json:"min"`    //>> 数量下限, 0当作1
+	Max    int64 `json:"max"`    //>> 数量上限, 小于Min时取Min; 嵌套表表示展开次数
+	Weight int32 `json:"weight"` //>> 随机权重, 必掉项不用填
+	Rare   bool  `json:"rare"`   //>> 稀有项, 抽到会重置保底计数
+}
+
+//>> 掉落表
+type Table struct {
+	ID         int32   `json:"id"`
+	Guaranteed []Entry `json:"guaranteed"` //>> 必掉
+	Entries    []Entry `json:"entries"`    //>> 按权重随机
+	Rolls      int     `json:"rolls"`      //>> 随机次数, 0当作1
+	Pity       int32   `json:"pity"`       //>> 保底次数, 0表示没有保底
+}
+
+//>> 所有掉落表
+type Tables map[int32]*Table
+
+//>> 保底计数, key为掉落表id, 需要调用方存盘
+type PityState map[int32]int32
+
+//>> 从json文件加载掉落表, 格式为掉落表数组
+func LoadTablesJSON(path string) (Tables, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Table
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	tables := make(Tables, len(list))
+	for _, table := range list {
+		if _, ok := tables[table.ID]; ok {
+			return nil, fmt.Errorf("duplicate loot table id:%d", table.ID)
+		}
+		tables[table.ID] = table
+	}
+	if err := tables.Validate(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+//>> 检查配置: 掉落项合法、嵌套的表存在且没有环
+func (this Tables) Validate() error {
+	for id, table := range this {
+		if table.Pity > 0 {
+			rare := false
+			for _, entry := range table.Entries {
+				rare = rare || entry.Rare
+			}
+			if !rare {
+				return fmt.Errorf("loot table %d has pity but no rare entry", id)
+			}
+		}
+
+		for _, entries := range [][]Entry{table.Guaranteed, table.Entries} {
+			for i, entry := range entries {
+				if (entry.TID == 0) == (entry.Table == 0) {
+					return fmt.Errorf("loot table %d entry %d needs exactly one of tid and table", id, i)
+				}
+				if entry.Table != 0 && this[entry.Table] == nil {
+					return fmt.Errorf("loot table %d entry %d refers to missing table %d", id, i, entry.Table)
+				}
+				if entry.Min < 0 || entry.Weight < 0 {
+					return fmt.Errorf("loot table %d entry %d has negative min or weight", id, i)
+				}
+			}
+		}
+	}
+
+	//>> 0未访问, 1访问中, 2已完成
+	state := make(map[int32]int)
+	var visit func(id int32) error
+	visit = func(id int32) error {
+		switch state[id] {
+		case 1:
+			return fmt.Errorf("loot table %d is nested in itself", id)
+		case 2:
+			return nil
+		}
+		state[id] = 1
+		table := this[id]
+		for _, entries := range [][]Entry{table.Guaranteed, table.Entries} {
+			for _, entry := range entries {
+				if entry.Table != 0 {
+					if err := visit(entry.Table); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		state[id] = 2
+		return nil
+	}
+	for id := range this {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//>> 掉落计算
+type Resolver struct {
+	tables Tables
+	rng    *rand.Rand
+}
+
+//>> seed相同时同样的调用顺序结果相同
+func NewResolver(tables Tables, seed int64) *Resolver {
+	return &Resolver{tables: tables, rng: rand.New(rand.NewSource(seed))}
+}
+
+//>> 计算一次掉落, 同模板的数量会合并, 顺序为第一次掉落的顺序; pity为nil表示不计保底
+func (this *Resolver) Resolve(tableID int32, pity PityState) ([]bag.ItemTidDesc, error) {
+	var ret []bag.ItemTidDesc
+	index := make(map[int32]int)
+	add := func(tid int32, count int64) {
+		if i, ok := index[tid]; ok {
+			ret[i].Count += count
+			return
+		}
+		index[tid] = len(ret)
+		ret = append(ret, bag.ItemTidDesc{TID: tid, Count: count})
+	}
+
+	if err := this.resolve(tableID, pity, add, 0); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (this *Resolver) resolve(tableID int32, pity PityState, add func(int32, int64), depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("loot table %d nested too deep", tableID)
+	}
+	table := this.tables[tableID]
+	if table == nil {
+		return fmt.Errorf("loot table %d not exist", tableID)
+	}
+
+	for i := range table.Guaranteed {
+		if err := this.drop(&table.Guaranteed[i], pity, add, depth); err != nil {
+			return err
+		}
+	}
+
+	rolls := table.Rolls
+	if rolls <= 0 {
+		rolls = 1
+	}
+	for ; rolls > 0 && len(table.Entries) > 0; rolls-- {
+		//>> 保底: 前面Pity-1次都没出稀有, 这次只在稀有项里抽
+		rareOnly := pity != nil && table.Pity > 0 && pity[table.ID] >= table.Pity-1
+		entry := this.pick(table.Entries, rareOnly)
+		if entry == nil {
+			continue
+		}
+
+		if pity != nil && table.Pity > 0 {
+			if entry.Rare {
+				delete(pity, table.ID)
+			} else {
+				pity[table.ID]++
+			}
+		}
+		if err := this.drop(entry, pity, add, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//>> 按权重选一项, 权重都是0时返回nil
+func (this *Resolver) pick(entries []Entry, rareOnly bool) *Entry {
+	total := int64(0)
+	for i := range entries {
+		if !rareOnly || entries[i].Rare {
+			total += int64(entries[i].Weight)
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	n := this.rng.Int63n(total)
+	for i := range entries {
+		if rareOnly && !entries[i].Rare {
+			continue
+		}
+		if n -= int64(entries[i].Weight); n < 0 {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+func (this *Resolver) drop(entry *Entry, pity PityState, add func(int32, int64), depth int) error {
+	count := this.count(entry)
+	if entry.Table == 0 {
+		add(entry.TID, count)
+		return nil
+	}
+
+	for ; count > 0; count-- {
+		if err := this.resolve(entry.Table, pity, add, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//>> [Min,Max]里随机一个数量
+func (this *Resolver) count(entry *Entry) int64 {
+	min, max := entry.Min, entry.Max
+	if min <= 0 {
+		min = 1
+	}
+	if max <= min {
+		return min
+	}
+	return min + this.rng.Int63n(max-min+1)
+}
+
+//>> 把奖励加到typ容器(货币会自动进钱包), 放不下时按背包的溢出策略处理:
+//>> KOverflowMail时每项能放下的部分照常加, 剩下的进溢出邮箱; 否则整批失败, 什么都不加
+func Grant(component *bag.ItemComponent, typ bag.ContainerType, items []bag.ItemTidDesc, reason bag.ItemChangeReason) (*bag.AddResult, bag.ItemError) {
+	return component.AddItemsWithResult(typ, items, reason)
+}
+
+//>> 宝箱的使用效果: 每开一个按tableID掉落一次, 奖励加到背包.
+//>> pity返回玩家的保底计数, nil表示不计保底; 保底计数在使用成功提交后才更新
+func ChestHandler(resolver *Resolver, tableID int32, pity func(ctx *bag.UseContext) PityState) bag.UseHandler {
+	return func(ctx *bag.UseContext) bag.ItemError {
+		var state, next PityState
+		if pity != nil {
+			if state = pity(ctx); state != nil {
+				next = make(PityState, len(state))
+				for id, n := range state {
+					next[id] = n
+				}
+			}
+		}
+
+		var drops []bag.ItemTidDesc
+		for i := int64(0); i < ctx.Count; i++ {
+			items, err := resolver.Resolve(tableID, next)
+			if err != nil {
+				itemErr := bag.NewItemError(bag.ErrItemCannotUse)
+				itemErr.Detail = err.Error()
+				itemErr.Param = append(itemErr.Param, int(ctx.Item.GetTID()))
+				return itemErr
+			}
+			drops = append(drops, items...)
+		}
+
+		if err := ctx.AddItems(drops); err != nil {
+			return err
+		}
+		if next != nil {
+			ctx.OnCommit(func() {
+				for id, n := range next {
+					state[id] = n
+				}
+			})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,159 @@
+package loot
+
+import (
+	"reflect"
+	"testing"
+
+	"bag"
+)
+
+const (
+	tidGold   = 1
+	tidPotion = 2
+	tidSword  = 3
+	tidGem    = 4
+)
+
+func testTables() Tables {
+	return Tables{
+		1: {
+			ID:         1,
+			Guaranteed: []Entry{{TID: tidGold, Min: 10, Max: 20}},
+			Entries:    []Entry{{TID: tidPotion, Weight: 90}, {Table: 2, Weight: 10, Rare: true}},
+			Rolls:      2,
+			Pity:       5,
+		},
+		2: {
+			ID:      2,
+			Entries: []Entry{{TID: tidSword, Weight: 1}, {TID: tidGem, Weight: 1, Min: 1, Max: 3}},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testTables().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := testTables()
+	tables[2].Entries = append(tables[2].Entries, Entry{Table: 1, Weight: 1})
+	if err := tables.Validate(); err == nil {
+		t.Fatal("cycle should be rejected")
+	}
+
+	tables = testTables()
+	tables[1].Entries[0].Table = 9
+	if err := tables.Validate(); err == nil {
+		t.Fatal("entry with both tid and table should be rejected")
+	}
+}
+
+func TestResolveDeterministic(t *testing.T) {
+	a, b := NewResolver(testTables(), 42), NewResolver(testTables(), 42)
+	for i := 0; i < 100; i++ {
+		x, err := a.Resolve(1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, _ := b.Resolve(1, nil)
+		if !reflect.DeepEqual(x, y) {
+			t.Fatalf("round %d: %v != %v", i, x, y)
+		}
+		if x[0].TID != tidGold || x[0].Count < 10 || x[0].Count > 20 {
+			t.Fatalf("guaranteed gold missing or out of range: %v", x)
+		}
+	}
+}
+
+func TestPity(t *testing.T) {
+	resolver := NewResolver(testTables(), 7)
+	pity := PityState{}
+	misses := int32(0)
+	for i := 0; i < 1000; i++ {
+		//>> 一次Resolve抽两次, 逐次看计数
+		before := pity[1]
+		items, err := resolver.Resolve(1, pity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rare := false
+		for _, item := range items {
+			rare = rare || item.TID == tidSword || item.TID == tidGem
+		}
+		if !rare {
+			misses = before + 2
+		} else {
+			misses = 0
+		}
+		if misses >= 5 || pity[1] >= 5 {
+			t.Fatalf("round %d: %d rolls without rare, pity %d", i, misses, pity[1])
+		}
+	}
+}
+
+func TestGrantOverflow(t *testing.T) {
+	bag.SetItemTemplateProvider(bag.ItemTemplateTable{
+		tidPotion: {TID: tidPotion, MaxOverlap: 10},
+		tidSword:  {TID: tidSword},
+	})
+	defer bag.SetItemTemplateProvider(nil)
+
+	component := bag.NewItemComponent(1)
+	//>> 占满背包只留一格
+	bagSize := component.GetContainerByType(bag.KContainerTypeBag).GetMaxSize()
+	component.AddItem(bag.KContainerTypeBag, tidSword, int64(bagSize-1), 1)
+
+	items := []bag.ItemTidDesc{{TID: tidPotion, Count: 15}, {TID: tidSword, Count: 2}}
+	if _, err := Grant(component, bag.KContainerTypeBag, items, 1); err == nil {
+		t.Fatal("Grant should fail when the bag is full and overflow is rejected")
+	}
+	if got := component.GetItemCount(tidPotion); got != 0 {
+		t.Fatalf("potion = %d after rejected grant, want 0", got)
+	}
+
+	//>> 放得下的一堆照常加, 只有剩下的进溢出邮箱
+	component.SetOverflowPolicy(bag.KOverflowMail, 0)
+	result, err := Grant(component, bag.KContainerTypeBag, items, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := component.GetItemCount(tidPotion); got != 10 {
+		t.Fatalf("potion = %d, want 10", got)
+	}
+	if result.Overflow == nil || !reflect.DeepEqual(result.Overflow.Items, []bag.ItemTidDesc{{TID: tidPotion, Count: 5}, {TID: tidSword, Count: 2}}) {
+		t.Fatalf("overflow = %+v", result.Overflow)
+	}
+}
+
+func TestChestHandler(t *testing.T) {
+	const tidChest = 5
+	bag.SetItemTemplateProvider(bag.ItemTemplateTable{
+		tidChest:  {TID: tidChest, MaxOverlap: 10},
+		tidPotion: {TID: tidPotion, MaxOverlap: 99},
+		tidGold:   {TID: tidGold, MaxOverlap: 9999},
+		tidGem:    {TID: tidGem, MaxOverlap: 99},
+		tidSword:  {TID: tidSword},
+	})
+	defer bag.SetItemTemplateProvider(nil)
+
+	pity := PityState{}
+	bag.RegisterUseHandler(tidChest, ChestHandler(NewResolver(testTables(), 1), 1, func(*bag.UseContext) PityState { return pity }))
+	defer bag.RegisterUseHandler(tidChest, nil)
+
+	component := bag.NewItemComponent(1)
+	chests, _ := component.AddItem(bag.KContainerTypeBag, tidChest, 3, 1)
+	result, err := component.UseItem(chests[0].GetUID(), 3, nil)
+	if err != nil {
+		t.Fatalf("UseItem: %v", err)
+	}
+	if component.GetItemCount(tidChest) != 0 || len(result.Added) == 0 {
+		t.Fatalf("chest %d, added %d", component.GetItemCount(tidChest), len(result.Added))
+	}
+	if gold := component.GetItemCount(tidGold); gold < 30 || gold > 60 {
+		t.Fatalf("gold = %d, want 3 guaranteed drops", gold)
+	}
+	if len(pity) == 0 {
+		t.Fatal("pity state not updated after commit")
+	}
+}
@@ -3,6 +3,7 @@ package timer
 import (
 	"container/list"
 	"math"
+	"sync"
 	"time"
 	"util"
 )
@@ -93,7 +94,10 @@ func newTimerWheel(wheelID uint32) *timerWheel {
 }
 
 // 定时器
+// 可以在任意goroutine里SetTimer/KillTimer, 轮子由mu保护, 回调在loop的goroutine里执行, 执行时不持有锁
 type Manager struct {
+	mu sync.Mutex
+
 	curScale   int64 //当前刻度
 	nextScale  int64 //真实时间指向的刻度
 	hashFinder []*timerCell
@@ -101,7 +105,6 @@ type Manager struct {
 
 	freeCellPool list.List
 
-	// todo: 线程安全  增加一个swap容器
 	eventQueue []*timerCell
 }
 
@@ -162,6 +165,9 @@ func (this *Manager) setTimer(interval int64, count uint32, callback func(interf
 		return InvalidHTimer
 	}
 
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	cell := this.getFreeCell()
 	if cell == nil {
 		return InvalidHTimer
@@ -179,6 +185,9 @@ func (this *Manager) setTimer(interval int64, count uint32, callback func(interf
 }
 
 func (this *Manager) killTimer(uid HTimer) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	cell := this.findTimerCell(uid)
 	if cell == nil {
 		return
@@ -192,6 +201,9 @@ func (this *Manager) killTimer(uid HTimer) {
 }
 
 func (this *Manager) getLeftTime(uid HTimer) int64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	cell := this.findTimerCell(uid)
 	if cell == nil || cell.callback == nil {
 		return 0
@@ -330,6 +342,7 @@ func (this *Manager) loop() {
 	util.PrintCover()
 
 	for {
+		this.mu.Lock()
 		this.nextScale = this.curScale + getDeltaMs()
 		//fmt.Println(this.curScale, this.nextScale)
 
@@ -353,7 +366,11 @@ func (this *Manager) loop() {
 
 				delListNode(it)
 
-				if !e.callback(e.args) || e.count <= 1 {
+				// 回调里可能再SetTimer/KillTimer, 先放开锁
+				this.mu.Unlock()
+				again := e.callback(e.args)
+				this.mu.Lock()
+				if !again || e.count <= 1 {
 					this.recycleCell(e)
 					continue
 				}
@@ -365,6 +382,7 @@ func (this *Manager) loop() {
 			}
 			this.curScale++
 		}
+		this.mu.Unlock()
 		time.Sleep(5 * time.Millisecond)
 	}
 }